@@ -48,12 +48,19 @@ func (this *EventLoop) Loop() {
 	}
 }
 
-func (this *EventLoop) RunInLoop(functor func()) {
+// RunInLoop queues functor to run on the loop, it reports false and drops
+// functor once the loop is closed.
+func (this *EventLoop) RunInLoop(functor func()) bool {
 	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		return false
+	}
 	this.functors = append(this.functors, functor)
 	this.mutex.Unlock()
 
 	this.cond.Signal()
+	return true
 }
 
 func (loop *EventLoop) Func(functor func()) func() {
@@ -13,3 +13,11 @@ func TestEventLoop(t *testing.T) {
 	})
 	loop.Loop()
 }
+
+func TestRunInLoopClosed(t *testing.T) {
+	loop := NewEventLoop()
+	loop.Close()
+	if loop.RunInLoop(func() {}) {
+		t.Fatal("functor queued on a closed loop")
+	}
+}
@@ -1,10 +1,15 @@
 package eventloop
 
+import (
+	"sync"
+)
+
 type Pool struct {
 	workers []*Worker
 	loops   []*EventLoop
 
-	next int
+	mutex sync.Mutex
+	next  int
 }
 
 func NewPool(numWorkers int, handler LoopHandler) *Pool {
@@ -32,11 +37,13 @@ func (this *Pool) GetNextLoop() *EventLoop {
 	if len(this.loops) == 0 {
 		return nil
 	}
+	this.mutex.Lock()
 	index := this.next
 	this.next++
 	if this.next >= len(this.loops) {
 		this.next = 0
 	}
+	this.mutex.Unlock()
 	return this.loops[index]
 }
 
@@ -44,7 +51,7 @@ func (this *Pool) GetLoopForHash(hashCode int) *EventLoop {
 	if len(this.loops) == 0 {
 		return nil
 	}
-	index := hashCode % len(this.loops)
+	index := int(uint(hashCode) % uint(len(this.loops)))
 	return this.loops[index]
 }
 
@@ -0,0 +1,303 @@
+package network
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBanned                  = errors.New("network: source banned")
+	ErrTooManyConnections      = errors.New("network: too many connections")
+	ErrTooManyConnectionsPerIP = errors.New("network: too many connections from source")
+	ErrAcceptRate              = errors.New("network: accept rate limit exceeded")
+	ErrMessageRate             = errors.New("network: message rate limit exceeded")
+)
+
+// AdmissionConfig sets the limits of an Admission, zero means no limit.
+type AdmissionConfig struct {
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	AcceptRate          float64 // connections accepted per second
+	AcceptBurst         int     // connections accepted at once, at least 1
+	MessageRate         float64 // messages received per second by each connection
+	MessageBurst        int     // messages received at once, at least 1
+	Log                 bool    // log rejected connections and connections over the message rate
+}
+
+type AdmissionStats struct {
+	Connections    int
+	Accepted       uint64
+	Banned         uint64 // rejected as banned
+	OverMax        uint64 // rejected over MaxConnections
+	OverPerIP      uint64 // rejected over MaxConnectionsPerIP
+	OverAcceptRate uint64 // rejected over AcceptRate
+	OverMessage    uint64 // closed over MessageRate
+}
+
+// Admission decides which connections servers accept, see WithAdmission.
+// Its ban list may be changed at any time and it may be shared by servers
+// so that the limits apply to them together.
+type Admission struct {
+	config AdmissionConfig
+	accept *tokenBucket
+
+	mutex       sync.Mutex
+	connections int
+	perIP       map[string]int
+	bans        map[string]time.Time // zero for no expiry
+	stats       AdmissionStats
+}
+
+func NewAdmission(config AdmissionConfig) *Admission {
+	return &Admission{
+		config: config,
+		accept: newTokenBucket(config.AcceptRate, config.AcceptBurst),
+		perIP:  make(map[string]int),
+		bans:   make(map[string]time.Time),
+	}
+}
+
+// Ban rejects the connections from ip for d, or until Unban when d is not
+// positive. Connections already accepted are not closed.
+func (a *Admission) Ban(ip net.IP, d time.Duration) {
+	var expiry time.Time
+	if d > 0 {
+		expiry = time.Now().Add(d)
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.removeExpired()
+	a.bans[ip.String()] = expiry
+}
+
+func (a *Admission) Unban(ip net.IP) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.bans, ip.String())
+}
+
+func (a *Admission) IsBanned(ip net.IP) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.isBanned(ip.String(), time.Now())
+}
+
+// Bans returns the banned IPs with their expiry, zero for none.
+func (a *Admission) Bans() map[string]time.Time {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.removeExpired()
+	bans := make(map[string]time.Time, len(a.bans))
+	for ip, expiry := range a.bans {
+		bans[ip] = expiry
+	}
+	return bans
+}
+
+func (a *Admission) Stats() AdmissionStats {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	stats := a.stats
+	stats.Connections = a.connections
+	return stats
+}
+
+func (a *Admission) isBanned(ip string, now time.Time) bool {
+	expiry, ok := a.bans[ip]
+	if !ok {
+		return false
+	}
+	if !expiry.IsZero() && !now.Before(expiry) {
+		delete(a.bans, ip)
+		return false
+	}
+	return true
+}
+
+func (a *Admission) removeExpired() {
+	now := time.Now()
+	for ip := range a.bans {
+		a.isBanned(ip, now)
+	}
+}
+
+// admit counts a connection from addr, it must be released once closed.
+func (a *Admission) admit(addr net.Addr) error {
+	if err := a.reserve(addr); err != nil {
+		return err
+	}
+	if err := a.admitReserved(addr); err != nil {
+		a.unreserve()
+		return err
+	}
+	return nil
+}
+
+// reserve counts a connection from addr against the bans, MaxConnections
+// and AcceptRate, before its client address is known such as behind a PROXY
+// protocol header. admitReserved checks the client address, the reserved
+// connection is released by unreserve when it fails.
+func (a *Admission) reserve(addr net.Addr) error {
+	if a == nil {
+		return nil
+	}
+	a.mutex.Lock()
+	err := a.checkReserve(addrIP(addr))
+	a.mutex.Unlock()
+	a.logRejected(addr, err)
+	return err
+}
+
+// admitReserved checks the client address of a reserved connection against
+// the bans and MaxConnectionsPerIP, it must be released once closed.
+func (a *Admission) admitReserved(addr net.Addr) error {
+	if a == nil {
+		return nil
+	}
+	a.mutex.Lock()
+	err := a.checkClient(addrIP(addr))
+	a.mutex.Unlock()
+	a.logRejected(addr, err)
+	return err
+}
+
+func (a *Admission) unreserve() {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.connections--
+}
+
+func (a *Admission) logRejected(addr net.Addr, err error) {
+	if err != nil && a.config.Log {
+		log.Printf("network: connection from %v rejected: %v", addr, err)
+	}
+}
+
+// checkReserve is called with a.mutex held.
+func (a *Admission) checkReserve(ip string) error {
+	if a.isBanned(ip, time.Now()) {
+		a.stats.Banned++
+		return ErrBanned
+	}
+	if a.config.MaxConnections > 0 && a.connections >= a.config.MaxConnections {
+		a.stats.OverMax++
+		return ErrTooManyConnections
+	}
+	if !a.accept.allow() {
+		a.stats.OverAcceptRate++
+		return ErrAcceptRate
+	}
+	a.connections++
+	return nil
+}
+
+// checkClient is called with a.mutex held.
+func (a *Admission) checkClient(ip string) error {
+	if a.isBanned(ip, time.Now()) {
+		a.stats.Banned++
+		return ErrBanned
+	}
+	if a.config.MaxConnectionsPerIP > 0 && a.perIP[ip] >= a.config.MaxConnectionsPerIP {
+		a.stats.OverPerIP++
+		return ErrTooManyConnectionsPerIP
+	}
+	a.perIP[ip]++
+	a.stats.Accepted++
+	return nil
+}
+
+func (a *Admission) release(addr net.Addr) {
+	if a == nil {
+		return
+	}
+	ip := addrIP(addr)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.connections--
+	if a.perIP[ip]--; a.perIP[ip] <= 0 {
+		delete(a.perIP, ip)
+	}
+}
+
+// messageLimiter returns the message rate limiter of a connection, nil for
+// no limit.
+func (a *Admission) messageLimiter() *tokenBucket {
+	if a == nil {
+		return nil
+	}
+	return newTokenBucket(a.config.MessageRate, a.config.MessageBurst)
+}
+
+// overMessageRate records a connection closed over the message rate.
+func (a *Admission) overMessageRate(addr net.Addr) {
+	a.mutex.Lock()
+	a.stats.OverMessage++
+	a.mutex.Unlock()
+	if a.config.Log {
+		log.Printf("network: connection from %v closed: %v", addr, ErrMessageRate)
+	}
+}
+
+func addrIP(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case *net.UDPAddr:
+		return addr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// tokenBucket allows rate events per second, up to burst at once.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,103 @@
+package network_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/iakud/plume/network"
+)
+
+// dialAdmitted dials addr and reports whether the server kept the connection.
+func dialAdmitted(t *testing.T, addr string) (net.Conn, bool) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+	_, err = conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		conn.SetReadDeadline(time.Time{})
+		return conn, true
+	}
+	conn.Close()
+	return nil, false
+}
+
+func TestAdmission(t *testing.T) {
+	admission := network.NewAdmission(network.AdmissionConfig{MaxConnectionsPerIP: 1})
+	server := network.NewTCPServer("localhost:8025", network.WithAdmission(admission))
+	go server.ListenAndServe(nil, nil)
+	defer server.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	conn, ok := dialAdmitted(t, "localhost:8025")
+	if !ok {
+		t.Fatal("connection rejected")
+	}
+	if _, ok := dialAdmitted(t, "localhost:8025"); ok {
+		t.Fatal("connection over the per IP limit admitted")
+	}
+	conn.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	admission.Ban(net.IPv4(127, 0, 0, 1), time.Millisecond*200)
+	if _, ok := dialAdmitted(t, "localhost:8025"); ok {
+		t.Fatal("banned connection admitted")
+	}
+	time.Sleep(time.Millisecond * 200)
+	conn, ok = dialAdmitted(t, "localhost:8025")
+	if !ok {
+		t.Fatal("connection rejected after the ban expired")
+	}
+	defer conn.Close()
+
+	stats := admission.Stats()
+	if stats.Connections != 1 || stats.Accepted != 2 || stats.OverPerIP != 1 || stats.Banned != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestAdmissionAcceptRate(t *testing.T) {
+	admission := network.NewAdmission(network.AdmissionConfig{AcceptRate: 1})
+	server := network.NewTCPServer("localhost:8026", network.WithAdmission(admission))
+	go server.ListenAndServe(nil, nil)
+	defer server.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	conn, ok := dialAdmitted(t, "localhost:8026")
+	if !ok {
+		t.Fatal("connection rejected")
+	}
+	defer conn.Close()
+	if _, ok := dialAdmitted(t, "localhost:8026"); ok {
+		t.Fatal("connection over the accept rate admitted")
+	}
+	if stats := admission.Stats(); stats.OverAcceptRate != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestAdmissionMessageRate(t *testing.T) {
+	srv := newCloseReasonHandler()
+	admission := network.NewAdmission(network.AdmissionConfig{MessageRate: 1, MessageBurst: 2})
+	codec := network.NewVarintCodec(0)
+	server := network.NewTCPServer("localhost:8027", network.WithAdmission(admission))
+	go server.ListenAndServe(srv, codec)
+	defer server.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	conn, err := net.Dial("tcp", "localhost:8027")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-srv.connected
+	for i := 0; i < 3; i++ {
+		codec.Write(conn, []byte("hello"))
+	}
+	srv.wait(t, network.CloseRateLimit)
+	if stats := admission.Stats(); stats.OverMessage != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
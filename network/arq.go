@@ -0,0 +1,590 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+var (
+	ErrARQSegment  = errors.New("network: invalid ARQ segment")
+	ErrARQDeadLink = errors.New("network: ARQ segment retransmitted too many times")
+)
+
+// ARQConfig configures the reliable ordered mode of UDP connections, a
+// protocol compatible in spirit with KCP. The zero value is the normal mode,
+// for low latency set NoDelay, a 10ms Interval, Resend 2 and NoCongestion.
+type ARQConfig struct {
+	SendWindow    int           // segments in flight, default 128
+	ReceiveWindow int           // segments buffered for reordering, default 128
+	NoDelay       bool          // 30ms minimum RTO instead of 100ms, and RTO grows by half instead of doubling
+	Interval      time.Duration // flush interval, default 100ms
+	Resend        int           // fast retransmit after Resend later segments are acked, 0 disables
+	NoCongestion  bool          // disable the congestion window
+	MTU           int           // maximum datagram size, default 1400, larger than the 24 byte segment header
+	DeadLink      int           // retransmissions of a segment before the connection is closed, default 20
+}
+
+func (c ARQConfig) withDefaults() ARQConfig {
+	if c.SendWindow <= 0 {
+		c.SendWindow = 128
+	}
+	if c.ReceiveWindow <= 0 {
+		c.ReceiveWindow = 128
+	}
+	if c.Interval <= 0 {
+		c.Interval = 100 * time.Millisecond
+	}
+	if c.MTU <= 0 {
+		c.MTU = 1400
+	}
+	if c.DeadLink <= 0 {
+		c.DeadLink = 20
+	}
+	return c
+}
+
+const (
+	arqHeaderSize = 24
+
+	arqCmdPush = 81 // data
+	arqCmdAck  = 82 // ack of a push
+	arqCmdWask = 83 // window probe
+	arqCmdWins = 84 // window size
+	arqCmdFin  = 85 // the peer closed the connection
+
+	arqAskSend = 1 // send a window probe
+	arqAskTell = 2 // tell the window size
+
+	arqRTODefault = 200
+	arqRTOMin     = 100
+	arqRTONoDelay = 30
+	arqRTOMax     = 60000
+	arqProbeInit  = 7000
+	arqProbeLimit = 120000
+	arqThreshInit = 2
+	arqThreshMin  = 2
+	arqMaxFrags   = 255
+)
+
+type arqSegment struct {
+	conv     uint32
+	cmd      uint8
+	frg      uint8
+	wnd      uint16
+	ts       uint32
+	sn       uint32
+	una      uint32
+	resendts uint32
+	rto      uint32
+	fastack  uint32
+	xmit     uint32
+	data     []byte
+}
+
+func (seg *arqSegment) encode(b []byte) []byte {
+	var h [arqHeaderSize]byte
+	binary.LittleEndian.PutUint32(h[0:], seg.conv)
+	h[4] = seg.cmd
+	h[5] = seg.frg
+	binary.LittleEndian.PutUint16(h[6:], seg.wnd)
+	binary.LittleEndian.PutUint32(h[8:], seg.ts)
+	binary.LittleEndian.PutUint32(h[12:], seg.sn)
+	binary.LittleEndian.PutUint32(h[16:], seg.una)
+	binary.LittleEndian.PutUint32(h[20:], uint32(len(seg.data)))
+	return append(append(b, h[:]...), seg.data...)
+}
+
+// arqConv returns the conversation of the first segment in b.
+func arqConv(b []byte) (uint32, bool) {
+	if len(b) < arqHeaderSize {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(b), true
+}
+
+type arqAck struct {
+	sn uint32
+	ts uint32
+}
+
+// arq is the state of one conversation, it is not safe for concurrent use.
+type arq struct {
+	conv     uint32
+	mtu      uint32
+	mss      uint32
+	interval uint32
+	nodelay  bool
+	resend   uint32
+	nocwnd   bool
+	deadLink uint32
+
+	sndUna, sndNxt, rcvNxt uint32
+	ssthresh               uint32
+	rxRttval, rxSrtt       int32
+	rxRto, rxMinrto        uint32
+	sndWnd, rcvWnd, rmtWnd uint32
+	cwnd, incr             uint32
+	probe                  uint32
+	tsProbe, probeWait     uint32
+	dead                   bool
+	fin                    bool
+
+	sndQueue []arqSegment
+	rcvQueue []arqSegment
+	sndBuf   []arqSegment
+	rcvBuf   []arqSegment
+	acklist  []arqAck
+	buffer   []byte
+
+	start  time.Time
+	output func(b []byte)
+}
+
+func newARQ(conv uint32, config ARQConfig, output func(b []byte)) *arq {
+	a := &arq{
+		conv:     conv,
+		mtu:      uint32(config.MTU),
+		mss:      uint32(config.MTU - arqHeaderSize),
+		interval: uint32(config.Interval / time.Millisecond),
+		nodelay:  config.NoDelay,
+		resend:   uint32(config.Resend),
+		nocwnd:   config.NoCongestion,
+		deadLink: uint32(config.DeadLink),
+		ssthresh: arqThreshInit,
+		rxRto:    arqRTODefault,
+		rxMinrto: arqRTOMin,
+		sndWnd:   uint32(config.SendWindow),
+		rcvWnd:   uint32(config.ReceiveWindow),
+		rmtWnd:   uint32(config.ReceiveWindow),
+		cwnd:     1,
+		start:    time.Now(),
+		output:   output,
+	}
+	if a.nodelay {
+		a.rxMinrto = arqRTONoDelay
+	}
+	if a.interval < 1 {
+		a.interval = 1
+	}
+	a.incr = a.mss
+	a.buffer = make([]byte, 0, a.mtu)
+	return a
+}
+
+func (a *arq) current() uint32 {
+	return uint32(time.Since(a.start) / time.Millisecond)
+}
+
+func timediff(later, earlier uint32) int32 {
+	return int32(later - earlier)
+}
+
+// fragments returns how many segments a message of n bytes takes, ok is
+// false when it is too large.
+func (a *arq) fragments(n int) (int, bool) {
+	count := 1
+	if n > int(a.mss) {
+		count = (n + int(a.mss) - 1) / int(a.mss)
+	}
+	return count, count <= arqMaxFrags && count < int(a.rcvWnd)
+}
+
+// send queues a message, it must not be too large, see fragments.
+func (a *arq) send(b []byte) {
+	count, _ := a.fragments(len(b))
+	for i := 0; i < count; i++ {
+		size := len(b)
+		if size > int(a.mss) {
+			size = int(a.mss)
+		}
+		seg := arqSegment{
+			frg:  uint8(count - i - 1),
+			data: append([]byte(nil), b[:size]...),
+		}
+		a.sndQueue = append(a.sndQueue, seg)
+		b = b[size:]
+	}
+}
+
+// waitSnd returns the segments not acked yet.
+func (a *arq) waitSnd() int {
+	return len(a.sndBuf) + len(a.sndQueue)
+}
+
+// recv returns the next complete message.
+func (a *arq) recv() ([]byte, bool) {
+	if len(a.rcvQueue) == 0 {
+		return nil, false
+	}
+	count := int(a.rcvQueue[0].frg) + 1
+	if len(a.rcvQueue) < count {
+		return nil, false
+	}
+	full := len(a.rcvQueue) >= int(a.rcvWnd)
+	size := 0
+	for _, seg := range a.rcvQueue[:count] {
+		size += len(seg.data)
+	}
+	b := make([]byte, 0, size)
+	for _, seg := range a.rcvQueue[:count] {
+		b = append(b, seg.data...)
+	}
+	a.rcvQueue = removeSegments(a.rcvQueue, count)
+	a.moveReceived()
+	if full && len(a.rcvQueue) < int(a.rcvWnd) {
+		a.probe |= arqAskTell // tell the peer the window opened
+	}
+	return b, true
+}
+
+func removeSegments(segs []arqSegment, n int) []arqSegment {
+	m := copy(segs, segs[n:])
+	for i := m; i < len(segs); i++ {
+		segs[i] = arqSegment{}
+	}
+	return segs[:m]
+}
+
+// moveReceived moves the in order segments from rcvBuf to rcvQueue.
+func (a *arq) moveReceived() {
+	n := 0
+	for n < len(a.rcvBuf) && a.rcvBuf[n].sn == a.rcvNxt && len(a.rcvQueue) < int(a.rcvWnd) {
+		a.rcvQueue = append(a.rcvQueue, a.rcvBuf[n])
+		a.rcvNxt++
+		n++
+	}
+	a.rcvBuf = removeSegments(a.rcvBuf, n)
+}
+
+func (a *arq) updateAck(rtt int32) {
+	if a.rxSrtt == 0 {
+		a.rxSrtt = rtt
+		a.rxRttval = rtt / 2
+	} else {
+		delta := rtt - a.rxSrtt
+		if delta < 0 {
+			delta = -delta
+		}
+		a.rxRttval = (3*a.rxRttval + delta) / 4
+		a.rxSrtt = (7*a.rxSrtt + rtt) / 8
+		if a.rxSrtt < 1 {
+			a.rxSrtt = 1
+		}
+	}
+	rto := uint32(a.rxSrtt) + maxUint32(a.interval, uint32(4*a.rxRttval))
+	a.rxRto = minUint32(maxUint32(a.rxMinrto, rto), arqRTOMax)
+}
+
+func (a *arq) shrinkBuf() {
+	if len(a.sndBuf) > 0 {
+		a.sndUna = a.sndBuf[0].sn
+	} else {
+		a.sndUna = a.sndNxt
+	}
+}
+
+func (a *arq) parseAck(sn uint32) {
+	if timediff(sn, a.sndUna) < 0 || timediff(sn, a.sndNxt) >= 0 {
+		return
+	}
+	for i := range a.sndBuf {
+		if a.sndBuf[i].sn == sn {
+			copy(a.sndBuf[i:], a.sndBuf[i+1:])
+			a.sndBuf[len(a.sndBuf)-1] = arqSegment{}
+			a.sndBuf = a.sndBuf[:len(a.sndBuf)-1]
+			return
+		}
+		if timediff(sn, a.sndBuf[i].sn) < 0 {
+			return
+		}
+	}
+}
+
+func (a *arq) parseUna(una uint32) {
+	n := 0
+	for n < len(a.sndBuf) && timediff(una, a.sndBuf[n].sn) > 0 {
+		n++
+	}
+	a.sndBuf = removeSegments(a.sndBuf, n)
+}
+
+func (a *arq) parseFastack(sn, ts uint32) {
+	if timediff(sn, a.sndUna) < 0 || timediff(sn, a.sndNxt) >= 0 {
+		return
+	}
+	for i := range a.sndBuf {
+		seg := &a.sndBuf[i]
+		if timediff(sn, seg.sn) < 0 {
+			return
+		}
+		if seg.sn != sn && timediff(ts, seg.ts) >= 0 {
+			seg.fastack++
+		}
+	}
+}
+
+func (a *arq) parseData(seg arqSegment) {
+	sn := seg.sn
+	if timediff(sn, a.rcvNxt+a.rcvWnd) >= 0 || timediff(sn, a.rcvNxt) < 0 {
+		return
+	}
+	i := len(a.rcvBuf)
+	for i > 0 && timediff(a.rcvBuf[i-1].sn, sn) > 0 {
+		i--
+	}
+	if i > 0 && a.rcvBuf[i-1].sn == sn {
+		return // duplicate
+	}
+	seg.data = append([]byte(nil), seg.data...)
+	a.rcvBuf = append(a.rcvBuf, arqSegment{})
+	copy(a.rcvBuf[i+1:], a.rcvBuf[i:])
+	a.rcvBuf[i] = seg
+	a.moveReceived()
+}
+
+// input processes a datagram from the peer.
+func (a *arq) input(b []byte) error {
+	prevUna := a.sndUna
+	var maxack, latestTs uint32
+	acked := false
+	current := a.current()
+	for len(b) >= arqHeaderSize {
+		var seg arqSegment
+		seg.conv = binary.LittleEndian.Uint32(b)
+		seg.cmd = b[4]
+		seg.frg = b[5]
+		seg.wnd = binary.LittleEndian.Uint16(b[6:])
+		seg.ts = binary.LittleEndian.Uint32(b[8:])
+		seg.sn = binary.LittleEndian.Uint32(b[12:])
+		seg.una = binary.LittleEndian.Uint32(b[16:])
+		length := binary.LittleEndian.Uint32(b[20:])
+		b = b[arqHeaderSize:]
+		if seg.conv != a.conv || uint32(len(b)) < length {
+			return ErrARQSegment
+		}
+		if seg.cmd < arqCmdPush || seg.cmd > arqCmdFin {
+			return ErrARQSegment
+		}
+		seg.data = b[:length]
+		b = b[length:]
+
+		a.rmtWnd = uint32(seg.wnd)
+		a.parseUna(seg.una)
+		a.shrinkBuf()
+		switch seg.cmd {
+		case arqCmdAck:
+			if rtt := timediff(current, seg.ts); rtt >= 0 {
+				a.updateAck(rtt)
+			}
+			a.parseAck(seg.sn)
+			a.shrinkBuf()
+			if !acked || timediff(seg.sn, maxack) > 0 {
+				acked = true
+				maxack, latestTs = seg.sn, seg.ts
+			}
+		case arqCmdPush:
+			if timediff(seg.sn, a.rcvNxt+a.rcvWnd) < 0 {
+				a.acklist = append(a.acklist, arqAck{seg.sn, seg.ts})
+				if timediff(seg.sn, a.rcvNxt) >= 0 {
+					a.parseData(seg)
+				}
+			}
+		case arqCmdWask:
+			a.probe |= arqAskTell
+		case arqCmdFin:
+			a.fin = true
+		}
+	}
+	if acked {
+		a.parseFastack(maxack, latestTs)
+	}
+	if timediff(a.sndUna, prevUna) > 0 && a.cwnd < a.rmtWnd {
+		// grow the congestion window
+		if a.cwnd < a.ssthresh {
+			a.cwnd++
+			a.incr += a.mss
+		} else {
+			if a.incr < a.mss {
+				a.incr = a.mss
+			}
+			a.incr += (a.mss*a.mss)/a.incr + a.mss/16
+			if (a.cwnd+1)*a.mss <= a.incr {
+				a.cwnd++
+			}
+		}
+		if a.cwnd > a.rmtWnd {
+			a.cwnd = a.rmtWnd
+			a.incr = a.rmtWnd * a.mss
+		}
+	}
+	return nil
+}
+
+func (a *arq) wndUnused() uint16 {
+	if len(a.rcvQueue) < int(a.rcvWnd) {
+		return uint16(int(a.rcvWnd) - len(a.rcvQueue))
+	}
+	return 0
+}
+
+// appendSegment adds seg to the pending datagram, sending it first when seg
+// does not fit.
+func (a *arq) appendSegment(seg *arqSegment) {
+	if len(a.buffer)+arqHeaderSize+len(seg.data) > int(a.mtu) {
+		a.output(a.buffer)
+		a.buffer = a.buffer[:0]
+	}
+	a.buffer = seg.encode(a.buffer)
+}
+
+// flush sends acks, window probes and the segments due, it is called every
+// interval.
+func (a *arq) flush() {
+	current := a.current()
+	seg := arqSegment{
+		conv: a.conv,
+		cmd:  arqCmdAck,
+		wnd:  a.wndUnused(),
+		una:  a.rcvNxt,
+	}
+	for _, ack := range a.acklist {
+		seg.sn, seg.ts = ack.sn, ack.ts
+		a.appendSegment(&seg)
+	}
+	a.acklist = a.acklist[:0]
+
+	// probe the window when the peer has none
+	if a.rmtWnd == 0 {
+		if a.probeWait == 0 {
+			a.probeWait = arqProbeInit
+			a.tsProbe = current + a.probeWait
+		} else if timediff(current, a.tsProbe) >= 0 {
+			a.probeWait += a.probeWait / 2
+			if a.probeWait > arqProbeLimit {
+				a.probeWait = arqProbeLimit
+			}
+			a.tsProbe = current + a.probeWait
+			a.probe |= arqAskSend
+		}
+	} else {
+		a.tsProbe = 0
+		a.probeWait = 0
+	}
+	seg.sn, seg.ts = 0, 0
+	if a.probe&arqAskSend != 0 {
+		seg.cmd = arqCmdWask
+		a.appendSegment(&seg)
+	}
+	if a.probe&arqAskTell != 0 {
+		seg.cmd = arqCmdWins
+		a.appendSegment(&seg)
+	}
+	a.probe = 0
+
+	cwnd := minUint32(a.sndWnd, a.rmtWnd)
+	if !a.nocwnd {
+		cwnd = minUint32(a.cwnd, cwnd)
+	}
+	n := 0
+	for n < len(a.sndQueue) && timediff(a.sndNxt, a.sndUna+cwnd) < 0 {
+		s := a.sndQueue[n]
+		s.conv = a.conv
+		s.cmd = arqCmdPush
+		s.sn = a.sndNxt
+		a.sndNxt++
+		a.sndBuf = append(a.sndBuf, s)
+		n++
+	}
+	a.sndQueue = removeSegments(a.sndQueue, n)
+
+	resent := a.resend
+	if resent == 0 {
+		resent = 0xffffffff
+	}
+	rtomin := uint32(0)
+	if !a.nodelay {
+		rtomin = a.rxRto >> 3
+	}
+	change, lost := false, false
+	for i := range a.sndBuf {
+		s := &a.sndBuf[i]
+		send := false
+		switch {
+		case s.xmit == 0:
+			send = true
+			s.rto = a.rxRto
+			s.resendts = current + s.rto + rtomin
+		case timediff(current, s.resendts) >= 0:
+			send = true
+			if a.nodelay {
+				s.rto += s.rto / 2
+			} else {
+				s.rto += maxUint32(s.rto, a.rxRto)
+			}
+			s.rto = minUint32(s.rto, arqRTOMax)
+			s.resendts = current + s.rto
+			lost = true
+		case s.fastack >= resent:
+			send = true
+			s.fastack = 0
+			s.resendts = current + s.rto
+			change = true
+		}
+		if !send {
+			continue
+		}
+		s.xmit++
+		s.ts = current
+		s.wnd = seg.wnd
+		s.una = a.rcvNxt
+		a.appendSegment(s)
+		if s.xmit >= a.deadLink {
+			a.dead = true
+		}
+	}
+	if len(a.buffer) > 0 {
+		a.output(a.buffer)
+		a.buffer = a.buffer[:0]
+	}
+
+	if change {
+		a.ssthresh = maxUint32((a.sndNxt-a.sndUna)/2, arqThreshMin)
+		a.cwnd = a.ssthresh + resent
+		a.incr = a.cwnd * a.mss
+	}
+	if lost {
+		a.ssthresh = maxUint32(cwnd/2, arqThreshMin)
+		a.cwnd = 1
+		a.incr = a.mss
+	}
+	if a.cwnd < 1 {
+		a.cwnd = 1
+		a.incr = a.mss
+	}
+}
+
+// finSegment returns the datagram telling the peer the connection is closed.
+func (a *arq) finSegment() []byte {
+	seg := arqSegment{
+		conv: a.conv,
+		cmd:  arqCmdFin,
+		wnd:  a.wndUnused(),
+		una:  a.rcvNxt,
+	}
+	return seg.encode(nil)
+}
+
+func minUint32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxUint32(a, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,148 @@
+package network
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Backoff decides how long clients wait before dialing again, see
+// WithBackoff.
+type Backoff interface {
+	// Next returns the delay before the retry attempt, counted from 1, when
+	// the dials failed for elapsed. ok false stops retrying.
+	Next(attempt int, elapsed time.Duration) (delay time.Duration, ok bool)
+}
+
+// ExponentialBackoff multiplies the delay on each attempt up to Max. The zero
+// value waits 1s, 2s, 4s and so on up to 1min and retries forever.
+type ExponentialBackoff struct {
+	Initial     time.Duration // default 1s
+	Max         time.Duration // default 1min
+	Multiplier  float64       // default 2
+	Jitter      float64       // the delay is randomized by up to this fraction, such as 0.2
+	MaxAttempts int           // zero means no limit
+	MaxElapsed  time.Duration // zero means no limit
+}
+
+var (
+	jitterMutex sync.Mutex
+	jitterRand  = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func (b ExponentialBackoff) Next(attempt int, elapsed time.Duration) (time.Duration, bool) {
+	if b.MaxAttempts > 0 && attempt > b.MaxAttempts {
+		return 0, false
+	}
+	if b.MaxElapsed > 0 && elapsed >= b.MaxElapsed {
+		return 0, false
+	}
+	initial, max, multiplier := b.Initial, b.Max, b.Multiplier
+	if initial <= 0 {
+		initial = time.Second
+	}
+	if max <= 0 {
+		max = time.Minute
+	}
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	delay := float64(initial) * math.Pow(multiplier, float64(attempt-1))
+	if delay > float64(max) {
+		delay = float64(max)
+	}
+	if b.Jitter > 0 {
+		jitterMutex.Lock()
+		delay += (jitterRand.Float64()*2 - 1) * b.Jitter * delay
+		jitterMutex.Unlock()
+	}
+	return time.Duration(delay), true
+}
+
+// retrier counts the failed dials of a client and waits between them.
+type retrier struct {
+	backoff  Backoff
+	callback func(attempt int, delay time.Duration, err error)
+	attempt  int
+	start    time.Time
+}
+
+func newRetrier(opts *options) *retrier {
+	r := &retrier{
+		backoff:  opts.backoff,
+		callback: opts.retryCallback,
+	}
+	if r.backoff == nil {
+		r.backoff = ExponentialBackoff{}
+	}
+	return r
+}
+
+// next returns the delay before dialing again after err, ok is false when
+// the backoff gives up.
+func (r *retrier) next(err error) (time.Duration, bool) {
+	if r.attempt == 0 {
+		r.start = time.Now()
+	}
+	r.attempt++
+	delay, ok := r.backoff.Next(r.attempt, time.Since(r.start))
+	if !ok {
+		return 0, false
+	}
+	if r.callback != nil {
+		r.callback(r.attempt, delay, err)
+	}
+	return delay, true
+}
+
+func (r *retrier) reset() {
+	r.attempt = 0
+}
+
+// clientContext returns a context canceled when ctx is done or done is
+// closed by the client Close. When ctx is done first closeConnection is
+// called with ctx.Err().
+func clientContext(ctx context.Context, done <-chan struct{}, closeConnection func(err error)) (context.Context, context.CancelFunc) {
+	parent := ctx
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+			if err := parent.Err(); err != nil {
+				closeConnection(err)
+			}
+		}
+	}()
+	return ctx, cancel
+}
+
+// dial dials addr with the dial function and timeout of opts.
+func dial(ctx context.Context, network, addr string, opts *options) (net.Conn, error) {
+	if opts.dial == nil {
+		dialer := net.Dialer{Timeout: opts.dialTimeout}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	if opts.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.dialTimeout)
+		defer cancel()
+	}
+	return opts.dial(ctx, addr)
+}
+
+// sleep waits for d, it returns false when ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
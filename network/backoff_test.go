@@ -0,0 +1,80 @@
+package network_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/iakud/plume/network"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := network.ExponentialBackoff{Initial: time.Millisecond * 10, Max: time.Millisecond * 50, MaxAttempts: 4}
+	want := []time.Duration{time.Millisecond * 10, time.Millisecond * 20, time.Millisecond * 40, time.Millisecond * 50}
+	for i, d := range want {
+		delay, ok := backoff.Next(i+1, 0)
+		if !ok || delay != d {
+			t.Fatalf("attempt %d: delay %v, %v", i+1, delay, ok)
+		}
+	}
+	if _, ok := backoff.Next(5, 0); ok {
+		t.Fatal("retry over MaxAttempts")
+	}
+
+	backoff = network.ExponentialBackoff{Initial: time.Second, Jitter: 0.5, MaxElapsed: time.Minute}
+	for i := 0; i < 100; i++ {
+		delay, _ := backoff.Next(1, 0)
+		if delay < time.Millisecond*500 || delay > time.Millisecond*1500 {
+			t.Fatalf("jittered delay %v", delay)
+		}
+	}
+	if _, ok := backoff.Next(1, time.Minute); ok {
+		t.Fatal("retry over MaxElapsed")
+	}
+}
+
+func TestTCPClientRetry(t *testing.T) {
+	var attempts int
+	client := network.NewTCPClient("localhost:8030",
+		network.WithBackoff(network.ExponentialBackoff{Initial: time.Millisecond, MaxAttempts: 3}),
+		network.WithRetryCallback(func(attempt int, delay time.Duration, err error) {
+			attempts = attempt
+		}),
+	)
+	if err := client.DialAndServe(nil, nil); err == nil || errors.Is(err, network.ErrClientClosed) {
+		t.Fatalf("DialAndServe: %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("attempts %d", attempts)
+	}
+}
+
+func TestTCPClientDialCancel(t *testing.T) {
+	client := network.NewTCPClient("localhost:8030", network.WithBackoff(network.ExponentialBackoff{Initial: time.Hour}))
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*100, cancel)
+	if err := client.DialAndServeContext(ctx, nil, nil); err != context.Canceled {
+		t.Fatalf("DialAndServeContext: %v", err)
+	}
+
+	time.AfterFunc(time.Millisecond*100, client.Close)
+	if err := client.DialAndServe(nil, nil); err != network.ErrClientClosed {
+		t.Fatalf("DialAndServe: %v", err)
+	}
+}
+
+func TestTCPClientContextClose(t *testing.T) {
+	server := network.NewTCPServer("localhost:8031")
+	go server.ListenAndServe(nil, nil)
+	defer server.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	client := network.NewTCPClient("localhost:8031", network.WithDialTimeout(time.Second))
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	if err := client.DialAndServeContext(ctx, nil, nil); err != context.DeadlineExceeded {
+		t.Fatalf("DialAndServeContext: %v", err)
+	}
+}
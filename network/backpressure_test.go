@@ -0,0 +1,175 @@
+package network_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/iakud/plume/network"
+)
+
+type slowConsumerClient struct {
+	connected chan *network.TCPConnection
+	reasons   chan network.CloseReason
+}
+
+func (c *slowConsumerClient) Connect(connection *network.TCPConnection, connected bool) {
+	if connected {
+		c.connected <- connection
+		return
+	}
+	c.reasons <- connection.CloseReason()
+}
+
+func (c *slowConsumerClient) Receive(*network.TCPConnection, []byte) {}
+
+// dialSlowConsumer returns a connection to a peer that never reads, with its
+// background writer blocked and one message pending.
+func dialSlowConsumer(t *testing.T, backpressure network.Backpressure) (*network.TCPConnection, *slowConsumerClient) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+
+	c := &slowConsumerClient{
+		connected: make(chan *network.TCPConnection, 1),
+		reasons:   make(chan network.CloseReason, 1),
+	}
+	client := network.NewTCPClient(ln.Addr().String())
+	go client.DialAndServe(c, nil)
+	t.Cleanup(client.Close)
+	connection := <-c.connected
+
+	message := make([]byte, 1<<20)
+	for i := 0; i < 64; i++ {
+		connection.Send(message)
+	}
+	time.Sleep(time.Millisecond * 100)
+	connection.SetBackpressure(backpressure)
+	if err := connection.Send(message); err != nil {
+		t.Fatal(err)
+	}
+	if stats := connection.SendStats(); stats.QueuedMessages != 1 {
+		t.Fatalf("queued %d messages, want 1", stats.QueuedMessages)
+	}
+	return connection, c
+}
+
+func TestBackpressureReject(t *testing.T) {
+	connection, _ := dialSlowConsumer(t, network.Backpressure{MaxMessages: 2})
+	if err := connection.Send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := connection.Send([]byte("hello")); err != network.ErrConnectionPendingSendFull {
+		t.Fatalf("send: %v, want ErrConnectionPendingSendFull", err)
+	}
+	stats := connection.SendStats()
+	if stats.QueuedMessages != 2 || stats.QueuedBytes != 1<<20+5 || stats.Rejected != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestBackpressureMaxBytes(t *testing.T) {
+	connection, _ := dialSlowConsumer(t, network.Backpressure{MaxBytes: 1<<20 + 10})
+	if err := connection.Send(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := connection.Send([]byte("x")); err != network.ErrConnectionPendingSendFull {
+		t.Fatalf("send: %v, want ErrConnectionPendingSendFull", err)
+	}
+	if stats := connection.SendStats(); stats.QueuedBytes != 1<<20+10 || stats.HighWaterMark < 1<<20+10 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestBackpressureDropOldest(t *testing.T) {
+	connection, _ := dialSlowConsumer(t, network.Backpressure{MaxMessages: 2, Policy: network.OverflowDropOldest})
+	for i := 0; i < 5; i++ {
+		if err := connection.Send([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := connection.SendStats()
+	if stats.QueuedMessages != 2 || stats.QueuedBytes != 10 || stats.Dropped != 4 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestBackpressureBlock(t *testing.T) {
+	connection, _ := dialSlowConsumer(t, network.Backpressure{MaxMessages: 1, Policy: network.OverflowBlock})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := connection.SendContext(ctx, []byte("hello")); err != context.DeadlineExceeded {
+		t.Fatalf("send: %v, want DeadlineExceeded", err)
+	}
+
+	// blocked senders return once the connection is closed
+	errs := make(chan error, 1)
+	go func() {
+		errs <- connection.Send([]byte("hello"))
+	}()
+	time.Sleep(time.Millisecond * 50)
+	connection.Close()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("send still blocked after close")
+	}
+}
+
+func TestBackpressureClose(t *testing.T) {
+	connection, c := dialSlowConsumer(t, network.Backpressure{
+		MaxMessages: 1,
+		Policy:      network.OverflowClose,
+		SlowTimeout: time.Millisecond * 100,
+	})
+	if err := connection.Send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case reason := <-c.reasons:
+		if reason.Cause != network.CloseSlowConsumer || reason.Err != network.ErrSlowConsumer {
+			t.Fatalf("close reason %v", reason)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("slow consumer not closed")
+	}
+}
+
+func TestBackpressureCloseWithoutTimeout(t *testing.T) {
+	connection, c := dialSlowConsumer(t, network.Backpressure{
+		MaxMessages: 1,
+		Policy:      network.OverflowClose,
+	})
+	if err := connection.Send([]byte("hello")); err != network.ErrSlowConsumer {
+		t.Fatalf("send: %v, want ErrSlowConsumer", err)
+	}
+	select {
+	case reason := <-c.reasons:
+		if reason.Cause != network.CloseSlowConsumer || reason.Err != network.ErrSlowConsumer {
+			t.Fatalf("close reason %v", reason)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("slow consumer not closed")
+	}
+}
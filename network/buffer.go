@@ -0,0 +1,63 @@
+package network
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	minBufferShift = 9  // 512B
+	maxBufferShift = 22 // 4MiB
+)
+
+var bufferPools [maxBufferShift - minBufferShift + 1]sync.Pool
+
+// Buffer is a pooled message buffer, see GetBuffer. It is reference counted
+// so one buffer can be sent to many connections.
+type Buffer struct {
+	B    []byte
+	refs int32
+	pool *sync.Pool
+}
+
+// GetBuffer returns a buffer of size bytes with one reference owned by the
+// caller. Buffers larger than 4MiB are not pooled.
+func GetBuffer(size int) *Buffer {
+	shift := minBufferShift
+	if size > 1<<minBufferShift {
+		shift = bits.Len(uint(size - 1))
+	}
+	if shift > maxBufferShift {
+		return &Buffer{B: make([]byte, size), refs: 1}
+	}
+	pool := &bufferPools[shift-minBufferShift]
+	buffer, ok := pool.Get().(*Buffer)
+	if !ok {
+		buffer = &Buffer{B: make([]byte, 1<<shift), pool: pool}
+	}
+	buffer.B = buffer.B[:size]
+	buffer.refs = 1
+	return buffer
+}
+
+// Retain adds a reference, each one is given up by Release or SendBuffer.
+func (b *Buffer) Retain() {
+	atomic.AddInt32(&b.refs, 1)
+}
+
+// Release gives up a reference, the buffer returns to the pool when the last
+// one is released and must not be used anymore.
+func (b *Buffer) Release() {
+	refs := atomic.AddInt32(&b.refs, -1)
+	if refs > 0 {
+		return
+	}
+	if refs < 0 {
+		panic("network: buffer released too many times")
+	}
+	if b.pool != nil {
+		b.B = b.B[:cap(b.B)]
+		b.pool.Put(b)
+	}
+}
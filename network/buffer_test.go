@@ -0,0 +1,30 @@
+package network_test
+
+import (
+	"testing"
+
+	"github.com/iakud/plume/network"
+)
+
+func TestBuffer(t *testing.T) {
+	for _, size := range []int{0, 1, 512, 513, 64 << 10, 4 << 20, 4<<20 + 1} {
+		buffer := network.GetBuffer(size)
+		if len(buffer.B) != size {
+			t.Fatalf("buffer size %d, want %d", len(buffer.B), size)
+		}
+		buffer.Retain()
+		buffer.Release()
+		buffer.Release()
+	}
+}
+
+func TestBufferReleaseTwice(t *testing.T) {
+	buffer := network.GetBuffer(16)
+	buffer.Release()
+	defer func() {
+		if recover() == nil {
+			t.Fatal("release twice did not panic")
+		}
+	}()
+	buffer.Release()
+}
@@ -0,0 +1,95 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+type CloseCause int
+
+const (
+	CloseNone         CloseCause = iota
+	CloseLocal                   // Close was called on the connection
+	CloseServer                  // the owning server or client was closed
+	ClosePeer                    // the peer closed the connection
+	CloseReadError               // reading from the socket failed
+	CloseWriteError              // writing to the socket failed
+	CloseCodecError              // the codec failed to read or write a frame
+	CloseIdleTimeout             // read or write idle timeout
+	ClosePanic                   // the handler panicked
+	CloseSlowConsumer            // pending sends stayed over the limit, see OverflowClose
+	CloseRateLimit               // messages arrived over the rate limit, see WithAdmission
+)
+
+var closeCauseNames = []string{
+	CloseNone:         "none",
+	CloseLocal:        "local",
+	CloseServer:       "server",
+	ClosePeer:         "peer",
+	CloseReadError:    "read_error",
+	CloseWriteError:   "write_error",
+	CloseCodecError:   "codec_error",
+	CloseIdleTimeout:  "idle_timeout",
+	ClosePanic:        "panic",
+	CloseSlowConsumer: "slow_consumer",
+	CloseRateLimit:    "rate_limit",
+}
+
+func (c CloseCause) String() string {
+	if c >= 0 && int(c) < len(closeCauseNames) {
+		return closeCauseNames[c]
+	}
+	return fmt.Sprintf("CloseCause(%d)", int(c))
+}
+
+// CloseReason records why a connection was closed. The first cause wins, it is
+// set before the disconnect event.
+type CloseReason struct {
+	Cause CloseCause
+	Err   error
+}
+
+func (r CloseReason) String() string {
+	if r.Err == nil {
+		return r.Cause.String()
+	}
+	return r.Cause.String() + ": " + r.Err.Error()
+}
+
+func readCloseReason(err error) CloseReason {
+	switch {
+	case err == io.EOF:
+		return CloseReason{ClosePeer, err}
+	case isTimeout(err):
+		return CloseReason{CloseIdleTimeout, ErrReadIdleTimeout}
+	case isNetError(err):
+		return CloseReason{CloseReadError, err}
+	}
+	return CloseReason{CloseCodecError, err}
+}
+
+func writeCloseReason(err error) CloseReason {
+	switch {
+	case isTimeout(err):
+		return CloseReason{CloseIdleTimeout, ErrWriteIdleTimeout}
+	case isNetError(err):
+		return CloseReason{CloseWriteError, err}
+	}
+	return CloseReason{CloseCodecError, err}
+}
+
+func panicCloseReason(v interface{}) CloseReason {
+	return CloseReason{ClosePanic, fmt.Errorf("network: panic: %v", v)}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func isNetError(err error) bool {
+	var oe *net.OpError
+	return errors.As(err, &oe) || errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,102 @@
+package network_test
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/iakud/plume/network"
+)
+
+type closeReasonHandler struct {
+	connected chan *network.TCPConnection
+	reasons   chan network.CloseReason
+}
+
+func newCloseReasonHandler() *closeReasonHandler {
+	return &closeReasonHandler{
+		connected: make(chan *network.TCPConnection, 16),
+		reasons:   make(chan network.CloseReason, 16),
+	}
+}
+
+func (h *closeReasonHandler) Connect(connection *network.TCPConnection, connected bool) {
+	if connected {
+		h.connected <- connection
+		return
+	}
+	h.reasons <- connection.CloseReason()
+}
+
+func (h *closeReasonHandler) Receive(connection *network.TCPConnection, b []byte) {
+	if string(b) == "panic" {
+		panic("boom")
+	}
+}
+
+func (h *closeReasonHandler) wait(t *testing.T, cause network.CloseCause) {
+	select {
+	case reason := <-h.reasons:
+		if reason.Cause != cause || reason.Err == nil {
+			t.Fatalf("close reason %v, want %v", reason, cause)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("close reason timeout, want %v", cause)
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	srv := newCloseReasonHandler()
+	server := network.NewTCPServer("localhost:8008")
+	go server.ListenAndServe(srv, network.NewLengthCodec(2, binary.BigEndian, 16))
+	time.Sleep(time.Millisecond * 100)
+
+	dial := func() (*network.TCPClient, *closeReasonHandler, *network.TCPConnection) {
+		c := newCloseReasonHandler()
+		client := network.NewTCPClient("localhost:8008")
+		go client.DialAndServe(c, network.NewLengthCodec(2, binary.BigEndian, 0))
+		connection := <-c.connected
+		<-srv.connected
+		return client, c, connection
+	}
+
+	// local close and peer close
+	client, c, connection := dial()
+	connection.Close()
+	c.wait(t, network.CloseLocal)
+	srv.wait(t, network.ClosePeer)
+	<-c.connected // reconnected before close
+	<-srv.connected
+	client.Close()
+	c.wait(t, network.CloseServer)
+	srv.wait(t, network.ClosePeer)
+
+	// codec error
+	client, c, connection = dial()
+	connection.Send(make([]byte, 17))
+	srv.wait(t, network.CloseCodecError)
+	c.wait(t, network.ClosePeer)
+	<-c.connected
+	<-srv.connected
+	client.Close()
+	c.wait(t, network.CloseServer)
+	srv.wait(t, network.ClosePeer)
+
+	// panic in Receive
+	client, c, connection = dial()
+	connection.Send([]byte("panic"))
+	srv.wait(t, network.ClosePanic)
+	c.wait(t, network.ClosePeer)
+	<-c.connected
+	<-srv.connected
+	client.Close()
+	c.wait(t, network.CloseServer)
+	srv.wait(t, network.ClosePeer)
+
+	// server close
+	client, c, _ = dial()
+	defer client.Close()
+	server.Close()
+	srv.wait(t, network.CloseServer)
+	c.wait(t, network.ClosePeer)
+}
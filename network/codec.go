@@ -18,6 +18,14 @@ type CodecWriter interface {
 	Write(w io.Writer, b []byte) error
 }
 
+// HeaderCodec is implemented by codecs whose frame is a header followed by
+// the message unchanged. The background writer then sends the frames with
+// writev instead of copying them through a buffer.
+type HeaderCodec interface {
+	Codec
+	AppendHeader(dst []byte, b []byte) ([]byte, error)
+}
+
 type defaultCodec struct {
 }
 
@@ -41,3 +49,7 @@ func (*defaultCodec) Write(w io.Writer, b []byte) error {
 	}
 	return nil
 }
+
+func (*defaultCodec) AppendHeader(dst []byte, b []byte) ([]byte, error) {
+	return dst, nil
+}
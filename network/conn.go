@@ -0,0 +1,138 @@
+package network
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/iakud/plume/eventloop"
+)
+
+// Conn is implemented by TCPConnection, WSConnection and UDPConnection, so
+// session logic can be written once for native and web clients.
+type Conn interface {
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	Loop() *eventloop.EventLoop
+
+	SetPendingSend(pendingSend int)
+	SetBackpressure(backpressure Backpressure)
+	SendStats() SendStats
+	Send(b []byte) error
+	SendBuffer(buffer *Buffer) error
+	SendContext(ctx context.Context, b []byte) error
+
+	Shutdown()
+	Close()
+	CloseWithTimeout(timeout time.Duration)
+	CloseReason() CloseReason
+	Err() error
+
+	GetUserdata() interface{}
+	SetUserdata(userdata interface{})
+}
+
+var (
+	_ Conn = (*TCPConnection)(nil)
+	_ Conn = (*WSConnection)(nil)
+	_ Conn = (*UDPConnection)(nil)
+)
+
+// closeHooks are called once a connection is closed, after its disconnect
+// event.
+type closeHooks struct {
+	mutex  sync.Mutex
+	hooks  map[*func()]struct{}
+	closed bool
+}
+
+// add registers f, it returns false when the connection is already closed.
+// Call remove to unregister f.
+func (h *closeHooks) add(f func()) (remove func(), ok bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		return nil, false
+	}
+	if h.hooks == nil {
+		h.hooks = make(map[*func()]struct{})
+	}
+	hook := &f
+	h.hooks[hook] = struct{}{}
+	return func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		delete(h.hooks, hook)
+	}, true
+}
+
+func (h *closeHooks) run() {
+	h.mutex.Lock()
+	hooks := h.hooks
+	h.hooks, h.closed = nil, true
+	h.mutex.Unlock()
+	for hook := range hooks {
+		(*hook)()
+	}
+}
+
+// closeNotifier is implemented by the connections of this package.
+type closeNotifier interface {
+	onClose(f func()) (remove func(), ok bool)
+}
+
+// Handler handles the events of any Conn, serve it with AsTCPHandler,
+// AsWSHandler or AsUDPHandler.
+type Handler interface {
+	Connect(conn Conn, connected bool)
+	Receive(conn Conn, b []byte)
+}
+
+func AsTCPHandler(handler Handler) TCPHandler {
+	return &tcpHandler{handler}
+}
+
+func AsWSHandler(handler Handler) WSHandler {
+	return &wsHandler{handler}
+}
+
+func AsUDPHandler(handler Handler) UDPHandler {
+	return &udpHandler{handler}
+}
+
+type tcpHandler struct {
+	handler Handler
+}
+
+func (h *tcpHandler) Connect(conn *TCPConnection, connected bool) {
+	h.handler.Connect(conn, connected)
+}
+
+func (h *tcpHandler) Receive(conn *TCPConnection, buf []byte) {
+	h.handler.Receive(conn, buf)
+}
+
+type wsHandler struct {
+	handler Handler
+}
+
+func (h *wsHandler) Connect(conn *WSConnection, connected bool) {
+	h.handler.Connect(conn, connected)
+}
+
+func (h *wsHandler) Receive(conn *WSConnection, data []byte) {
+	h.handler.Receive(conn, data)
+}
+
+type udpHandler struct {
+	handler Handler
+}
+
+func (h *udpHandler) Connect(conn *UDPConnection, connected bool) {
+	h.handler.Connect(conn, connected)
+}
+
+func (h *udpHandler) Receive(conn *UDPConnection, b []byte) {
+	h.handler.Receive(conn, b)
+}
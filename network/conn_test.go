@@ -0,0 +1,79 @@
+package network_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/iakud/plume/network"
+)
+
+type session struct {
+	received int
+}
+
+// sessionServer is served on both TCP and WebSocket.
+type sessionServer struct{}
+
+func (sessionServer) Connect(conn network.Conn, connected bool) {
+	if connected {
+		conn.SetUserdata(&session{})
+	}
+}
+
+func (sessionServer) Receive(conn network.Conn, b []byte) {
+	s := conn.GetUserdata().(*session)
+	s.received++
+	conn.Send(append([]byte{byte(s.received)}, b...))
+}
+
+type sessionClient struct {
+	received chan []byte
+}
+
+func (c *sessionClient) Connect(conn network.Conn, connected bool) {
+	if connected {
+		conn.Send([]byte("hello"))
+		conn.Send([]byte("hello"))
+	}
+}
+
+func (c *sessionClient) Receive(conn network.Conn, b []byte) {
+	c.received <- b
+}
+
+func (c *sessionClient) wait(t *testing.T) {
+	for i := 1; i <= 2; i++ {
+		select {
+		case b := <-c.received:
+			if string(b) != string(append([]byte{byte(i)}, "hello"...)) {
+				t.Fatalf("received %q", b)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestConnHandler(t *testing.T) {
+	codec := network.NewVarintCodec(0)
+	server := network.NewTCPServer("localhost:8014")
+	go server.ListenAndServe(network.AsTCPHandler(sessionServer{}), codec)
+	defer server.Close()
+	httpServer := &http.Server{Addr: "localhost:8015", Handler: network.NewWSServer(network.AsWSHandler(sessionServer{}))}
+	go httpServer.ListenAndServe()
+	defer httpServer.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	c := &sessionClient{received: make(chan []byte, 2)}
+	client := network.NewTCPClient("localhost:8014")
+	go client.DialAndServe(network.AsTCPHandler(c), codec)
+	defer client.Close()
+	c.wait(t)
+
+	wsc := &sessionClient{received: make(chan []byte, 2)}
+	wsClient := network.NewWSClient("ws://localhost:8015", network.AsWSHandler(wsc))
+	go wsClient.DialAndServe()
+	defer wsClient.Close()
+	wsc.wait(t)
+}
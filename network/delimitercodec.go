@@ -0,0 +1,75 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+var (
+	ErrDelimiterInFrame = errors.New("network: delimiter in frame")
+)
+
+// DelimiterCodec terminates each message with a delimiter byte, such as '\n'.
+// The delimiter is not part of the returned frame.
+type DelimiterCodec struct {
+	delim        byte
+	maxFrameSize int
+}
+
+// NewDelimiterCodec returns a delimiter codec. A maxFrameSize <= 0 means
+// DefaultMaxFrameSize.
+func NewDelimiterCodec(delim byte, maxFrameSize int) *DelimiterCodec {
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+	codec := &DelimiterCodec{
+		delim:        delim,
+		maxFrameSize: maxFrameSize,
+	}
+	return codec
+}
+
+func (c *DelimiterCodec) MaxFrameSize() int {
+	return c.maxFrameSize
+}
+
+func (c *DelimiterCodec) Read(r io.Reader) ([]byte, error) {
+	br := toByteReader(r)
+	var b []byte
+	for {
+		x, err := br.ReadByte()
+		if err != nil {
+			if len(b) > 0 {
+				return nil, unexpectedEOF(err)
+			}
+			return nil, err
+		}
+		if x == c.delim {
+			if b == nil {
+				b = []byte{}
+			}
+			return b, nil
+		}
+		if len(b) >= c.maxFrameSize {
+			return nil, ErrFrameTooLarge
+		}
+		b = append(b, x)
+	}
+}
+
+func (c *DelimiterCodec) Write(w io.Writer, b []byte) error {
+	if len(b) > c.maxFrameSize {
+		return ErrFrameTooLarge
+	}
+	if bytes.IndexByte(b, c.delim) >= 0 {
+		return ErrDelimiterInFrame
+	}
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{c.delim}); err != nil {
+		return err
+	}
+	return nil
+}
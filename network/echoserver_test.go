@@ -5,15 +5,16 @@ import (
 	"testing"
 
 	"github.com/iakud/plume/network"
+	"github.com/iakud/plume/network/memnet"
 )
 
 type echoServer struct {
 	server *network.TCPServer
 }
 
-func newEchoServer(addr string) *echoServer {
+func newEchoServer(addr string, opt ...network.Option) *echoServer {
 	srv := &echoServer{
-		server: network.NewTCPServer(addr),
+		server: network.NewTCPServer(addr, opt...),
 	}
 	return srv
 }
@@ -48,9 +49,9 @@ type echoClient struct {
 	client *network.TCPClient
 }
 
-func newEchoClient(addr string) *echoClient {
+func newEchoClient(addr string, opt ...network.Option) *echoClient {
 	echoClient := &echoClient{
-		client: network.NewTCPClient(addr),
+		client: network.NewTCPClient(addr, opt...),
 	}
 	return echoClient
 }
@@ -79,9 +80,10 @@ func (c *echoClient) Receive(connection *network.TCPConnection, b []byte) {
 }
 
 func TestEcho(t *testing.T) {
-	srv := newEchoServer("localhost:8000")
+	memNetwork := memnet.NewNetwork(memnet.StreamConfig{})
+	srv := newEchoServer("echo:8000", network.WithListenFunc(memNetwork.Listen))
 	go func() {
-		c := newEchoClient("localhost:8000")
+		c := newEchoClient("echo:8000", network.WithDialFunc(memNetwork.Dial))
 		c.ConnectAndServe()
 		srv.Close()
 	}()
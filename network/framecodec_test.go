@@ -0,0 +1,210 @@
+package network_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/iakud/plume/network"
+)
+
+const kMaxFrameSize = 1024
+
+type frameCodec interface {
+	network.Codec
+	MaxFrameSize() int
+}
+
+func frameCodecs() map[string]frameCodec {
+	return map[string]frameCodec{
+		"uint16be": network.NewLengthCodec(2, binary.BigEndian, kMaxFrameSize),
+		"uint16le": network.NewLengthCodec(2, binary.LittleEndian, kMaxFrameSize),
+		"uint32be": network.NewLengthCodec(4, binary.BigEndian, kMaxFrameSize),
+		"uint32le": network.NewLengthCodec(4, binary.LittleEndian, kMaxFrameSize),
+		"varint":   network.NewVarintCodec(kMaxFrameSize),
+		"delim":    network.NewDelimiterCodec('\n', kMaxFrameSize),
+	}
+}
+
+func TestFrameCodecRoundTrip(t *testing.T) {
+	messages := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte("x"), kMaxFrameSize)}
+	for name, codec := range frameCodecs() {
+		buffer := bytes.NewBuffer(nil)
+		for _, message := range messages {
+			if err := codec.Write(buffer, message); err != nil {
+				t.Fatalf("%s: write: %v", name, err)
+			}
+		}
+		for _, message := range messages {
+			b, err := codec.Read(buffer)
+			if err != nil {
+				t.Fatalf("%s: read: %v", name, err)
+			}
+			if !bytes.Equal(b, message) {
+				t.Fatalf("%s: read %q, want %q", name, b, message)
+			}
+		}
+		if _, err := codec.Read(buffer); err != io.EOF {
+			t.Fatalf("%s: read at end: %v, want EOF", name, err)
+		}
+	}
+}
+
+func TestFrameCodecTruncated(t *testing.T) {
+	for name, codec := range frameCodecs() {
+		buffer := bytes.NewBuffer(nil)
+		if err := codec.Write(buffer, []byte("hello")); err != nil {
+			t.Fatalf("%s: write: %v", name, err)
+		}
+		frame := buffer.Bytes()
+		for i := 1; i < len(frame); i++ {
+			if _, err := codec.Read(bytes.NewReader(frame[:i])); err != io.ErrUnexpectedEOF {
+				t.Fatalf("%s: read %d/%d bytes: %v, want ErrUnexpectedEOF", name, i, len(frame), err)
+			}
+		}
+	}
+}
+
+func TestFrameCodecOversized(t *testing.T) {
+	message := make([]byte, kMaxFrameSize+1)
+	for name, codec := range frameCodecs() {
+		if err := codec.Write(io.Discard, message); err != network.ErrFrameTooLarge {
+			t.Fatalf("%s: write: %v, want ErrFrameTooLarge", name, err)
+		}
+	}
+
+	headers := map[string][]byte{
+		"uint16be": {0xff, 0xff},
+		"uint32le": {0xff, 0xff, 0xff, 0x7f},
+		"varint":   {0xff, 0xff, 0xff, 0xff, 0x0f},
+		"delim":    bytes.Repeat([]byte("x"), kMaxFrameSize+1),
+	}
+	codecs := frameCodecs()
+	for name, header := range headers {
+		if _, err := codecs[name].Read(bytes.NewReader(header)); err != network.ErrFrameTooLarge {
+			t.Fatalf("%s: read: %v, want ErrFrameTooLarge", name, err)
+		}
+	}
+}
+
+func TestDelimiterInFrame(t *testing.T) {
+	codec := network.NewDelimiterCodec('\n', 0)
+	if err := codec.Write(io.Discard, []byte("a\nb")); err != network.ErrDelimiterInFrame {
+		t.Fatalf("write: %v, want ErrDelimiterInFrame", err)
+	}
+}
+
+func fuzzFrameCodecRead(f *testing.F, codec frameCodec) {
+	f.Add([]byte{})
+	f.Add([]byte{0x00, 0x05, 'h', 'e', 'l', 'l', 'o'})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+	f.Add([]byte("hello\nworld"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		for {
+			b, err := codec.Read(r)
+			if err != nil {
+				return
+			}
+			if len(b) > codec.MaxFrameSize() {
+				t.Fatalf("read %d bytes, max frame size %d", len(b), codec.MaxFrameSize())
+			}
+		}
+	})
+}
+
+func FuzzLengthCodecRead(f *testing.F) {
+	fuzzFrameCodecRead(f, network.NewLengthCodec(2, binary.BigEndian, kMaxFrameSize))
+}
+
+func FuzzVarintCodecRead(f *testing.F) {
+	fuzzFrameCodecRead(f, network.NewVarintCodec(kMaxFrameSize))
+}
+
+func FuzzDelimiterCodecRead(f *testing.F) {
+	fuzzFrameCodecRead(f, network.NewDelimiterCodec('\n', kMaxFrameSize))
+}
+
+func FuzzFrameCodecRoundTrip(f *testing.F) {
+	f.Add([]byte("hello"), 3)
+	f.Fuzz(func(t *testing.T, message []byte, cut int) {
+		for name, codec := range frameCodecs() {
+			buffer := bytes.NewBuffer(nil)
+			err := codec.Write(buffer, message)
+			if errors.Is(err, network.ErrFrameTooLarge) || errors.Is(err, network.ErrDelimiterInFrame) {
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: write: %v", name, err)
+			}
+			frame := buffer.Bytes()
+			b, err := codec.Read(bytes.NewReader(frame))
+			if err != nil || !bytes.Equal(b, message) {
+				t.Fatalf("%s: read %q, %v, want %q", name, b, err, message)
+			}
+			// truncated frames never yield a message
+			if cut <= 0 || cut >= len(frame) {
+				continue
+			}
+			if _, err := codec.Read(bytes.NewReader(frame[:cut])); err != io.ErrUnexpectedEOF {
+				t.Fatalf("%s: read truncated: %v, want ErrUnexpectedEOF", name, err)
+			}
+		}
+	})
+}
+
+type frameEchoServer struct{}
+
+func (*frameEchoServer) Connect(*network.TCPConnection, bool) {}
+
+func (*frameEchoServer) Receive(connection *network.TCPConnection, b []byte) {
+	connection.Send(b)
+}
+
+type frameEchoClient struct {
+	client   *network.TCPClient
+	messages [][]byte
+	received int
+}
+
+func (c *frameEchoClient) Connect(connection *network.TCPConnection, connected bool) {
+	if !connected {
+		return
+	}
+	for _, message := range c.messages {
+		connection.Send(message)
+	}
+}
+
+func (c *frameEchoClient) Receive(connection *network.TCPConnection, b []byte) {
+	if !bytes.Equal(b, c.messages[c.received]) {
+		log.Fatalf("frame echo: receive %d bytes, want %d", len(b), len(c.messages[c.received]))
+	}
+	c.received++
+	if c.received == len(c.messages) {
+		c.client.Close()
+	}
+}
+
+func TestFrameCodecEcho(t *testing.T) {
+	codec := network.NewLengthCodec(4, binary.BigEndian, 0)
+	server := network.NewTCPServer("localhost:8001")
+	go server.ListenAndServe(&frameEchoServer{}, codec)
+	defer server.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	c := &frameEchoClient{client: network.NewTCPClient("localhost:8001")}
+	for i := 1; i <= 100; i++ {
+		c.messages = append(c.messages, bytes.Repeat([]byte{byte(i)}, i*97))
+	}
+	if err := c.client.DialAndServe(c, codec); err != network.ErrClientClosed {
+		t.Fatal(err)
+	}
+	if c.received != len(c.messages) {
+		t.Fatalf("received %d messages, want %d", c.received, len(c.messages))
+	}
+}
@@ -0,0 +1,575 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync"
+)
+
+var (
+	ErrGatewayMessage     = errors.New("network: invalid gateway message")
+	ErrNoRoute            = errors.New("network: no route for message")
+	ErrUnknownBackend     = errors.New("network: unknown gateway backend")
+	ErrBackendUnavailable = errors.New("network: gateway backend unavailable")
+)
+
+// Gateway messages between the gateway and the backends are the type, the
+// 8 byte session ID and the payload.
+const (
+	gatewayConnect    byte = 1 // flags and identity, to the backend
+	gatewayDisconnect byte = 2 // flags, to the backend
+	gatewayForward    byte = 3 // client message, to the backend
+	gatewayPush       byte = 4 // message to the client, from the backend
+	gatewayKick       byte = 5 // close the client session, from the backend
+
+	gatewayHeaderSize = 9
+
+	// gatewayMigrated flags the connect and disconnect of a migration.
+	gatewayMigrated byte = 1
+
+	// gatewayPendingBytes bounds the messages kept for a backend while it is
+	// reconnecting.
+	gatewayPendingBytes = 1 << 20
+)
+
+func packGateway(typ byte, session uint64, payload []byte) []byte {
+	b := make([]byte, gatewayHeaderSize+len(payload))
+	b[0] = typ
+	binary.BigEndian.PutUint64(b[1:], session)
+	copy(b[gatewayHeaderSize:], payload)
+	return b
+}
+
+type gatewayRoute struct {
+	min, max uint32
+	service  string
+}
+
+// Gateway forwards the messages of client sessions to backend services over
+// TCPClient connections, and the pushes of the backends to the clients. Use
+// TCPHandler or WSHandler to serve the clients, and NewGatewayBackend on the
+// backends.
+//
+// A session is bound to one backend of a service on its first message to the
+// service. Messages for a reconnecting backend are kept and sent once it is
+// connected again, after its sessions are connected again.
+type Gateway struct {
+	header MessageHeader
+	codec  Codec
+	opt    []Option
+
+	mutex     sync.RWMutex
+	services  map[string][]*gatewayBackend
+	backends  map[string]*gatewayBackend
+	routes    []gatewayRoute
+	routeFunc func(id uint32, payload []byte) string
+	auth      func(conn Conn, b []byte) (identity string, err error)
+	sessions  map[uint64]*GatewaySession
+	conns     map[Conn]*GatewaySession
+	nextID    uint64
+	closed    bool
+}
+
+// NewGateway returns a gateway reading message IDs with header. The backend
+// connections use codec, which must frame messages, and opt, the retry is
+// always enabled.
+func NewGateway(header MessageHeader, codec Codec, opt ...Option) *Gateway {
+	if header == nil {
+		header = DefaultMessageHeader
+	}
+	gateway := &Gateway{
+		header:   header,
+		codec:    codec,
+		opt:      opt,
+		services: make(map[string][]*gatewayBackend),
+		backends: make(map[string]*gatewayBackend),
+		sessions: make(map[uint64]*GatewaySession),
+		conns:    make(map[Conn]*GatewaySession),
+	}
+	return gateway
+}
+
+// AddBackend connects to the backend name of service at addr.
+func (g *Gateway) AddBackend(service, name, addr string) {
+	backend := &gatewayBackend{
+		gateway:  g,
+		service:  service,
+		name:     name,
+		client:   NewTCPClient(addr, g.opt...),
+		sessions: make(map[uint64]*GatewaySession),
+	}
+	backend.client.EnableRetry()
+
+	g.mutex.Lock()
+	if _, ok := g.backends[name]; ok {
+		g.mutex.Unlock()
+		panic("network: multiple registrations for gateway backend " + name)
+	}
+	if g.closed {
+		g.mutex.Unlock()
+		return
+	}
+	g.backends[name] = backend
+	g.services[service] = append(g.services[service], backend)
+	g.mutex.Unlock()
+
+	go func() {
+		if err := backend.client.DialAndServe(backend, g.codec); err != ErrClientClosed {
+			log.Printf("network: gateway backend %v: %v", name, err)
+		}
+	}()
+}
+
+// Route sends the messages with an ID in [min, max] to service.
+func (g *Gateway) Route(min, max uint32, service string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.routes = append(g.routes, gatewayRoute{min, max, service})
+}
+
+// RouteFunc sets f naming the service of the messages without an ID route,
+// such as from a service name in the payload. An empty name drops the
+// message.
+func (g *Gateway) RouteFunc(f func(id uint32, payload []byte) string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.routeFunc = f
+}
+
+// HandleAuth sets f authenticating sessions with their first message, the
+// identity is sent to the backends. The connection is closed when f returns
+// an error. Without it sessions are not authenticated.
+func (g *Gateway) HandleAuth(f func(conn Conn, b []byte) (identity string, err error)) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.auth = f
+}
+
+func (g *Gateway) route(id uint32, payload []byte) string {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	for _, route := range g.routes {
+		if id >= route.min && id <= route.max {
+			return route.service
+		}
+	}
+	if g.routeFunc != nil {
+		return g.routeFunc(id, payload)
+	}
+	return ""
+}
+
+// Session returns the session id, nil when it is closed.
+func (g *Gateway) Session(id uint64) *GatewaySession {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return g.sessions[id]
+}
+
+func (g *Gateway) NumSessions() int {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return len(g.sessions)
+}
+
+func (g *Gateway) Connect(conn Conn, connected bool) {
+	if !connected {
+		g.mutex.Lock()
+		session := g.conns[conn]
+		delete(g.conns, conn)
+		if session != nil {
+			delete(g.sessions, session.id)
+		}
+		g.mutex.Unlock()
+		if session != nil {
+			session.disconnect()
+		}
+		return
+	}
+
+	g.mutex.Lock()
+	g.nextID++
+	session := &GatewaySession{
+		id:       g.nextID,
+		conn:     conn,
+		gateway:  g,
+		authed:   g.auth == nil,
+		backends: make(map[string]*gatewayBackend),
+	}
+	g.sessions[session.id] = session
+	g.conns[conn] = session
+	g.mutex.Unlock()
+}
+
+func (g *Gateway) Receive(conn Conn, b []byte) {
+	g.mutex.RLock()
+	session, auth := g.conns[conn], g.auth
+	g.mutex.RUnlock()
+	if session == nil {
+		return
+	}
+
+	if !session.isAuthed() && auth != nil {
+		identity, err := auth(conn, b)
+		if err != nil {
+			log.Printf("network: gateway %v: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		session.authenticate(identity)
+		return
+	}
+
+	id, payload, err := g.header.Unpack(b)
+	if err != nil {
+		log.Printf("network: gateway %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	service := g.route(id, payload)
+	if service == "" {
+		log.Printf("network: gateway %v message %d: %v", conn.RemoteAddr(), id, ErrNoRoute)
+		return
+	}
+	if err := session.forward(service, b); err != nil {
+		log.Printf("network: gateway %v message %d: %v", conn.RemoteAddr(), id, err)
+		if err == ErrBackendUnavailable {
+			conn.Close()
+		}
+	}
+}
+
+func (g *Gateway) TCPHandler() TCPHandler {
+	return AsTCPHandler(g)
+}
+
+func (g *Gateway) WSHandler() WSHandler {
+	return AsWSHandler(g)
+}
+
+// Close closes the backend connections, the client connections are left to
+// their servers.
+func (g *Gateway) Close() {
+	g.mutex.Lock()
+	g.closed = true
+	backends := g.backends
+	g.backends = make(map[string]*gatewayBackend)
+	g.services = make(map[string][]*gatewayBackend)
+	g.mutex.Unlock()
+	for _, backend := range backends {
+		backend.client.Close()
+	}
+}
+
+// pick returns the backend of service for a new session, by session ID.
+func (g *Gateway) pick(service string, session uint64) (*gatewayBackend, error) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	backends := g.services[service]
+	if len(backends) == 0 {
+		return nil, ErrUnknownBackend
+	}
+	return backends[session%uint64(len(backends))], nil
+}
+
+func (g *Gateway) backend(name string) *gatewayBackend {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return g.backends[name]
+}
+
+// GatewaySession is a client session of a Gateway.
+type GatewaySession struct {
+	id      uint64
+	conn    Conn
+	gateway *Gateway
+
+	mutex    sync.Mutex
+	identity string
+	authed   bool
+	backends map[string]*gatewayBackend // by service
+	closed   bool
+}
+
+func (s *GatewaySession) ID() uint64 {
+	return s.id
+}
+
+func (s *GatewaySession) Conn() Conn {
+	return s.conn
+}
+
+// Identity returns the identity of HandleAuth.
+func (s *GatewaySession) Identity() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.identity
+}
+
+// Backend returns the name of the backend of service the session is bound
+// to, empty when none.
+func (s *GatewaySession) Backend(service string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if backend, ok := s.backends[service]; ok {
+		return backend.name
+	}
+	return ""
+}
+
+// Migrate binds the session to the backend name of service. The previous
+// backend is told the session disconnected and the new one that it
+// connected, both flagged as a migration.
+func (s *GatewaySession) Migrate(service, name string) error {
+	to := s.gateway.backend(name)
+	if to == nil || to.service != service {
+		return ErrUnknownBackend
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return ErrConnectionClosed
+	}
+	from := s.backends[service]
+	if from == to {
+		return nil
+	}
+	if from != nil {
+		from.unbind(s, gatewayMigrated)
+	}
+	s.backends[service] = to
+	to.bind(s, gatewayMigrated)
+	return nil
+}
+
+// Close closes the client connection.
+func (s *GatewaySession) Close() {
+	s.conn.Close()
+}
+
+func (s *GatewaySession) isAuthed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.authed
+}
+
+func (s *GatewaySession) authenticate(identity string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.identity, s.authed = identity, true
+}
+
+// forward sends the client message b to the backend of service, binding the
+// session to one on its first message.
+func (s *GatewaySession) forward(service string, b []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return ErrConnectionClosed
+	}
+	backend, ok := s.backends[service]
+	if !ok {
+		var err error
+		if backend, err = s.gateway.pick(service, s.id); err != nil {
+			return err
+		}
+		s.backends[service] = backend
+		backend.bind(s, 0)
+	}
+	if !backend.forward(s.id, b) {
+		return ErrBackendUnavailable
+	}
+	return nil
+}
+
+func (s *GatewaySession) disconnect() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	for _, backend := range s.backends {
+		backend.unbind(s, 0)
+	}
+	s.backends = nil
+}
+
+type gatewayMessage struct {
+	session uint64
+	b       []byte
+}
+
+// gatewayBackend is the connection to a backend, it is a TCPHandler of its
+// TCPClient.
+type gatewayBackend struct {
+	gateway *Gateway
+	service string
+	name    string
+	client  *TCPClient
+
+	mutex        sync.Mutex
+	connection   *TCPConnection // nil while reconnecting
+	sessions     map[uint64]*GatewaySession
+	pending      []gatewayMessage
+	pendingBytes int
+}
+
+// bind connects session to the backend, session.mutex is held.
+func (b *gatewayBackend) bind(session *GatewaySession, flags byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.sessions[session.id] = session
+	b.sendControl(packConnect(session, flags))
+}
+
+// unbind disconnects session from the backend, session.mutex is held.
+func (b *gatewayBackend) unbind(session *GatewaySession, flags byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.sessions, session.id)
+	b.sendControl(packGateway(gatewayDisconnect, session.id, []byte{flags}))
+}
+
+// sendControl sends a session connect or disconnect, b.mutex is held. The
+// sessions are connected again on the next connection, which is forced when
+// the message cannot be queued.
+func (b *gatewayBackend) sendControl(msg []byte) {
+	if b.connection == nil {
+		return
+	}
+	if err := b.connection.sendOpen(msg); err != nil && err != ErrConnectionClosed {
+		log.Printf("network: gateway backend %v: %v", b.name, err)
+		b.connection.Close()
+	}
+}
+
+func packConnect(session *GatewaySession, flags byte) []byte {
+	payload := append([]byte{flags}, session.identity...)
+	return packGateway(gatewayConnect, session.id, payload)
+}
+
+// forward returns false when the backend connection is full, or when it is
+// reconnecting and too many messages are kept.
+func (b *gatewayBackend) forward(session uint64, msg []byte) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.connection != nil {
+		err := b.connection.sendOpen(packGateway(gatewayForward, session, msg))
+		if err == nil {
+			return true
+		}
+		if err != ErrConnectionClosed {
+			return false
+		}
+		// the connection broke, keep msg for the next one
+	}
+	if b.pendingBytes+len(msg) > gatewayPendingBytes {
+		return false
+	}
+	b.pending = append(b.pending, gatewayMessage{session, msg})
+	b.pendingBytes += len(msg)
+	return true
+}
+
+// Connect replays the sessions and the pending messages to a new connection.
+// They are sent without b.mutex held, the messages forwarded meanwhile are
+// kept until the connection is set.
+func (b *gatewayBackend) Connect(conn *TCPConnection, connected bool) {
+	b.mutex.Lock()
+	if !connected {
+		if b.connection == conn {
+			b.connection = nil
+		}
+		b.mutex.Unlock()
+		return
+	}
+	// the backend lost the sessions with the previous connection
+	bound := make(map[uint64]struct{}, len(b.sessions))
+	for {
+		var controls [][]byte
+		for id, session := range b.sessions {
+			if _, ok := bound[id]; !ok {
+				bound[id] = struct{}{}
+				controls = append(controls, packConnect(session, 0))
+			}
+		}
+		for id := range bound {
+			if _, ok := b.sessions[id]; !ok {
+				delete(bound, id)
+				controls = append(controls, packGateway(gatewayDisconnect, id, []byte{0}))
+			}
+		}
+		var forwards []gatewayMessage
+		for _, m := range b.pending {
+			if _, ok := bound[m.session]; ok {
+				forwards = append(forwards, m)
+			}
+		}
+		b.pending, b.pendingBytes = nil, 0
+		if len(controls) == 0 && len(forwards) == 0 {
+			b.connection = conn
+			b.mutex.Unlock()
+			return
+		}
+		b.mutex.Unlock()
+
+		if err := b.replay(conn, controls, forwards); err != nil {
+			if err != ErrConnectionClosed {
+				log.Printf("network: gateway backend %v: %v", b.name, err)
+				conn.Close()
+			}
+			return
+		}
+		b.mutex.Lock()
+	}
+}
+
+// replay sends controls then forwards to conn, the forwards not sent are kept
+// for the next connection.
+func (b *gatewayBackend) replay(conn *TCPConnection, controls [][]byte, forwards []gatewayMessage) error {
+	for _, msg := range controls {
+		if err := conn.sendOpen(msg); err != nil {
+			b.keep(forwards)
+			return err
+		}
+	}
+	for i, m := range forwards {
+		if err := conn.sendOpen(packGateway(gatewayForward, m.session, m.b)); err != nil {
+			b.keep(forwards[i:])
+			return err
+		}
+	}
+	return nil
+}
+
+// keep puts forwards back before the pending messages.
+func (b *gatewayBackend) keep(forwards []gatewayMessage) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, m := range forwards {
+		b.pendingBytes += len(m.b)
+	}
+	b.pending = append(forwards[:len(forwards):len(forwards)], b.pending...)
+}
+
+func (b *gatewayBackend) Receive(conn *TCPConnection, buf []byte) {
+	if len(buf) < gatewayHeaderSize {
+		log.Printf("network: gateway backend %v: %v", b.name, ErrGatewayMessage)
+		conn.Close()
+		return
+	}
+	// only the sessions bound to the backend
+	b.mutex.Lock()
+	session := b.sessions[binary.BigEndian.Uint64(buf[1:])]
+	b.mutex.Unlock()
+	if session == nil {
+		return
+	}
+	switch buf[0] {
+	case gatewayPush:
+		session.conn.Send(buf[gatewayHeaderSize:])
+	case gatewayKick:
+		session.conn.Close()
+	default:
+		log.Printf("network: gateway backend %v: %v", b.name, ErrGatewayMessage)
+		conn.Close()
+	}
+}
@@ -0,0 +1,177 @@
+package network_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iakud/plume/network"
+	"github.com/iakud/plume/network/memnet"
+)
+
+// eventBackend reports its session events and echoes the messages prefixed
+// with its name.
+type eventBackend struct {
+	name    string
+	events  chan string
+	session *network.BackendSession // the last one connected or disconnected
+}
+
+func newEventBackend(name string) *eventBackend {
+	return &eventBackend{name: name, events: make(chan string, 16)}
+}
+
+func (b *eventBackend) Connect(session *network.BackendSession, connected bool) {
+	b.session = session
+	switch {
+	case connected && session.Migrated():
+		b.events <- "migrate in " + session.Identity()
+	case connected:
+		b.events <- "connect " + session.Identity()
+	case session.Migrated():
+		b.events <- "migrate out"
+	default:
+		b.events <- "disconnect"
+	}
+}
+
+func (b *eventBackend) Receive(session *network.BackendSession, msg []byte) {
+	_, payload, _ := network.DefaultMessageHeader.Unpack(msg)
+	b.events <- "receive " + string(payload)
+	if string(payload) == "kick" {
+		session.Kick()
+		return
+	}
+	session.Push(append([]byte(b.name+":"), payload...))
+}
+
+func (b *eventBackend) expect(t *testing.T, event string) {
+	t.Helper()
+	select {
+	case e := <-b.events:
+		if e != event {
+			t.Fatalf("%v: event %q, want %q", b.name, e, event)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("%v: timeout waiting for %q", b.name, event)
+	}
+}
+
+func TestGateway(t *testing.T) {
+	memNetwork := memnet.NewNetwork(memnet.StreamConfig{})
+	codec := network.NewVarintCodec(0)
+	backends := make(map[string]*eventBackend)
+	servers := make(map[string]*network.TCPServer)
+	serveBackend := func(name string) {
+		server := network.NewTCPServer(name, memnetListen(t, memNetwork, name))
+		go server.ListenAndServe(network.NewGatewayBackend(backends[name]), codec)
+		servers[name] = server
+	}
+	for _, name := range []string{"login", "game1", "game2"} {
+		backends[name] = newEventBackend(name)
+		serveBackend(name)
+	}
+	defer func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	}()
+
+	gateway := network.NewGateway(nil, codec,
+		network.WithDialFunc(memNetwork.Dial),
+		network.WithBackoff(network.ExponentialBackoff{Initial: time.Millisecond * 10, Max: time.Millisecond * 10}),
+	)
+	defer gateway.Close()
+	gateway.AddBackend("login", "login", "login")
+	gateway.AddBackend("game", "game1", "game1")
+	gateway.AddBackend("game", "game2", "game2")
+	gateway.Route(1, 99, "login")
+	gateway.Route(100, 199, "game")
+	gateway.HandleAuth(func(conn network.Conn, b []byte) (string, error) {
+		if string(b) != "token:alice" {
+			return "", errors.New("invalid token")
+		}
+		return "alice", nil
+	})
+	server := network.NewTCPServer("gateway", memnetListen(t, memNetwork, "gateway"))
+	go server.ListenAndServe(gateway.TCPHandler(), codec)
+	defer server.Close()
+
+	handler := newMemnetHandler()
+	client := network.NewTCPClient("gateway", network.WithDialFunc(memNetwork.Dial))
+	go client.DialAndServe(handler, codec)
+	defer client.Close()
+	connection := handler.connection(t)
+	send := func(id uint32, payload string) {
+		connection.Send(network.DefaultMessageHeader.Pack(id, []byte(payload)))
+	}
+	receive := func(want string) {
+		t.Helper()
+		select {
+		case b := <-handler.receive:
+			if string(b) != want {
+				t.Fatalf("received %q, want %q", b, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %q", want)
+		}
+	}
+
+	connection.Send([]byte("token:alice"))
+	send(1, "hello")
+	backends["login"].expect(t, "connect alice")
+	backends["login"].expect(t, "receive hello")
+	receive("login:hello")
+
+	send(100, "move")
+	var from string
+	select {
+	case b := <-handler.receive:
+		from = strings.TrimSuffix(string(b), ":move")
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for move")
+	}
+	session := gateway.Session(1)
+	if session.Backend("game") != from || session.Identity() != "alice" {
+		t.Fatalf("session bound to %q", session.Backend("game"))
+	}
+	to := map[string]string{"game1": "game2", "game2": "game1"}[from]
+	backends[from].expect(t, "connect alice")
+	backends[from].expect(t, "receive move")
+
+	if err := session.Migrate("game", to); err != nil {
+		t.Fatal(err)
+	}
+	send(101, "move")
+	backends[from].expect(t, "migrate out")
+	backends[to].expect(t, "migrate in alice")
+	backends[to].expect(t, "receive move")
+	receive(to + ":move")
+
+	// the session is no longer bound to the old backend
+	backends[from].session.Push([]byte("stale"))
+	send(101, "move")
+	backends[to].expect(t, "receive move")
+	receive(to + ":move")
+
+	// the messages are kept while the backend restarts
+	servers[to].Close()
+	backends[to].expect(t, "disconnect")
+	time.Sleep(time.Millisecond * 50)
+	send(102, "queued")
+	serveBackend(to)
+	backends[to].expect(t, "connect alice")
+	backends[to].expect(t, "receive queued")
+	receive(to + ":queued")
+
+	send(103, "kick")
+	backends[to].expect(t, "receive kick")
+	select {
+	case <-handler.closed:
+	case <-time.After(time.Second):
+		t.Fatal("kick timeout")
+	}
+	backends["login"].expect(t, "disconnect")
+	backends[to].expect(t, "disconnect")
+}
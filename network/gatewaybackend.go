@@ -0,0 +1,147 @@
+package network
+
+import (
+	"encoding/binary"
+	"log"
+	"sync"
+)
+
+// GatewayBackendHandler handles the client sessions of gateways on a backend
+// served by NewGatewayBackend.
+type GatewayBackendHandler interface {
+	Connect(session *BackendSession, connected bool)
+	Receive(session *BackendSession, b []byte)
+}
+
+// BackendSession is a client session of a gateway connected to the backend.
+// The sessions of a gateway are disconnected when its connection is closed,
+// and connected again when it reconnects.
+type BackendSession struct {
+	id       uint64
+	identity string
+	migrated bool
+	conn     *TCPConnection
+
+	Userdata interface{}
+}
+
+// ID returns the session ID, unique on its gateway.
+func (s *BackendSession) ID() uint64 {
+	return s.id
+}
+
+// Identity returns the identity the gateway authenticated.
+func (s *BackendSession) Identity() string {
+	return s.identity
+}
+
+// Migrated reports whether the session was connected or disconnected by
+// GatewaySession.Migrate.
+func (s *BackendSession) Migrated() bool {
+	return s.migrated
+}
+
+// Gateway returns the connection of the gateway.
+func (s *BackendSession) Gateway() *TCPConnection {
+	return s.conn
+}
+
+// Push sends b to the client as is.
+func (s *BackendSession) Push(b []byte) error {
+	return s.conn.Send(packGateway(gatewayPush, s.id, b))
+}
+
+// Kick asks the gateway to close the client connection.
+func (s *BackendSession) Kick() error {
+	return s.conn.Send(packGateway(gatewayKick, s.id, nil))
+}
+
+func (s *BackendSession) GetUserdata() interface{} {
+	return s.Userdata
+}
+
+func (s *BackendSession) SetUserdata(userdata interface{}) {
+	s.Userdata = userdata
+}
+
+type gatewayBackendHandler struct {
+	handler GatewayBackendHandler
+
+	mutex sync.Mutex
+	conns map[*TCPConnection]map[uint64]*BackendSession
+}
+
+// NewGatewayBackend returns a TCPHandler serving the gateways connected to a
+// backend, with the codec of the Gateway.
+func NewGatewayBackend(handler GatewayBackendHandler) TCPHandler {
+	h := &gatewayBackendHandler{
+		handler: handler,
+		conns:   make(map[*TCPConnection]map[uint64]*BackendSession),
+	}
+	return h
+}
+
+func (h *gatewayBackendHandler) Connect(conn *TCPConnection, connected bool) {
+	h.mutex.Lock()
+	if connected {
+		h.conns[conn] = make(map[uint64]*BackendSession)
+		h.mutex.Unlock()
+		return
+	}
+	sessions := h.conns[conn]
+	delete(h.conns, conn)
+	h.mutex.Unlock()
+	for _, session := range sessions {
+		session.migrated = false
+		h.handler.Connect(session, false)
+	}
+}
+
+func (h *gatewayBackendHandler) Receive(conn *TCPConnection, buf []byte) {
+	if len(buf) < gatewayHeaderSize {
+		log.Printf("network: gateway %v: %v", conn.RemoteAddr(), ErrGatewayMessage)
+		conn.Close()
+		return
+	}
+	id := binary.BigEndian.Uint64(buf[1:])
+	payload := buf[gatewayHeaderSize:]
+
+	h.mutex.Lock()
+	sessions := h.conns[conn]
+	session := sessions[id]
+	h.mutex.Unlock()
+	switch buf[0] {
+	case gatewayConnect:
+		if len(payload) < 1 || session != nil {
+			break
+		}
+		session = &BackendSession{
+			id:       id,
+			identity: string(payload[1:]),
+			migrated: payload[0]&gatewayMigrated != 0,
+			conn:     conn,
+		}
+		h.mutex.Lock()
+		sessions[id] = session
+		h.mutex.Unlock()
+		h.handler.Connect(session, true)
+		return
+	case gatewayDisconnect:
+		if len(payload) < 1 || session == nil {
+			break
+		}
+		h.mutex.Lock()
+		delete(sessions, id)
+		h.mutex.Unlock()
+		session.migrated = payload[0]&gatewayMigrated != 0
+		h.handler.Connect(session, false)
+		return
+	case gatewayForward:
+		if session == nil {
+			break
+		}
+		h.handler.Receive(session, payload)
+		return
+	}
+	log.Printf("network: gateway %v session %d: %v", conn.RemoteAddr(), id, ErrGatewayMessage)
+}
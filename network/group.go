@@ -0,0 +1,146 @@
+package network
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+type GroupStats struct {
+	Members    int
+	Broadcasts uint64
+	Sent       uint64 // messages queued on members
+	Failed     uint64 // messages members refused, see Backpressure
+	Bytes      uint64 // bytes of the messages sent
+}
+
+// Group is a set of connections messages are broadcast to, such as a room.
+// Connections of this package leave the groups they are in once closed.
+type Group struct {
+	// 64-bit atomic counters first, for alignment on 32-bit platforms
+	broadcasts uint64
+	sent       uint64
+	failed     uint64
+	bytes      uint64
+
+	mutex   sync.RWMutex
+	members map[Conn]func() // removes the close hook
+}
+
+func NewGroup() *Group {
+	return &Group{
+		members: make(map[Conn]func()),
+	}
+}
+
+// Add adds conn to the group, it returns false when conn is already closed.
+func (g *Group) Add(conn Conn) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if _, ok := g.members[conn]; ok {
+		return true
+	}
+	remove := func() {}
+	if notifier, ok := conn.(closeNotifier); ok {
+		if remove, ok = notifier.onClose(func() { g.remove(conn, false) }); !ok {
+			return false
+		}
+	}
+	g.members[conn] = remove
+	return true
+}
+
+func (g *Group) Remove(conn Conn) {
+	g.remove(conn, true)
+}
+
+func (g *Group) remove(conn Conn, removeHook bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	remove, ok := g.members[conn]
+	if !ok {
+		return
+	}
+	delete(g.members, conn)
+	if removeHook {
+		remove()
+	}
+}
+
+func (g *Group) Contains(conn Conn) bool {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	_, ok := g.members[conn]
+	return ok
+}
+
+func (g *Group) Len() int {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return len(g.members)
+}
+
+func (g *Group) Members() []Conn {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	members := make([]Conn, 0, len(g.members))
+	for conn := range g.members {
+		members = append(members, conn)
+	}
+	return members
+}
+
+// Broadcast sends b to the members filter returns true for, or to every
+// member when filter is nil. b is shared by the members and must not be
+// modified after. It returns the number of members b was sent to.
+func (g *Group) Broadcast(b []byte, filter func(conn Conn) bool) int {
+	return g.broadcast(len(b), filter, func(conn Conn) error {
+		return conn.Send(b)
+	})
+}
+
+// BroadcastBuffer is Broadcast with buffer.B, each member holds a reference
+// until it is written and the caller's reference is released.
+func (g *Group) BroadcastBuffer(buffer *Buffer, filter func(conn Conn) bool) int {
+	defer buffer.Release()
+	return g.broadcast(len(buffer.B), filter, func(conn Conn) error {
+		buffer.Retain()
+		return conn.SendBuffer(buffer)
+	})
+}
+
+func (g *Group) broadcast(size int, filter func(conn Conn) bool, send func(conn Conn) error) int {
+	members := g.Members()
+	if filter != nil {
+		n := 0
+		for _, conn := range members {
+			if filter(conn) {
+				members[n] = conn
+				n++
+			}
+		}
+		members = members[:n]
+	}
+
+	sent := 0
+	for _, conn := range members {
+		if err := send(conn); err != nil {
+			continue
+		}
+		sent++
+	}
+	atomic.AddUint64(&g.broadcasts, 1)
+	atomic.AddUint64(&g.sent, uint64(sent))
+	atomic.AddUint64(&g.failed, uint64(len(members)-sent))
+	atomic.AddUint64(&g.bytes, uint64(sent*size))
+	return sent
+}
+
+func (g *Group) Stats() GroupStats {
+	return GroupStats{
+		Members:    g.Len(),
+		Broadcasts: atomic.LoadUint64(&g.broadcasts),
+		Sent:       atomic.LoadUint64(&g.sent),
+		Failed:     atomic.LoadUint64(&g.failed),
+		Bytes:      atomic.LoadUint64(&g.bytes),
+	}
+}
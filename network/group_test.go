@@ -0,0 +1,88 @@
+package network_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/iakud/plume/network"
+)
+
+type roomServer struct {
+	room      *network.Group
+	connected chan network.Conn
+}
+
+func (s *roomServer) Connect(conn network.Conn, connected bool) {
+	if connected {
+		s.room.Add(conn)
+		s.connected <- conn
+	}
+}
+
+func (s *roomServer) Receive(network.Conn, []byte) {}
+
+type roomClient struct {
+	received chan []byte
+}
+
+func (c *roomClient) Connect(network.Conn, bool) {}
+
+func (c *roomClient) Receive(conn network.Conn, b []byte) {
+	c.received <- b
+}
+
+func TestGroup(t *testing.T) {
+	codec := network.NewVarintCodec(0)
+	s := &roomServer{room: network.NewGroup(), connected: make(chan network.Conn, 3)}
+	server := network.NewTCPServer("localhost:8029")
+	go server.ListenAndServe(network.AsTCPHandler(s), codec)
+	defer server.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	var clients []*network.TCPClient
+	var members []*roomClient
+	var muted network.Conn
+	for i := 0; i < 3; i++ {
+		c := &roomClient{received: make(chan []byte, 1)}
+		client := network.NewTCPClient("localhost:8029")
+		go client.DialAndServe(network.AsTCPHandler(c), codec)
+		defer client.Close()
+		clients = append(clients, client)
+		members = append(members, c)
+		muted = <-s.connected
+	}
+
+	buffer := network.GetBuffer(5)
+	copy(buffer.B, "hello")
+	if n := s.room.BroadcastBuffer(buffer, func(conn network.Conn) bool { return conn != muted }); n != 2 {
+		t.Fatalf("broadcast to %d members", n)
+	}
+	for i, c := range members[:2] {
+		select {
+		case b := <-c.received:
+			if string(b) != "hello" {
+				t.Fatalf("member %d received %q", i, b)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout")
+		}
+	}
+	select {
+	case b := <-members[2].received:
+		t.Fatalf("filtered member received %q", b)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// members leave once closed
+	clients[0].Close()
+	for i := 0; s.room.Len() != 2; i++ {
+		if i == 50 {
+			t.Fatalf("group has %d members", s.room.Len())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	stats := s.room.Stats()
+	if stats.Members != 2 || stats.Broadcasts != 1 || stats.Sent != 2 || stats.Bytes != 10 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
@@ -0,0 +1,156 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrServerHandedOver = errors.New("network: Server listeners handed over")
+	ErrHandover         = errors.New("network: invalid listener handover")
+)
+
+// errNoHandover is returned by receiveListeners when no server serves the
+// handover socket.
+var errNoHandover = errors.New("network: no listener handover")
+
+// handoverMagic is sent with the listener file descriptors, followed by
+// their count.
+const (
+	handoverMagic        = "PLHO"
+	handoverTimeout      = 10 * time.Second
+	maxHandoverListeners = 64
+)
+
+// listenReusePort listens on addr n times with SO_REUSEPORT, the kernel
+// balances the connections between the listeners.
+func listenReusePort(addr string, n int) ([]net.Listener, error) {
+	if addr == "" {
+		addr = ":0"
+	}
+	lc := net.ListenConfig{Control: reusePortControl}
+	lns := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		ln, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			closeListeners(lns)
+			return nil, err
+		}
+		// the port chosen for ":0"
+		addr = ln.Addr().String()
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+func (s *TCPServer) isHandedOver() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.handedOver
+}
+
+// listenHandover serves the handover of the listeners on the Unix socket
+// path, replacing the socket of the previous server.
+func (s *TCPServer) listenHandover(path string) error {
+	os.Remove(path)
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.handover = ln
+	go s.serveHandover(ln)
+	return nil
+}
+
+func (s *TCPServer) serveHandover(ln *net.UnixListener) {
+	for {
+		conn, err := ln.AcceptUnix()
+		if err != nil {
+			return
+		}
+		if s.handOver(conn) {
+			return
+		}
+	}
+}
+
+// handOver sends the listeners over conn, then stops accepting on them. The
+// socket is left for the next server, which waits for conn to be closed.
+func (s *TCPServer) handOver(conn *net.UnixConn) bool {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(handoverTimeout))
+
+	s.mutex.Lock()
+	lns := s.listeners
+	s.mutex.Unlock()
+	if err := sendListeners(conn, lns); err != nil {
+		log.Printf("network: TCPServer handover error: %v", err)
+		return false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.handedOver = true
+	setUnlinkOnClose(s.listeners, false) // the next server listens on the socket files
+	closeListeners(s.listeners)
+	s.listeners = nil
+	if s.handover != nil {
+		s.handover.SetUnlinkOnClose(false)
+		s.handover.Close()
+		s.handover = nil
+	}
+	return true
+}
+
+// receiveListeners takes over the listeners of the server on the Unix socket
+// path, errNoHandover when there is none.
+func receiveListeners(path string) ([]net.Listener, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, errNoHandover
+		}
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(handoverTimeout))
+
+	lns, err := receiveListenersFrom(conn)
+	if err != nil {
+		return nil, err
+	}
+	// the previous server closes conn after its handover socket
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		closeListeners(lns)
+		if err == nil {
+			err = ErrHandover
+		}
+		return nil, err
+	}
+	// the socket files are now removed by this server
+	setUnlinkOnClose(lns, true)
+	return lns, nil
+}
+
+func setUnlinkOnClose(lns []net.Listener, unlink bool) {
+	for _, ln := range lns {
+		if unixListener, ok := ln.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(unlink)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package network_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iakud/plume/network"
+)
+
+// tagHandler echoes the messages prefixed with its tag.
+type tagHandler string
+
+func (h tagHandler) Connect(connection *network.TCPConnection, connected bool) {}
+
+func (h tagHandler) Receive(connection *network.TCPConnection, b []byte) {
+	connection.Send(append([]byte(h), b...))
+}
+
+// dialTag dials again until the server at addr listens.
+func dialTag(t *testing.T, addr string, codec network.Codec) (*network.TCPConnection, *network.TCPClient, *memnetHandler) {
+	handler := newMemnetHandler()
+	client := network.NewTCPClient(addr, network.WithBackoff(network.ExponentialBackoff{Initial: time.Millisecond * 10}))
+	go client.DialAndServe(handler, codec)
+	return handler.connection(t), client, handler
+}
+
+func expectTag(t *testing.T, connection *network.TCPConnection, handler *memnetHandler, tag string) {
+	connection.Send([]byte("!"))
+	select {
+	case b := <-handler.receive:
+		if string(b) != tag+"!" {
+			t.Fatalf("received %q, want %q", b, tag+"!")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("receive timeout")
+	}
+}
+
+func TestHandover(t *testing.T) {
+	codec := network.NewVarintCodec(0)
+	path := filepath.Join(t.TempDir(), "handover.sock")
+
+	old := network.NewTCPServer("localhost:8032", network.WithReusePort(2), network.WithHandover(path))
+	oldErr := make(chan error, 1)
+	go func() { oldErr <- old.ListenAndServe(tagHandler("old"), codec) }()
+	oldConnection, oldClient, oldHandler := dialTag(t, "localhost:8032", codec)
+	defer oldClient.Close()
+	expectTag(t, oldConnection, oldHandler, "old")
+
+	server := network.NewTCPServer("localhost:8032", network.WithHandover(path))
+	go server.ListenAndServe(tagHandler("new"), codec)
+	defer server.Close()
+	select {
+	case err := <-oldErr:
+		if err != network.ErrServerHandedOver {
+			t.Fatalf("ListenAndServe: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handover timeout")
+	}
+
+	// the old server still serves its connection, the new one accepts
+	expectTag(t, oldConnection, oldHandler, "old")
+	connection, client, handler := dialTag(t, "localhost:8032", codec)
+	defer client.Close()
+	expectTag(t, connection, handler, "new")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if drained, _, err := old.Shutdown(ctx); drained != 1 || err != nil {
+		t.Fatalf("Shutdown: %d, %v", drained, err)
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	codec := network.NewVarintCodec(0)
+	errc := make(chan error, 2)
+	for _, tag := range []string{"a", "b"} {
+		server := network.NewTCPServer("localhost:8033", network.WithReusePort(2))
+		go func(tag string) { errc <- server.ListenAndServe(tagHandler(tag), codec) }(tag)
+		defer server.Close()
+	}
+	time.Sleep(time.Millisecond * 50)
+	select {
+	case err := <-errc:
+		t.Fatalf("ListenAndServe: %v", err)
+	default:
+	}
+	connection, client, handler := dialTag(t, "localhost:8033", codec)
+	defer client.Close()
+	connection.Send([]byte("!"))
+	select {
+	case b := <-handler.receive:
+		if string(b) != "a!" && string(b) != "b!" {
+			t.Fatalf("received %q", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("receive timeout")
+	}
+}
@@ -0,0 +1,101 @@
+package network
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type heartbeat struct {
+	ping []byte
+	pong []byte
+}
+
+// receive swallows heartbeat frames and answers pings, it reports whether b
+// was a heartbeat frame.
+func (h *heartbeat) receive(b []byte, send func([]byte) error) bool {
+	if h == nil {
+		return false
+	}
+	if bytes.Equal(b, h.ping) {
+		if len(h.pong) > 0 {
+			send(h.pong)
+		}
+		return true
+	}
+	return len(h.pong) > 0 && bytes.Equal(b, h.pong)
+}
+
+// writeIdle calls idle whenever nothing has been written for timeout. Without
+// idle it only bounds the blocked writes, see WithWriteIdleTimeout.
+type writeIdle struct {
+	lastWrite int64 // unix nano, accessed atomically
+	timeout   time.Duration
+	idle      func()
+
+	mutex   sync.Mutex
+	timer   *time.Timer
+	stopped bool
+}
+
+func newWriteIdle(timeout time.Duration, idle func()) *writeIdle {
+	if timeout <= 0 {
+		return nil
+	}
+	w := &writeIdle{
+		timeout: timeout,
+		idle:    idle,
+	}
+	return w
+}
+
+func (w *writeIdle) start() {
+	if w == nil {
+		return
+	}
+	w.written()
+	if w.idle == nil {
+		return
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.stopped {
+		return
+	}
+	w.timer = time.AfterFunc(w.timeout, w.check)
+}
+
+func (w *writeIdle) written() {
+	if w == nil {
+		return
+	}
+	atomic.StoreInt64(&w.lastWrite, time.Now().UnixNano())
+}
+
+func (w *writeIdle) check() {
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&w.lastWrite)))
+	if idle >= w.timeout {
+		w.idle()
+		w.written()
+		idle = 0
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.stopped {
+		return
+	}
+	w.timer.Reset(w.timeout - idle)
+}
+
+func (w *writeIdle) stop() {
+	if w == nil {
+		return
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.stopped = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
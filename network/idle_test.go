@@ -0,0 +1,167 @@
+package network_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/iakud/plume/network"
+	"github.com/iakud/plume/network/memnet"
+)
+
+var (
+	kPing = []byte("ping")
+	kPong = []byte("pong")
+)
+
+type idleHandler struct {
+	connected chan struct{}
+	received  chan []byte
+	closed    chan error
+}
+
+func newIdleHandler() *idleHandler {
+	return &idleHandler{
+		connected: make(chan struct{}, 16),
+		received:  make(chan []byte, 16),
+		closed:    make(chan error, 16),
+	}
+}
+
+func (h *idleHandler) Connect(connection *network.TCPConnection, connected bool) {
+	if connected {
+		h.connected <- struct{}{}
+	} else {
+		h.closed <- connection.Err()
+	}
+}
+
+func (h *idleHandler) Receive(connection *network.TCPConnection, b []byte) {
+	h.received <- b
+}
+
+func TestReadIdleTimeout(t *testing.T) {
+	codec := network.NewLengthCodec(2, binary.BigEndian, 0)
+	srv := newIdleHandler()
+	server := network.NewTCPServer("localhost:8005", network.WithReadIdleTimeout(time.Millisecond*100))
+	go server.ListenAndServe(srv, codec)
+	defer server.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	c := newIdleHandler()
+	client := network.NewTCPClient("localhost:8005")
+	go client.DialAndServe(c, codec)
+	defer client.Close()
+
+	if err := <-srv.closed; err != network.ErrReadIdleTimeout {
+		t.Fatalf("server close: %v, want ErrReadIdleTimeout", err)
+	}
+	if err := <-c.closed; err != io.EOF {
+		t.Fatalf("client close: %v, want EOF", err)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	codec := network.NewLengthCodec(2, binary.BigEndian, 0)
+	srv := newIdleHandler()
+	server := network.NewTCPServer("localhost:8006",
+		network.WithReadIdleTimeout(time.Millisecond*100),
+		network.WithHeartbeat(kPing, kPong),
+	)
+	go server.ListenAndServe(srv, codec)
+	defer server.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	c := newIdleHandler()
+	client := network.NewTCPClient("localhost:8006",
+		network.WithReadIdleTimeout(time.Millisecond*100),
+		network.WithWriteIdleTimeout(time.Millisecond*20),
+		network.WithHeartbeat(kPing, kPong),
+	)
+	go client.DialAndServe(c, codec)
+
+	select {
+	case err := <-srv.closed:
+		t.Fatalf("server close: %v", err)
+	case err := <-c.closed:
+		t.Fatalf("client close: %v", err)
+	case b := <-srv.received:
+		t.Fatalf("server receive %q", b)
+	case b := <-c.received:
+		t.Fatalf("client receive %q", b)
+	case <-time.After(time.Millisecond * 500):
+	}
+	client.Close()
+	if err := <-c.closed; err != network.ErrClientClosed {
+		t.Fatalf("client close: %v, want ErrClientClosed", err)
+	}
+	if err := <-srv.closed; err != io.EOF {
+		t.Fatalf("server close: %v, want EOF", err)
+	}
+}
+
+func TestWriteIdleWithoutHeartbeat(t *testing.T) {
+	codec := network.NewLengthCodec(2, binary.BigEndian, 0)
+	memNetwork := memnet.NewNetwork(memnet.StreamConfig{})
+	srv := newIdleHandler()
+	server := network.NewTCPServer("idle", network.WithListenFunc(memNetwork.Listen))
+	go server.ListenAndServe(srv, codec)
+	defer server.Close()
+
+	c := newIdleHandler()
+	client := network.NewTCPClient("idle",
+		network.WithDialFunc(memNetwork.Dial),
+		network.WithWriteIdleTimeout(time.Millisecond*20),
+	)
+	client.EnableRetry() // the server may not listen yet
+	go client.DialAndServe(c, codec)
+	<-srv.connected
+
+	// quiet connections are kept
+	select {
+	case err := <-srv.closed:
+		t.Fatalf("server close: %v", err)
+	case err := <-c.closed:
+		t.Fatalf("client close: %v", err)
+	case <-time.After(time.Millisecond * 200):
+	}
+	client.Close()
+	if err := <-c.closed; err != network.ErrClientClosed {
+		t.Fatalf("client close: %v, want ErrClientClosed", err)
+	}
+}
+
+type wsIdleHandler struct {
+	closed chan error
+}
+
+func (h *wsIdleHandler) Connect(connection *network.WSConnection, connected bool) {
+	if !connected {
+		h.closed <- connection.Err()
+	}
+}
+
+func (h *wsIdleHandler) Receive(*network.WSConnection, []byte) {}
+
+func TestWSReadIdleTimeout(t *testing.T) {
+	srv := &wsIdleHandler{closed: make(chan error, 1)}
+	wsServer := network.NewWSServer(srv, network.WithReadIdleTimeout(time.Millisecond*100))
+	httpServer := &http.Server{Addr: "localhost:8007", Handler: wsServer}
+	go httpServer.ListenAndServe()
+	defer httpServer.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	c := &wsIdleHandler{closed: make(chan error, 1)}
+	wsClient := network.NewWSClient("ws://localhost:8007", c)
+	go wsClient.DialAndServe()
+	defer wsClient.Close()
+
+	if err := <-srv.closed; err != network.ErrReadIdleTimeout {
+		t.Fatalf("server close: %v, want ErrReadIdleTimeout", err)
+	}
+	if err := <-c.closed; err != io.EOF {
+		t.Fatalf("client close: %v, want EOF", err)
+	}
+}
@@ -0,0 +1,106 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const DefaultMaxFrameSize = 4 << 20
+
+var (
+	ErrFrameTooLarge = errors.New("network: frame too large")
+)
+
+// LengthCodec frames each message with a fixed 2 or 4 byte length header.
+type LengthCodec struct {
+	size         int
+	order        binary.ByteOrder
+	maxFrameSize int
+}
+
+// NewLengthCodec returns a codec with a size byte length header in the given
+// byte order. A maxFrameSize <= 0 means DefaultMaxFrameSize, it is also capped
+// by what the header can express.
+func NewLengthCodec(size int, order binary.ByteOrder, maxFrameSize int) *LengthCodec {
+	if size != 2 && size != 4 {
+		panic("network: length codec header size must be 2 or 4")
+	}
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+	if limit := uint64(1)<<(uint(size)*8) - 1; uint64(maxFrameSize) > limit {
+		maxFrameSize = int(limit)
+	}
+	codec := &LengthCodec{
+		size:         size,
+		order:        order,
+		maxFrameSize: maxFrameSize,
+	}
+	return codec
+}
+
+func (c *LengthCodec) MaxFrameSize() int {
+	return c.maxFrameSize
+}
+
+func (c *LengthCodec) Read(r io.Reader) ([]byte, error) {
+	var h [4]byte
+	if _, err := io.ReadFull(r, h[:c.size]); err != nil {
+		return nil, err
+	}
+	var n uint64
+	if c.size == 2 {
+		n = uint64(c.order.Uint16(h[:]))
+	} else {
+		n = uint64(c.order.Uint32(h[:]))
+	}
+	if n > uint64(c.maxFrameSize) {
+		return nil, ErrFrameTooLarge
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return b, nil
+}
+
+func (c *LengthCodec) Write(w io.Writer, b []byte) error {
+	if len(b) > c.maxFrameSize {
+		return ErrFrameTooLarge
+	}
+	var h [4]byte
+	if c.size == 2 {
+		c.order.PutUint16(h[:], uint16(len(b)))
+	} else {
+		c.order.PutUint32(h[:], uint32(len(b)))
+	}
+	if _, err := w.Write(h[:c.size]); err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *LengthCodec) AppendHeader(dst []byte, b []byte) ([]byte, error) {
+	if len(b) > c.maxFrameSize {
+		return dst, ErrFrameTooLarge
+	}
+	var h [4]byte
+	if c.size == 2 {
+		c.order.PutUint16(h[:], uint16(len(b)))
+	} else {
+		c.order.PutUint32(h[:], uint32(len(b)))
+	}
+	return append(dst, h[:c.size]...), nil
+}
+
+// unexpectedEOF reports a frame cut short once its header has been read.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,23 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package network
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errListenUnsupported = errors.New("network: SO_REUSEPORT and listener handover are not supported")
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errListenUnsupported
+}
+
+func sendListeners(conn *net.UnixConn, lns []net.Listener) error {
+	return errListenUnsupported
+}
+
+func receiveListenersFrom(conn *net.UnixConn) ([]net.Listener, error) {
+	return nil, errListenUnsupported
+}
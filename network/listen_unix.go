@@ -0,0 +1,88 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package network
+
+import (
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// sendListeners sends the file descriptors of lns with SCM_RIGHTS.
+func sendListeners(conn *net.UnixConn, lns []net.Listener) error {
+	if len(lns) == 0 || len(lns) > maxHandoverListeners {
+		return ErrHandover
+	}
+	fds := make([]int, 0, len(lns))
+	for _, ln := range lns {
+		filer, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return ErrHandover
+		}
+		f, err := filer.File()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fds = append(fds, int(f.Fd()))
+	}
+	b := append([]byte(handoverMagic), byte(len(fds)))
+	_, _, err := conn.WriteMsgUnix(b, syscall.UnixRights(fds...), nil)
+	return err
+}
+
+func receiveListenersFrom(conn *net.UnixConn) ([]net.Listener, error) {
+	b := make([]byte, len(handoverMagic)+1)
+	oob := make([]byte, syscall.CmsgSpace(maxHandoverListeners*4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(b, oob)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	for i := range msgs {
+		rights, err := syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			continue
+		}
+		fds = append(fds, rights...)
+	}
+	files := make([]*os.File, len(fds))
+	for i, fd := range fds {
+		files[i] = os.NewFile(uintptr(fd), "listener")
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if n != len(b) || string(b[:len(handoverMagic)]) != handoverMagic || int(b[len(handoverMagic)]) != len(fds) {
+		return nil, ErrHandover
+	}
+
+	lns := make([]net.Listener, 0, len(files))
+	for _, f := range files {
+		ln, err := net.FileListener(f)
+		if err != nil {
+			closeListeners(lns)
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
@@ -0,0 +1,64 @@
+package network
+
+import (
+	"log"
+	"net"
+	"runtime"
+
+	"github.com/iakud/plume/eventloop"
+)
+
+// loopBalancer picks the event loop a connection is bound to.
+type loopBalancer struct {
+	pool *eventloop.Pool
+	hash func(addr net.Addr) int
+}
+
+func (b *loopBalancer) get(addr net.Addr) *eventloop.EventLoop {
+	if b == nil || b.pool == nil {
+		return nil
+	}
+	if b.hash != nil {
+		return b.pool.GetLoopForHash(b.hash(addr))
+	}
+	return b.pool.GetNextLoop()
+}
+
+// runInLoop runs f on loop, or right away without a loop or once the loop is
+// closed. Panics on the loop are logged and close the connection through
+// closeWithReason.
+func runInLoop(loop *eventloop.EventLoop, addr net.Addr, closeWithReason func(CloseReason), f func()) {
+	if loop == nil {
+		f()
+		return
+	}
+	functor := func() {
+		defer func() {
+			if err := recover(); err != nil {
+				const size = 64 << 10
+				buf := make([]byte, size)
+				buf = buf[:runtime.Stack(buf, false)]
+				log.Printf("network: panic serving %v: %v\n%s", addr, err, buf)
+				closeWithReason(panicCloseReason(err))
+			}
+		}()
+		f()
+	}
+	if !loop.RunInLoop(functor) {
+		functor()
+	}
+}
+
+// runInLoopWait is runInLoop waiting for f to return.
+func runInLoopWait(loop *eventloop.EventLoop, addr net.Addr, closeWithReason func(CloseReason), f func()) {
+	if loop == nil {
+		f()
+		return
+	}
+	done := make(chan struct{})
+	runInLoop(loop, addr, closeWithReason, func() {
+		defer close(done)
+		f()
+	})
+	<-done
+}
@@ -0,0 +1,152 @@
+package network_test
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/iakud/plume/eventloop"
+	"github.com/iakud/plume/network"
+	"github.com/iakud/plume/network/memnet"
+)
+
+const (
+	kLoopClients  = 4
+	kLoopMessages = 100
+)
+
+type loopPool struct{}
+
+func (loopPool) LoopInit(*eventloop.EventLoop)  {}
+func (loopPool) LoopClose(*eventloop.EventLoop) {}
+
+// loopServer state is only touched on the loop, the race detector reports
+// any handler called elsewhere.
+type loopServer struct {
+	t        *testing.T
+	loop     *eventloop.EventLoop
+	received map[*network.TCPConnection]uint32
+	done     chan struct{}
+}
+
+func (srv *loopServer) Connect(connection *network.TCPConnection, connected bool) {
+	if connection.Loop() != srv.loop {
+		srv.t.Error("connection not bound to the loop")
+	}
+	if connected {
+		srv.received[connection] = 0
+		return
+	}
+	delete(srv.received, connection)
+}
+
+func (srv *loopServer) Receive(connection *network.TCPConnection, b []byte) {
+	n := binary.BigEndian.Uint32(b)
+	if n != srv.received[connection] {
+		srv.t.Errorf("received %d, want %d", n, srv.received[connection])
+	}
+	srv.received[connection] = n + 1
+	if n+1 == kLoopMessages {
+		srv.done <- struct{}{}
+	}
+}
+
+type loopClient struct {
+	client *network.TCPClient
+}
+
+func (c *loopClient) Connect(connection *network.TCPConnection, connected bool) {
+	if !connected {
+		c.client.Close()
+		return
+	}
+	for i := 0; i < kLoopMessages; i++ {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(i))
+		connection.Send(b)
+	}
+}
+
+func (c *loopClient) Receive(*network.TCPConnection, []byte) {}
+
+func TestEventLoop(t *testing.T) {
+	pool := eventloop.NewPool(1, loopPool{})
+	defer pool.Close()
+	srv := &loopServer{
+		t:        t,
+		loop:     pool.GetAllLoops()[0],
+		received: make(map[*network.TCPConnection]uint32),
+		done:     make(chan struct{}, kLoopClients),
+	}
+	codec := network.NewLengthCodec(2, binary.BigEndian, 0)
+	server := network.NewTCPServer("localhost:8013", network.WithEventLoopPool(pool))
+	go server.ListenAndServe(srv, codec)
+	defer server.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	for i := 0; i < kLoopClients; i++ {
+		c := &loopClient{client: network.NewTCPClient("localhost:8013")}
+		go c.client.DialAndServe(c, codec)
+		defer c.client.Close()
+	}
+	for i := 0; i < kLoopClients; i++ {
+		select {
+		case <-srv.done:
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+type loopClosedServer struct {
+	connected    chan struct{}
+	disconnected chan struct{}
+}
+
+func (srv *loopClosedServer) Connect(connection *network.TCPConnection, connected bool) {
+	if connected {
+		srv.connected <- struct{}{}
+	} else {
+		srv.disconnected <- struct{}{}
+	}
+}
+
+func (srv *loopClosedServer) Receive(*network.TCPConnection, []byte) {}
+
+func TestEventLoopClosed(t *testing.T) {
+	pool := eventloop.NewPool(1, loopPool{})
+	memNetwork := memnet.NewNetwork(memnet.StreamConfig{})
+	ln, err := memNetwork.Listen("loop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &loopClosedServer{
+		connected:    make(chan struct{}, 1),
+		disconnected: make(chan struct{}, 1),
+	}
+	server := network.NewTCPServer("loop",
+		network.WithListenFunc(func(string) (net.Listener, error) { return ln, nil }),
+		network.WithEventLoopPool(pool),
+	)
+	go server.ListenAndServe(srv, nil)
+	defer server.Close()
+
+	client := network.NewTCPClient("loop", network.WithDialFunc(memNetwork.Dial))
+	go client.DialAndServe(&loopClosedServer{
+		connected:    make(chan struct{}, 1),
+		disconnected: make(chan struct{}, 1),
+	}, nil)
+	defer client.Close()
+	<-srv.connected
+
+	// the events after the pool is closed run on the connection goroutine
+	pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if _, forced, err := server.Shutdown(ctx); err != nil || forced != 0 {
+		t.Fatalf("shutdown: %v, %d forced", err, forced)
+	}
+	<-srv.disconnected
+}
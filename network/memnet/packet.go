@@ -0,0 +1,199 @@
+// Package memnet provides in-memory connections with configurable faults for
+// tests.
+package memnet
+
+import (
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Addr is the address of an in-memory endpoint.
+type Addr string
+
+func (Addr) Network() string {
+	return "memnet"
+}
+
+func (a Addr) String() string {
+	return string(a)
+}
+
+// LinkConfig sets the faults of a packet link, applied to each packet in
+// both directions.
+type LinkConfig struct {
+	Loss    float64       // probability a packet is dropped
+	Reorder float64       // probability a packet is held back behind later ones
+	Latency time.Duration // delay of every packet
+	Jitter  time.Duration // random extra delay up to Jitter
+	Seed    int64         // seed of the fault decisions
+}
+
+type packet struct {
+	b    []byte
+	from net.Addr
+}
+
+type packetLink struct {
+	config LinkConfig
+
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+// NewPacketLink returns the two ends of a lossy datagram link, with addresses
+// "a" and "b". Packets written to any other address are discarded.
+func NewPacketLink(config LinkConfig) (a net.PacketConn, b net.PacketConn) {
+	link := &packetLink{
+		config: config,
+		rand:   rand.New(rand.NewSource(config.Seed)),
+	}
+	connA := newPacketConn(link, Addr("a"))
+	connB := newPacketConn(link, Addr("b"))
+	connA.peer, connB.peer = connB, connA
+	return connA, connB
+}
+
+// delay returns how long a packet takes, ok is false when it is lost.
+func (l *packetLink) delay() (time.Duration, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.rand.Float64() < l.config.Loss {
+		return 0, false
+	}
+	delay := l.config.Latency
+	if l.config.Jitter > 0 {
+		delay += time.Duration(l.rand.Int63n(int64(l.config.Jitter)))
+	}
+	if l.rand.Float64() < l.config.Reorder {
+		delay += 2*(l.config.Latency+l.config.Jitter) + time.Millisecond
+	}
+	return delay, true
+}
+
+const packetQueueSize = 1024
+
+type packetConn struct {
+	link *packetLink
+	addr Addr
+	peer *packetConn
+
+	in        chan packet
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mutex           sync.Mutex
+	readDeadline    time.Time
+	deadlineChanged chan struct{}
+}
+
+func newPacketConn(link *packetLink, addr Addr) *packetConn {
+	c := &packetConn{
+		link:            link,
+		addr:            addr,
+		in:              make(chan packet, packetQueueSize),
+		closed:          make(chan struct{}),
+		deadlineChanged: make(chan struct{}),
+	}
+	return c
+}
+
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mutex.Lock()
+		deadline, changed := c.readDeadline, c.deadlineChanged
+		c.mutex.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		n, from, ok, err := c.read(b, changed, timeout)
+		if timer != nil {
+			timer.Stop()
+		}
+		if ok {
+			return n, from, err
+		}
+	}
+}
+
+// read returns ok false when the read deadline changed.
+func (c *packetConn) read(b []byte, changed chan struct{}, timeout <-chan time.Time) (int, net.Addr, bool, error) {
+	select {
+	case p := <-c.in:
+		return copy(b, p.b), p.from, true, nil
+	case <-c.closed:
+		return 0, nil, true, c.opError("read", net.ErrClosed)
+	case <-timeout:
+		return 0, nil, true, c.opError("read", os.ErrDeadlineExceeded)
+	case <-changed:
+		return 0, nil, false, nil
+	}
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.opError("write", net.ErrClosed)
+	default:
+	}
+	if addr.String() != c.peer.addr.String() {
+		return len(b), nil
+	}
+	delay, ok := c.link.delay()
+	if !ok {
+		return len(b), nil
+	}
+	p := packet{b: append([]byte(nil), b...), from: c.addr}
+	if delay <= 0 {
+		c.peer.deliver(p)
+	} else {
+		time.AfterFunc(delay, func() { c.peer.deliver(p) })
+	}
+	return len(b), nil
+}
+
+// deliver drops the packet when the receive queue is full, like a socket
+// buffer.
+func (c *packetConn) deliver(p packet) {
+	select {
+	case <-c.closed:
+	case c.in <- p:
+	default:
+	}
+}
+
+func (c *packetConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *packetConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *packetConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *packetConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.readDeadline = t
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline is a no-op, writes never block.
+func (c *packetConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *packetConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "memnet", Addr: c.addr, Err: err}
+}
@@ -0,0 +1,455 @@
+package memnet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var errAddrInUse = errors.New("address already in use")
+
+// StreamConfig sets the faults of the connections of a Network, applied to
+// each direction.
+type StreamConfig struct {
+	Latency    time.Duration // delay of every write
+	Bandwidth  int           // bytes per second, zero means no limit
+	ReadSize   int           // reads return at most ReadSize bytes, zero means no limit
+	Buffer     int           // bytes buffered before writes block, default 256KB
+	ResetAfter int           // the connection is reset after writing this many bytes, zero means never
+}
+
+const defaultStreamBuffer = 256 << 10
+
+// Network is an in-memory stream network. Its Listen and Dial may replace
+// net.Listen and net.Dial, such as with network.WithListenFunc and
+// network.WithDialFunc. Connections support deadlines and CloseWrite.
+type Network struct {
+	config StreamConfig
+
+	mutex     sync.Mutex
+	listeners map[string]*listener
+	next      int
+}
+
+func NewNetwork(config StreamConfig) *Network {
+	if config.Buffer <= 0 {
+		config.Buffer = defaultStreamBuffer
+	}
+	return &Network{
+		config:    config,
+		listeners: make(map[string]*listener),
+	}
+}
+
+// Listen listens on addr, an empty addr or one ending with ":0" is given a
+// unique address.
+func (n *Network) Listen(addr string) (net.Listener, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if addr == "" || strings.HasSuffix(addr, ":0") {
+		addr = n.newAddr("listener")
+	}
+	if _, ok := n.listeners[addr]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "memnet", Addr: Addr(addr), Err: errAddrInUse}
+	}
+	l := &listener{
+		network: n,
+		addr:    Addr(addr),
+		accept:  make(chan *Conn, listenBacklog),
+		closed:  make(chan struct{}),
+	}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+func (n *Network) newAddr(prefix string) string {
+	n.next++
+	return prefix + "-" + strconv.Itoa(n.next)
+}
+
+// Dial connects to the listener on addr, the connection is refused when
+// there is none.
+func (n *Network) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	n.mutex.Lock()
+	l, ok := n.listeners[addr]
+	local := Addr(n.newAddr("client"))
+	n.mutex.Unlock()
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: "memnet", Addr: Addr(addr), Err: syscall.ECONNREFUSED}
+	}
+
+	client, server := newConnPair(n.config, local, l.addr)
+	select {
+	case l.accept <- server:
+	case <-l.closed:
+		return nil, &net.OpError{Op: "dial", Net: "memnet", Addr: l.addr, Err: syscall.ECONNREFUSED}
+	case <-ctx.Done():
+		return nil, &net.OpError{Op: "dial", Net: "memnet", Addr: l.addr, Err: ctx.Err()}
+	}
+	// Close may have drained the backlog before the send, otherwise it
+	// resets server when draining
+	if l.isClosed() {
+		server.Reset()
+		return nil, &net.OpError{Op: "dial", Net: "memnet", Addr: l.addr, Err: syscall.ECONNREFUSED}
+	}
+	return client, nil
+}
+
+const listenBacklog = 128
+
+type listener struct {
+	network   *Network
+	addr      Addr
+	accept    chan *Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *listener) isClosed() bool {
+	select {
+	case <-l.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "accept", Net: "memnet", Addr: l.addr, Err: net.ErrClosed}
+	}
+}
+
+func (l *listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.network.mutex.Lock()
+		delete(l.network.listeners, string(l.addr))
+		l.network.mutex.Unlock()
+		// refuse the connections not accepted
+		for {
+			select {
+			case conn := <-l.accept:
+				conn.Reset()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+// chunk is a write, readable from at.
+type chunk struct {
+	b  []byte
+	at time.Time
+}
+
+// pipe is one direction of a connection.
+type pipe struct {
+	config StreamConfig
+
+	mutex    sync.Mutex
+	chunks   []chunk
+	buffered int
+	written  int
+	busy     time.Time // when the bandwidth is available again
+	eof      bool
+	reset    bool
+	changed  chan struct{}
+}
+
+func newPipe(config StreamConfig) *pipe {
+	return &pipe{
+		config:  config,
+		changed: make(chan struct{}),
+	}
+}
+
+// notify wakes the readers and writers waiting on p, p.mutex is held.
+func (p *pipe) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *pipe) setReset() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.reset = true
+	p.chunks, p.buffered = nil, 0
+	p.notify()
+}
+
+func (p *pipe) setEOF() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.eof = true
+	p.notify()
+}
+
+// read returns ok false with the time to wait for, zero when waiting for a
+// change.
+func (p *pipe) read(b []byte) (n int, ok bool, wake time.Time, changed chan struct{}, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.reset {
+		return 0, true, time.Time{}, nil, syscall.ECONNRESET
+	}
+	if len(p.chunks) == 0 {
+		if p.eof {
+			return 0, true, time.Time{}, nil, io.EOF
+		}
+		return 0, false, time.Time{}, p.changed, nil
+	}
+	c := &p.chunks[0]
+	if now := time.Now(); c.at.After(now) {
+		return 0, false, c.at, p.changed, nil
+	}
+	if p.config.ReadSize > 0 && len(b) > p.config.ReadSize {
+		b = b[:p.config.ReadSize]
+	}
+	n = copy(b, c.b)
+	c.b = c.b[n:]
+	if len(c.b) == 0 {
+		p.chunks = p.chunks[1:]
+	}
+	p.buffered -= n
+	p.notify()
+	return n, true, time.Time{}, nil, nil
+}
+
+// write returns ok false when the buffer is full.
+func (p *pipe) write(b []byte) (ok bool, changed chan struct{}, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.reset {
+		return true, nil, syscall.ECONNRESET
+	}
+	if p.eof {
+		return true, nil, syscall.EPIPE
+	}
+	if p.buffered >= p.config.Buffer {
+		return false, p.changed, nil
+	}
+	if p.config.ResetAfter > 0 && p.written+len(b) > p.config.ResetAfter {
+		return true, nil, errReset
+	}
+	p.written += len(b)
+
+	now := time.Now()
+	at := now
+	if p.config.Bandwidth > 0 {
+		if p.busy.After(at) {
+			at = p.busy
+		}
+		at = at.Add(time.Duration(len(b)) * time.Second / time.Duration(p.config.Bandwidth))
+		p.busy = at
+	}
+	at = at.Add(p.config.Latency)
+	p.chunks = append(p.chunks, chunk{b: append([]byte(nil), b...), at: at})
+	p.buffered += len(b)
+	p.notify()
+	return true, nil, nil
+}
+
+// errReset asks write to reset the connection.
+var errReset = errors.New("reset")
+
+// deadline is a read or write deadline of a Conn.
+type deadline struct {
+	mutex   sync.Mutex
+	t       time.Time
+	changed chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{changed: make(chan struct{})}
+}
+
+func (d *deadline) get() (time.Time, chan struct{}) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.t, d.changed
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.t = t
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+// Conn is an in-memory stream connection.
+type Conn struct {
+	local, remote Addr
+	in, out       *pipe
+
+	readDeadline  *deadline
+	writeDeadline *deadline
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnPair(config StreamConfig, client, server Addr) (*Conn, *Conn) {
+	up, down := newPipe(config), newPipe(config)
+	a := &Conn{local: client, remote: server, in: down, out: up}
+	b := &Conn{local: server, remote: client, in: up, out: down}
+	for _, c := range []*Conn{a, b} {
+		c.readDeadline, c.writeDeadline = newDeadline(), newDeadline()
+		c.closed = make(chan struct{})
+	}
+	return a, b
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if c.isClosed() {
+		return 0, c.opError("read", net.ErrClosed)
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for {
+		n, ok, wake, changed, err := c.in.read(b)
+		if ok {
+			if err != nil && err != io.EOF {
+				err = c.opError("read", err)
+			}
+			return n, err
+		}
+		if err := c.wait(c.readDeadline, wake, changed); err != nil {
+			return 0, c.opError("read", err)
+		}
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.isClosed() {
+		return 0, c.opError("write", net.ErrClosed)
+	}
+	for {
+		ok, changed, err := c.out.write(b)
+		if err == errReset {
+			c.Reset()
+			err = syscall.ECONNRESET
+		}
+		if ok {
+			if err != nil {
+				return 0, c.opError("write", err)
+			}
+			return len(b), nil
+		}
+		if err := c.wait(c.writeDeadline, time.Time{}, changed); err != nil {
+			return 0, c.opError("write", err)
+		}
+	}
+}
+
+func (c *Conn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait waits for changed, wake or the deadline. It returns an error when
+// the deadline is exceeded or c is closed.
+func (c *Conn) wait(d *deadline, wake time.Time, changed chan struct{}) error {
+	t, deadlineChanged := d.get()
+	if c.isClosed() {
+		return net.ErrClosed
+	}
+	if !t.IsZero() && !t.After(time.Now()) {
+		return os.ErrDeadlineExceeded
+	}
+	if !t.IsZero() && (wake.IsZero() || t.Before(wake)) {
+		wake = t
+	}
+	var timeout <-chan time.Time
+	if !wake.IsZero() {
+		timer := time.NewTimer(time.Until(wake))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-changed:
+	case <-deadlineChanged:
+	case <-timeout:
+	case <-c.closed:
+		return net.ErrClosed
+	}
+	return nil
+}
+
+// Close closes c, the peer reads the data written before EOF.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.out.setEOF()
+		// the peer writes fail, as a socket closed with unread data
+		c.in.setEOF()
+	})
+	return nil
+}
+
+// CloseWrite shuts down the writing side, the peer reads EOF after the data
+// written.
+func (c *Conn) CloseWrite() error {
+	c.out.setEOF()
+	return nil
+}
+
+// Reset resets the connection, the pending data is discarded and reads and
+// writes on both ends fail with ECONNRESET.
+func (c *Conn) Reset() {
+	c.in.setReset()
+	c.out.setReset()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "memnet", Source: c.local, Addr: c.remote, Err: err}
+}
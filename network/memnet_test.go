@@ -0,0 +1,198 @@
+package network_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/iakud/plume/network"
+	"github.com/iakud/plume/network/memnet"
+)
+
+// memnetListen listens on addr of memNetwork before the server is started,
+// so that clients may dial right away.
+func memnetListen(t *testing.T, memNetwork *memnet.Network, addr string) network.Option {
+	ln, err := memNetwork.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return network.WithListenFunc(func(string) (net.Listener, error) { return ln, nil })
+}
+
+type memnetHandler struct {
+	connected chan *network.TCPConnection
+	receive   chan []byte
+	closed    chan network.CloseReason
+}
+
+func newMemnetHandler() *memnetHandler {
+	return &memnetHandler{
+		connected: make(chan *network.TCPConnection, 1),
+		receive:   make(chan []byte, 16),
+		closed:    make(chan network.CloseReason, 1),
+	}
+}
+
+func (h *memnetHandler) Connect(connection *network.TCPConnection, connected bool) {
+	if connected {
+		h.connected <- connection
+	} else {
+		h.closed <- connection.CloseReason()
+	}
+}
+
+// connection waits for the connect event.
+func (h *memnetHandler) connection(t *testing.T) *network.TCPConnection {
+	select {
+	case connection := <-h.connected:
+		return connection
+	case <-time.After(time.Second * 5):
+		t.Fatal("connect timeout")
+		return nil
+	}
+}
+
+func (h *memnetHandler) Receive(connection *network.TCPConnection, b []byte) {
+	h.receive <- append([]byte(nil), b...)
+}
+
+// echoHandler echoes every message.
+type echoHandler struct{}
+
+func (echoHandler) Connect(connection *network.TCPConnection, connected bool) {}
+
+func (echoHandler) Receive(connection *network.TCPConnection, b []byte) {
+	connection.Send(b)
+}
+
+func TestMemnetEcho(t *testing.T) {
+	memNetwork := memnet.NewNetwork(memnet.StreamConfig{
+		Latency:   time.Millisecond * 20,
+		Bandwidth: 64 << 10,
+		ReadSize:  3,
+	})
+	codec := network.NewVarintCodec(0)
+	server := network.NewTCPServer("echo:1", memnetListen(t, memNetwork, "echo:1"))
+	go server.ListenAndServe(echoHandler{}, codec)
+	defer server.Close()
+
+	handler := newMemnetHandler()
+	client := network.NewTCPClient("echo:1", network.WithDialFunc(memNetwork.Dial))
+	go client.DialAndServe(handler, codec)
+	defer client.Close()
+	connection := handler.connection(t)
+
+	message := bytes.Repeat([]byte("0123456789"), 1<<10)
+	start := time.Now()
+	if err := connection.Send(message); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-handler.receive:
+		if !bytes.Equal(b, message) {
+			t.Fatalf("received %d bytes", len(b))
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("echo timeout")
+	}
+	// 10KB each way at 64KB/s, plus the latency
+	if elapsed := time.Since(start); elapsed < time.Millisecond*300 {
+		t.Fatalf("echo in %v", elapsed)
+	}
+}
+
+func TestMemnetReset(t *testing.T) {
+	memNetwork := memnet.NewNetwork(memnet.StreamConfig{ResetAfter: 100})
+	serverHandler := newMemnetHandler()
+	server := network.NewTCPServer("reset:1", memnetListen(t, memNetwork, "reset:1"))
+	go server.ListenAndServe(serverHandler, nil)
+	defer server.Close()
+
+	if _, err := memNetwork.Dial(context.Background(), "reset:2"); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("dial: %v", err)
+	}
+
+	handler := newMemnetHandler()
+	client := network.NewTCPClient("reset:1", network.WithDialFunc(memNetwork.Dial))
+	go client.DialAndServe(handler, nil)
+	defer client.Close()
+
+	handler.connection(t).Send(make([]byte, 200))
+	for _, closed := range []chan network.CloseReason{handler.closed, serverHandler.closed} {
+		select {
+		case reason := <-closed:
+			if !errors.Is(reason.Err, syscall.ECONNRESET) {
+				t.Fatalf("close reason %v", reason)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("reset timeout")
+		}
+	}
+}
+
+func TestMemnetDialClose(t *testing.T) {
+	memNetwork := memnet.NewNetwork(memnet.StreamConfig{})
+	for i := 0; i < 1000; i++ {
+		ln, err := memNetwork.Listen("close:1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dialed := make(chan net.Conn, 1)
+		go func() {
+			conn, _ := memNetwork.Dial(context.Background(), "close:1")
+			dialed <- conn
+		}()
+		ln.Close()
+		// the connections never accepted are reset
+		if conn := <-dialed; conn != nil {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+				t.Fatalf("read: %v", err)
+			}
+		}
+	}
+}
+
+type wsMemnetHandler struct {
+	receive chan []byte
+}
+
+func (h wsMemnetHandler) Connect(connection *network.WSConnection, connected bool) {
+	if connected && h.receive == nil {
+		connection.Send([]byte("hello"))
+	}
+}
+
+func (h wsMemnetHandler) Receive(connection *network.WSConnection, b []byte) {
+	h.receive <- append([]byte(nil), b...)
+}
+
+func TestMemnetWebSocket(t *testing.T) {
+	memNetwork := memnet.NewNetwork(memnet.StreamConfig{ReadSize: 7})
+	listener, err := memNetwork.Listen("ws:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := network.NewWSServer(wsMemnetHandler{})
+	go http.Serve(listener, server)
+	defer listener.Close()
+	defer server.Close()
+
+	handler := wsMemnetHandler{receive: make(chan []byte, 1)}
+	client := network.NewWSClient("ws://ws:1/", handler, network.WithDialFunc(memNetwork.Dial))
+	go client.DialAndServe()
+	defer client.Close()
+	select {
+	case b := <-handler.receive:
+		if string(b) != "hello" {
+			t.Fatalf("received %q", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("receive timeout")
+	}
+}
@@ -0,0 +1,263 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// writeLatencyBuckets are the upper bounds in seconds of the write latency
+// histogram.
+var writeLatencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// Metrics counts the connections and traffic of the servers and clients it
+// is given to with WithMetrics. Bytes are those of messages, framing
+// excluded, received heartbeats count in bytes but not in messages.
+type Metrics struct {
+	// 64-bit atomic counters first, for alignment on 32-bit platforms
+	accepts      uint64
+	bytesIn      uint64
+	bytesOut     uint64
+	messagesIn   uint64
+	messagesOut  uint64
+	codecErrors  uint64
+	active       int64
+	queuedBytes  int64
+	closes       [CloseRateLimit + 1]uint64
+	name         string
+	latencyMutex sync.Mutex
+	latency      histogram
+}
+
+// NewMetrics returns the metrics of a server or client, name is the value of
+// the server label in the Prometheus exposition.
+func NewMetrics(name string) *Metrics {
+	return &Metrics{
+		name:    name,
+		latency: histogram{counts: make([]uint64, len(writeLatencyBuckets))},
+	}
+}
+
+type MetricsSnapshot struct {
+	Name         string
+	Connections  int64                 // active connections
+	Accepts      uint64                // connections accepted, or established by clients, before the TLS handshake
+	Closes       map[CloseCause]uint64 // closed connections by cause
+	BytesIn      uint64
+	BytesOut     uint64
+	MessagesIn   uint64
+	MessagesOut  uint64
+	CodecErrors  uint64
+	QueuedBytes  int64 // bytes pending send
+	WriteLatency HistogramSnapshot
+}
+
+// HistogramSnapshot counts observations by upper bound in seconds, Counts are
+// not cumulative and the last one counts those over every bound.
+type HistogramSnapshot struct {
+	Bounds []float64
+	Counts []uint64
+	Count  uint64
+	Sum    float64
+}
+
+type histogram struct {
+	counts []uint64 // by bound, observations over every bound are in count only
+	count  uint64
+	sum    float64
+}
+
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	snapshot := MetricsSnapshot{
+		Name:        m.name,
+		Connections: atomic.LoadInt64(&m.active),
+		Accepts:     atomic.LoadUint64(&m.accepts),
+		Closes:      make(map[CloseCause]uint64),
+		BytesIn:     atomic.LoadUint64(&m.bytesIn),
+		BytesOut:    atomic.LoadUint64(&m.bytesOut),
+		MessagesIn:  atomic.LoadUint64(&m.messagesIn),
+		MessagesOut: atomic.LoadUint64(&m.messagesOut),
+		CodecErrors: atomic.LoadUint64(&m.codecErrors),
+		QueuedBytes: atomic.LoadInt64(&m.queuedBytes),
+	}
+	for cause := range m.closes {
+		if n := atomic.LoadUint64(&m.closes[cause]); n > 0 {
+			snapshot.Closes[CloseCause(cause)] = n
+		}
+	}
+	m.latencyMutex.Lock()
+	counts := make([]uint64, len(m.latency.counts)+1)
+	copy(counts, m.latency.counts)
+	var bounded uint64
+	for _, n := range m.latency.counts {
+		bounded += n
+	}
+	counts[len(counts)-1] = m.latency.count - bounded
+	snapshot.WriteLatency = HistogramSnapshot{
+		Bounds: writeLatencyBuckets,
+		Counts: counts,
+		Count:  m.latency.count,
+		Sum:    m.latency.sum,
+	}
+	m.latencyMutex.Unlock()
+	return snapshot
+}
+
+func (m *Metrics) connect() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.accepts, 1)
+	atomic.AddInt64(&m.active, 1)
+}
+
+func (m *Metrics) disconnect(reason CloseReason) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.active, -1)
+	if int(reason.Cause) < len(m.closes) {
+		atomic.AddUint64(&m.closes[reason.Cause], 1)
+	}
+	if reason.Cause == CloseCodecError {
+		atomic.AddUint64(&m.codecErrors, 1)
+	}
+}
+
+// received counts the bytes of a frame read, heartbeats included.
+func (m *Metrics) received(n int) {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.bytesIn, uint64(n))
+}
+
+// receivedMessage counts a message passed to the handler.
+func (m *Metrics) receivedMessage() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.messagesIn, 1)
+}
+
+// written records the messages of a write and how long it took.
+func (m *Metrics) written(bufs []outgoing, d time.Duration) {
+	if m == nil {
+		return
+	}
+	var n int
+	for _, o := range bufs {
+		n += len(o.b)
+	}
+	atomic.AddUint64(&m.messagesOut, uint64(len(bufs)))
+	atomic.AddUint64(&m.bytesOut, uint64(n))
+
+	seconds := d.Seconds()
+	m.latencyMutex.Lock()
+	for i, bound := range writeLatencyBuckets {
+		if seconds <= bound {
+			m.latency.counts[i]++
+			break
+		}
+	}
+	m.latency.count++
+	m.latency.sum += seconds
+	m.latencyMutex.Unlock()
+}
+
+func (m *Metrics) queue(n int) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.queuedBytes, int64(n))
+}
+
+// MetricsHandler serves the metrics in the Prometheus text format, mount it
+// on an admin listener such as the one plume.Run starts:
+//
+//	http.Handle("/metrics", network.MetricsHandler(metrics...))
+func MetricsHandler(metrics ...*Metrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		snapshots := make([]MetricsSnapshot, len(metrics))
+		for i, m := range metrics {
+			snapshots[i] = m.Snapshot()
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		writeMetrics(bw, snapshots)
+		bw.Flush()
+	})
+}
+
+func writeMetrics(w *bufio.Writer, snapshots []MetricsSnapshot) {
+	family := func(name, typ, help string, value func(s MetricsSnapshot) string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, s := range snapshots {
+			fmt.Fprintf(w, "%s{server=\"%s\"} %s\n", name, escapeLabel(s.Name), value(s))
+		}
+	}
+	count := func(n uint64) string { return strconv.FormatUint(n, 10) }
+	family("plume_network_connections", "gauge", "Active connections.", func(s MetricsSnapshot) string {
+		return strconv.FormatInt(s.Connections, 10)
+	})
+	family("plume_network_accepts_total", "counter", "Connections accepted or established.", func(s MetricsSnapshot) string {
+		return count(s.Accepts)
+	})
+
+	const closes = "plume_network_closes_total"
+	fmt.Fprintf(w, "# HELP %s Closed connections by cause.\n# TYPE %s counter\n", closes, closes)
+	for _, s := range snapshots {
+		for cause := CloseLocal; cause <= CloseRateLimit; cause++ {
+			fmt.Fprintf(w, "%s{server=\"%s\",cause=\"%s\"} %d\n", closes, escapeLabel(s.Name), cause, s.Closes[cause])
+		}
+	}
+
+	family("plume_network_received_bytes_total", "counter", "Bytes of messages received.", func(s MetricsSnapshot) string {
+		return count(s.BytesIn)
+	})
+	family("plume_network_sent_bytes_total", "counter", "Bytes of messages sent.", func(s MetricsSnapshot) string {
+		return count(s.BytesOut)
+	})
+	family("plume_network_received_messages_total", "counter", "Messages received.", func(s MetricsSnapshot) string {
+		return count(s.MessagesIn)
+	})
+	family("plume_network_sent_messages_total", "counter", "Messages sent.", func(s MetricsSnapshot) string {
+		return count(s.MessagesOut)
+	})
+	family("plume_network_codec_errors_total", "counter", "Connections closed by codec errors.", func(s MetricsSnapshot) string {
+		return count(s.CodecErrors)
+	})
+	family("plume_network_queued_bytes", "gauge", "Bytes of messages pending send.", func(s MetricsSnapshot) string {
+		return strconv.FormatInt(s.QueuedBytes, 10)
+	})
+
+	const latency = "plume_network_write_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Duration of socket writes.\n# TYPE %s histogram\n", latency, latency)
+	for _, s := range snapshots {
+		name := escapeLabel(s.Name)
+		h := s.WriteLatency
+		var cumulative uint64
+		for i, bound := range h.Bounds {
+			cumulative += h.Counts[i]
+			fmt.Fprintf(w, "%s_bucket{server=\"%s\",le=\"%s\"} %d\n", latency, name, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{server=\"%s\",le=\"+Inf\"} %d\n", latency, name, h.Count)
+		fmt.Fprintf(w, "%s_sum{server=\"%s\"} %s\n", latency, name, formatFloat(h.Sum))
+		fmt.Fprintf(w, "%s_count{server=\"%s\"} %d\n", latency, name, h.Count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,124 @@
+package network_test
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iakud/plume/network"
+	"github.com/iakud/plume/network/memnet"
+)
+
+// waitMetrics polls m until ok returns true.
+func waitMetrics(t *testing.T, m *network.Metrics, ok func(s network.MetricsSnapshot) bool) {
+	for i := 0; i < 50; i++ {
+		if ok(m.Snapshot()) {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("metrics %+v", m.Snapshot())
+}
+
+func TestMetrics(t *testing.T) {
+	codec := network.NewVarintCodec(0)
+	metrics := network.NewMetrics("game")
+	server := network.NewTCPServer("localhost:8028", network.WithMetrics(metrics))
+	go server.ListenAndServe(network.AsTCPHandler(sessionServer{}), codec)
+	defer server.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	c := &sessionClient{received: make(chan []byte, 2)}
+	client := network.NewTCPClient("localhost:8028")
+	go client.DialAndServe(network.AsTCPHandler(c), codec)
+	c.wait(t)
+	waitMetrics(t, metrics, func(s network.MetricsSnapshot) bool {
+		return s.Connections == 1 && s.Accepts == 1 && s.MessagesIn == 2 && s.BytesIn == 10 &&
+			s.MessagesOut == 2 && s.BytesOut == 12 && s.WriteLatency.Count > 0 && s.QueuedBytes == 0
+	})
+
+	client.Close()
+	waitMetrics(t, metrics, func(s network.MetricsSnapshot) bool {
+		return s.Connections == 0 && s.Closes[network.ClosePeer] == 1
+	})
+
+	w := httptest.NewRecorder()
+	network.MetricsHandler(metrics).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, line := range []string{
+		`plume_network_connections{server="game"} 0`,
+		`plume_network_closes_total{server="game",cause="peer"} 1`,
+		`plume_network_received_messages_total{server="game"} 2`,
+		`plume_network_sent_bytes_total{server="game"} 12`,
+		`plume_network_write_duration_seconds_bucket{server="game",le="+Inf"} `,
+	} {
+		if !strings.Contains(body, line) {
+			t.Fatalf("metrics missing %q:\n%s", line, body)
+		}
+	}
+}
+
+func TestMetricsHandshake(t *testing.T) {
+	ca := newTestCA(t)
+	metrics := network.NewMetrics("tls")
+	server := network.NewTCPServer("localhost:8037",
+		network.WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{ca.issue(t, "server")}}),
+		network.WithMetrics(metrics),
+	)
+	go server.ListenAndServe(nil, nil)
+	defer server.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	// the failed handshake is accepted and closed
+	conn, err := net.Dial("tcp", "localhost:8037")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	waitMetrics(t, metrics, func(s network.MetricsSnapshot) bool {
+		var closes uint64
+		for _, n := range s.Closes {
+			closes += n
+		}
+		return s.Accepts == 1 && s.Connections == 0 && closes == 1
+	})
+}
+
+func TestMetricsHeartbeat(t *testing.T) {
+	memNetwork := memnet.NewNetwork(memnet.StreamConfig{})
+	codec := network.NewVarintCodec(0)
+	metrics := network.NewMetrics("heartbeat")
+	server := network.NewTCPServer("server",
+		memnetListen(t, memNetwork, "server"),
+		network.WithHeartbeat([]byte("ping"), []byte("pong")),
+		network.WithMetrics(metrics),
+	)
+	go server.ListenAndServe(tagHandler(""), codec)
+	defer server.Close()
+
+	handler := newMemnetHandler()
+	client := network.NewTCPClient("server", network.WithDialFunc(memNetwork.Dial))
+	go client.DialAndServe(handler, codec)
+	defer client.Close()
+	connection := handler.connection(t)
+	connection.Send([]byte("ping"))
+	connection.Send([]byte("hi"))
+	for _, want := range []string{"pong", "hi"} {
+		select {
+		case b := <-handler.receive:
+			if string(b) != want {
+				t.Fatalf("received %q, want %q", b, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %q", want)
+		}
+	}
+	// the ping counts in bytes only
+	if s := metrics.Snapshot(); s.MessagesIn != 1 || s.BytesIn != 6 {
+		t.Fatalf("received %d messages, %d bytes", s.MessagesIn, s.BytesIn)
+	}
+}
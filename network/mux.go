@@ -0,0 +1,549 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"sync"
+)
+
+var (
+	ErrMuxClosed             = errors.New("network: mux connection closed")
+	ErrMuxFrame              = errors.New("network: invalid mux frame")
+	ErrStreamClosed          = errors.New("network: stream closed")
+	ErrStreamMessageTooLarge = errors.New("network: stream message too large")
+	ErrStreamIDsExhausted    = errors.New("network: stream IDs exhausted")
+)
+
+const (
+	muxOpen    byte = 1
+	muxData    byte = 2 // a chunk of a message
+	muxDataEnd byte = 3 // the last chunk of a message
+	muxWindow  byte = 4
+	muxClose   byte = 5
+
+	muxHeaderSize = 5
+
+	// muxRemote is set in the stream IDs of frames sent by the side that did
+	// not open the stream, and in the IDs of streams opened by the peer.
+	muxRemote = 1 << 31
+
+	// muxQueueBytes bounds the data queued on the connection by the mux
+	// writer, so a message waits behind at most that much of other streams.
+	muxQueueBytes = 64 << 10
+)
+
+// MuxConfig configures the streams of NewMuxHandler, both ends must use the
+// same Window.
+type MuxConfig struct {
+	Window    int // receive window of each stream and largest message, default 1MB
+	FrameSize int // largest chunk of a message, default 16KB
+}
+
+func (c MuxConfig) withDefaults() MuxConfig {
+	if c.Window <= 0 {
+		c.Window = 1 << 20
+	}
+	if c.FrameSize <= 0 {
+		c.FrameSize = 16 << 10
+	}
+	return c
+}
+
+// MuxHandler handles the streams of connections served by NewMuxHandler.
+// Stream is called when a stream is opened by the peer and when any stream
+// is closed. The events of a stream are called in order on its own
+// goroutine, or on the connection loop if any, so a slow stream does not
+// hold up the others.
+type MuxHandler interface {
+	Connect(conn *MuxConn, connected bool)
+	Stream(stream *Stream, opened bool)
+	Receive(stream *Stream, b []byte)
+}
+
+// MuxConn carries many streams over a TCPConnection. Messages are sent in
+// chunks taken from the streams in turn, so a large message does not hold
+// up the others, and each stream has its own flow control window.
+type MuxConn struct {
+	conn    *TCPConnection
+	handler MuxHandler
+	config  MuxConfig
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	streams map[uint32]*Stream
+	nextID  uint32
+	ready   []*Stream // streams with a frame to send, in turn
+	closed  bool
+	serving sync.WaitGroup
+
+	Userdata interface{}
+}
+
+func newMuxConn(conn *TCPConnection, handler MuxHandler, config MuxConfig) *MuxConn {
+	muxConn := &MuxConn{
+		conn:    conn,
+		handler: handler,
+		config:  config,
+		streams: make(map[uint32]*Stream),
+	}
+	muxConn.cond = sync.NewCond(&muxConn.mutex)
+	return muxConn
+}
+
+func (c *MuxConn) Conn() *TCPConnection {
+	return c.conn
+}
+
+func packMux(typ byte, id uint32, payload []byte) []byte {
+	b := make([]byte, muxHeaderSize+len(payload))
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:], id)
+	copy(b[muxHeaderSize:], payload)
+	return b
+}
+
+// OpenStream opens a stream, the peer is told before any of its messages.
+// The IDs wrap around, skipping those of the open streams.
+func (c *MuxConn) OpenStream() (*Stream, error) {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil, ErrMuxClosed
+	}
+	id, ok := c.newID()
+	if !ok {
+		c.mutex.Unlock()
+		return nil, ErrStreamIDsExhausted
+	}
+	stream := newStream(c, id)
+	c.streams[stream.id] = stream
+	c.serving.Add(1)
+	c.mutex.Unlock()
+
+	if err := c.conn.Send(packMux(muxOpen, stream.id, nil)); err != nil {
+		c.conn.Close()
+	}
+	go stream.serve(false)
+	return stream, nil
+}
+
+// newID returns an ID not used by an open stream, c.mutex is held.
+func (c *MuxConn) newID() (uint32, bool) {
+	for i := uint32(0); i < muxRemote; i++ {
+		c.nextID = (c.nextID + 1) &^ muxRemote
+		if _, ok := c.streams[c.nextID]; !ok {
+			return c.nextID, true
+		}
+	}
+	return 0, false
+}
+
+// NumStreams returns the number of open streams.
+func (c *MuxConn) NumStreams() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.streams)
+}
+
+// Close closes the connection and every stream.
+func (c *MuxConn) Close() {
+	c.conn.Close()
+}
+
+func (c *MuxConn) GetUserdata() interface{} {
+	return c.Userdata
+}
+
+func (c *MuxConn) SetUserdata(userdata interface{}) {
+	c.Userdata = userdata
+}
+
+// write sends the frames of ready streams, one chunk of each in turn.
+func (c *MuxConn) write() {
+	for {
+		c.mutex.Lock()
+		for !c.closed && len(c.ready) == 0 {
+			c.cond.Wait()
+		}
+		if c.closed {
+			c.mutex.Unlock()
+			return
+		}
+		stream := c.ready[0]
+		c.ready[0] = nil
+		c.ready = c.ready[1:]
+		stream.queued = false
+		frame := stream.nextFrame()
+		stream.schedule()
+		c.mutex.Unlock()
+
+		if frame == nil {
+			continue
+		}
+		if err := c.conn.Send(frame); err != nil {
+			c.conn.Close()
+			return
+		}
+		c.conn.queue.wait(muxQueueBytes)
+	}
+}
+
+func (c *MuxConn) receive(b []byte) error {
+	if len(b) < muxHeaderSize {
+		return ErrMuxFrame
+	}
+	id := binary.BigEndian.Uint32(b[1:]) ^ muxRemote
+	payload := b[muxHeaderSize:]
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return nil
+	}
+	stream, ok := c.streams[id]
+	switch b[0] {
+	case muxOpen:
+		if ok || id&muxRemote == 0 {
+			return ErrMuxFrame
+		}
+		stream = newStream(c, id)
+		c.streams[id] = stream
+		c.serving.Add(1)
+		go stream.serve(true)
+	case muxData, muxDataEnd:
+		if !ok {
+			return nil // closed
+		}
+		return stream.receive(payload, b[0] == muxDataEnd)
+	case muxWindow:
+		if len(payload) != 4 {
+			return ErrMuxFrame
+		}
+		if !ok {
+			return nil
+		}
+		stream.window += int(binary.BigEndian.Uint32(payload))
+		stream.schedule()
+	case muxClose:
+		if !ok {
+			return nil
+		}
+		stream.closeRemote()
+	default:
+		return ErrMuxFrame
+	}
+	return nil
+}
+
+// close closes every stream when the connection is closed.
+func (c *MuxConn) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+	for id, stream := range c.streams {
+		stream.finish(ErrMuxClosed)
+		delete(c.streams, id)
+	}
+	c.ready = nil
+	c.cond.Broadcast()
+}
+
+// Stream is a logical connection of a MuxConn, messages are delivered in
+// order.
+type Stream struct {
+	id   uint32
+	conn *MuxConn
+	cond *sync.Cond
+
+	// send side
+	pending [][]byte
+	offset  int // sent bytes of pending[0]
+	window  int // bytes the peer can receive
+	closing bool
+	queued  bool
+	removed bool
+
+	// receive side
+	partial    []byte
+	used       int // bytes received and not yet delivered
+	consumed   int // bytes delivered and not yet returned to the peer window
+	inbox      [][]byte
+	peerClosed bool
+	err        error
+
+	Userdata interface{}
+}
+
+func newStream(conn *MuxConn, id uint32) *Stream {
+	return &Stream{
+		id:     id,
+		conn:   conn,
+		cond:   sync.NewCond(&conn.mutex),
+		window: conn.config.Window,
+	}
+}
+
+// ID returns the stream ID, unique within the connection.
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+func (s *Stream) Conn() *MuxConn {
+	return s.conn
+}
+
+// Send queues b to be sent in chunks as the peer window allows, it must not
+// be modified after. b may not be larger than MuxConfig.Window.
+func (s *Stream) Send(b []byte) error {
+	c := s.conn
+	if len(b) > c.config.Window {
+		return ErrStreamMessageTooLarge
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return ErrMuxClosed
+	}
+	if s.closing || s.removed || s.err != nil {
+		return ErrStreamClosed
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	s.pending = append(s.pending, b)
+	s.schedule()
+	return nil
+}
+
+// Close stops receiving and closes the stream once the pending messages are
+// sent. Messages the peer sends after are discarded.
+func (s *Stream) Close() {
+	c := s.conn
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if s.closing || s.err != nil {
+		return
+	}
+	s.closing = true
+	s.err = ErrStreamClosed
+	s.cond.Signal()
+	s.schedule()
+}
+
+// Err returns why the stream was closed: ErrStreamClosed when closed
+// locally, io.EOF when closed by the peer and ErrMuxClosed when the
+// connection was closed.
+func (s *Stream) Err() error {
+	s.conn.mutex.Lock()
+	defer s.conn.mutex.Unlock()
+	return s.err
+}
+
+func (s *Stream) GetUserdata() interface{} {
+	return s.Userdata
+}
+
+func (s *Stream) SetUserdata(userdata interface{}) {
+	s.Userdata = userdata
+}
+
+// schedule queues the stream on the writer when it has a frame to send.
+func (s *Stream) schedule() {
+	if s.queued || s.removed {
+		return
+	}
+	if len(s.pending) > 0 && s.window <= 0 {
+		return
+	}
+	if len(s.pending) == 0 && !s.closing {
+		return
+	}
+	s.queued = true
+	s.conn.ready = append(s.conn.ready, s)
+	s.conn.cond.Signal()
+}
+
+// nextFrame returns the next chunk of the pending messages, then the close
+// frame once they are sent.
+func (s *Stream) nextFrame() []byte {
+	if s.removed {
+		return nil
+	}
+	if len(s.pending) == 0 {
+		if !s.closing {
+			return nil
+		}
+		s.remove()
+		return packMux(muxClose, s.id, nil)
+	}
+	if s.window <= 0 {
+		return nil
+	}
+	b := s.pending[0][s.offset:]
+	n := len(b)
+	if n > s.conn.config.FrameSize {
+		n = s.conn.config.FrameSize
+	}
+	if n > s.window {
+		n = s.window
+	}
+	s.window -= n
+	if n < len(b) {
+		s.offset += n
+		return packMux(muxData, s.id, b[:n])
+	}
+	s.pending[0] = nil
+	s.pending = s.pending[1:]
+	s.offset = 0
+	return packMux(muxDataEnd, s.id, b)
+}
+
+func (s *Stream) remove() {
+	s.removed = true
+	s.pending = nil
+	if s.conn.streams[s.id] == s {
+		delete(s.conn.streams, s.id)
+	}
+}
+
+func (s *Stream) receive(b []byte, end bool) error {
+	s.used += len(b)
+	if s.used > s.conn.config.Window {
+		return ErrMuxFrame
+	}
+	if s.err != nil {
+		s.used -= len(b) // closed, discard
+		return nil
+	}
+	s.partial = append(s.partial, b...)
+	if end {
+		s.inbox = append(s.inbox, s.partial)
+		s.partial = nil
+		s.cond.Signal()
+	}
+	return nil
+}
+
+// closeRemote closes the stream when the peer closed it, the messages
+// received are still delivered.
+func (s *Stream) closeRemote() {
+	s.peerClosed = true
+	s.remove()
+	s.cond.Signal()
+}
+
+func (s *Stream) finish(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+	s.remove()
+	s.cond.Signal()
+}
+
+// serve delivers the stream events, until the stream is closed.
+func (s *Stream) serve(remote bool) {
+	c := s.conn
+	defer c.serving.Done()
+	if remote {
+		c.conn.runInLoopWait(func() { c.handler.Stream(s, true) })
+	}
+	for {
+		c.mutex.Lock()
+		for s.err == nil && len(s.inbox) == 0 && !s.peerClosed {
+			s.cond.Wait()
+		}
+		if s.err == nil && len(s.inbox) == 0 {
+			s.err = io.EOF
+		}
+		if s.err != nil {
+			s.inbox = nil
+			c.mutex.Unlock()
+			break
+		}
+		b := s.inbox[0]
+		s.inbox[0] = nil
+		s.inbox = s.inbox[1:]
+		c.mutex.Unlock()
+
+		c.conn.runInLoopWait(func() { c.handler.Receive(s, b) })
+		s.consume(len(b))
+	}
+	c.conn.runInLoopWait(func() { c.handler.Stream(s, false) })
+}
+
+// consume returns n delivered bytes to the peer window, in batches of a
+// quarter window.
+func (s *Stream) consume(n int) {
+	c := s.conn
+	c.mutex.Lock()
+	s.used -= n
+	s.consumed += n
+	if s.consumed < c.config.Window/4 || s.removed {
+		c.mutex.Unlock()
+		return
+	}
+	var increment [4]byte
+	binary.BigEndian.PutUint32(increment[:], uint32(s.consumed))
+	s.consumed = 0
+	c.mutex.Unlock()
+	c.conn.Send(packMux(muxWindow, s.id, increment[:]))
+}
+
+type muxTCPHandler struct {
+	handler MuxHandler
+	config  MuxConfig
+
+	mutex sync.RWMutex
+	conns map[*TCPConnection]*MuxConn
+}
+
+// NewMuxHandler returns a TCPHandler serving handler with streams
+// multiplexed over each connection. Use it with TCPServer and TCPClient
+// alike, with a codec that preserves message boundaries.
+func NewMuxHandler(handler MuxHandler, config MuxConfig) TCPHandler {
+	h := &muxTCPHandler{
+		handler: handler,
+		config:  config.withDefaults(),
+		conns:   make(map[*TCPConnection]*MuxConn),
+	}
+	return h
+}
+
+func (h *muxTCPHandler) Connect(conn *TCPConnection, connected bool) {
+	if connected {
+		muxConn := newMuxConn(conn, h.handler, h.config)
+		h.mutex.Lock()
+		h.conns[conn] = muxConn
+		h.mutex.Unlock()
+		go muxConn.write()
+		h.handler.Connect(muxConn, true)
+		return
+	}
+	h.mutex.Lock()
+	muxConn := h.conns[conn]
+	delete(h.conns, conn)
+	h.mutex.Unlock()
+	muxConn.close()
+	if conn.Loop() == nil {
+		muxConn.serving.Wait()
+		h.handler.Connect(muxConn, false)
+		return
+	}
+	// the stream events are posted to the loop we are running on
+	go func() {
+		muxConn.serving.Wait()
+		conn.runInLoop(func() { h.handler.Connect(muxConn, false) })
+	}()
+}
+
+func (h *muxTCPHandler) Receive(conn *TCPConnection, buf []byte) {
+	h.mutex.RLock()
+	muxConn := h.conns[conn]
+	h.mutex.RUnlock()
+	if err := muxConn.receive(buf); err != nil {
+		log.Printf("network: mux %v: %v", conn.RemoteAddr(), err)
+		conn.Close()
+	}
+}
@@ -0,0 +1,135 @@
+package network_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/iakud/plume/network"
+)
+
+// muxServer echoes every stream, except that stream messages starting with
+// "block" hold up their stream until unblock is closed.
+type muxServer struct {
+	unblock chan struct{}
+	closed  chan error
+}
+
+func (s *muxServer) Connect(*network.MuxConn, bool) {}
+
+func (s *muxServer) Stream(stream *network.Stream, opened bool) {
+	if !opened {
+		s.closed <- stream.Err()
+	}
+}
+
+func (s *muxServer) Receive(stream *network.Stream, b []byte) {
+	if bytes.HasPrefix(b, []byte("block")) {
+		<-s.unblock
+		return
+	}
+	stream.Send(b)
+}
+
+type muxClient struct {
+	conns    chan *network.MuxConn
+	received chan []byte
+}
+
+func (c *muxClient) Connect(conn *network.MuxConn, connected bool) {
+	if connected {
+		c.conns <- conn
+	}
+}
+
+func (c *muxClient) Stream(*network.Stream, bool) {}
+
+func (c *muxClient) Receive(stream *network.Stream, b []byte) {
+	c.received <- append([]byte{byte(stream.ID() >> 24), byte(stream.ID() >> 16), byte(stream.ID() >> 8), byte(stream.ID())}, b...)
+}
+
+func TestMux(t *testing.T) {
+	config := network.MuxConfig{Window: 64 << 10, FrameSize: 1024}
+	codec := network.NewVarintCodec(0)
+	s := &muxServer{unblock: make(chan struct{}), closed: make(chan error, 4)}
+	defer close(s.unblock)
+	server := network.NewTCPServer("localhost:8022")
+	go server.ListenAndServe(network.NewMuxHandler(s, config), codec)
+	defer server.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	c := &muxClient{conns: make(chan *network.MuxConn, 1), received: make(chan []byte, 64)}
+	client := network.NewTCPClient("localhost:8022")
+	go client.DialAndServe(network.NewMuxHandler(c, config), codec)
+	defer client.Close()
+	var conn *network.MuxConn
+	select {
+	case conn = <-c.conns:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	// a blocked stream with its window full does not hold up the others
+	blocked, _ := conn.OpenStream()
+	for i := 0; i < 4; i++ {
+		b := make([]byte, 60<<10)
+		copy(b, "block")
+		if err := blocked.Send(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := blocked.Send(make([]byte, 64<<10+1)); err != network.ErrStreamMessageTooLarge {
+		t.Fatalf("send error %v", err)
+	}
+
+	streams := make([]*network.Stream, 3)
+	for i := range streams {
+		streams[i], _ = conn.OpenStream()
+	}
+	for n := 0; n < 10; n++ {
+		for i, stream := range streams {
+			b := bytes.Repeat([]byte{byte(i)}, 100+n*1000)
+			b[0] = byte(n)
+			stream.Send(b)
+		}
+	}
+	next := make(map[uint32]int)
+	for i := 0; i < 10*len(streams); i++ {
+		select {
+		case b := <-c.received:
+			id := binary.BigEndian.Uint32(b)
+			n := next[id]
+			next[id]++
+			if b[4] != byte(n) || len(b) != 4+100+n*1000 {
+				t.Fatalf("stream %d received message %d of %d bytes, want %d", id, b[4], len(b)-4, n)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout")
+		}
+	}
+
+	// streams close independently
+	streams[0].Close()
+	if err := streams[0].Send([]byte("hello")); err != network.ErrStreamClosed {
+		t.Fatalf("send error %v", err)
+	}
+	select {
+	case err := <-s.closed:
+		if err != io.EOF {
+			t.Fatalf("stream closed with %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+	streams[1].Send([]byte("hello"))
+	select {
+	case b := <-c.received:
+		if string(b[4:]) != "hello" {
+			t.Fatalf("received %q", b[4:])
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
@@ -0,0 +1,278 @@
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/iakud/plume/eventloop"
+)
+
+// options are shared by servers and clients, each one ignores the options
+// that do not apply to it.
+type options struct {
+	tlsConfig        *tls.Config
+	readIdleTimeout  time.Duration
+	writeIdleTimeout time.Duration
+	heartbeat        *heartbeat
+	backpressure     Backpressure
+	loops            *loopBalancer
+	pingInterval     time.Duration
+	maxMessageSize   int
+	compression      bool
+	checkOrigin      func(r *http.Request) bool
+	subprotocols     []string
+	arq              *ARQConfig
+	proxy            *proxyProtocol
+	admission        *Admission
+	metrics          *Metrics
+	backoff          Backoff
+	dialTimeout      time.Duration
+	retryCallback    func(attempt int, delay time.Duration, err error)
+	listen           func(addr string) (net.Listener, error)
+	dial             func(ctx context.Context, addr string) (net.Conn, error)
+	recorder         *Recorder
+	replaySpeed      float64
+	reusePort        int
+	handover         string
+}
+
+type Option func(*options)
+
+// TLS config, servers require Certificates or GetCertificate to be set.
+// Set ClientAuth for mutual TLS.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(opts *options) {
+		opts.tlsConfig = config
+	}
+}
+
+// Read idle timeout, connections are closed with ErrReadIdleTimeout when no
+// data arrives within it.
+func WithReadIdleTimeout(timeout time.Duration) Option {
+	return func(opts *options) {
+		opts.readIdleTimeout = timeout
+	}
+}
+
+// Write idle timeout, writes blocked longer than it fail with
+// ErrWriteIdleTimeout. With WithHeartbeat the ping is sent when nothing has
+// been written within it, without heartbeat quiet connections are kept.
+func WithWriteIdleTimeout(timeout time.Duration) Option {
+	return func(opts *options) {
+		opts.writeIdleTimeout = timeout
+	}
+}
+
+// Heartbeat frames, ping is sent through the codec when the connection is
+// write idle and pong, if any, is sent back on receiving ping. Heartbeat
+// frames are not delivered to the handler, so ping and pong must not equal
+// any application message.
+func WithHeartbeat(ping, pong []byte) Option {
+	return func(opts *options) {
+		if len(ping) == 0 {
+			panic("network: heartbeat ping may not be empty.")
+		}
+		opts.heartbeat = &heartbeat{ping: ping, pong: pong}
+	}
+}
+
+// Backpressure of every connection, see TCPConnection.SetBackpressure.
+func WithBackpressure(backpressure Backpressure) Option {
+	return func(opts *options) {
+		opts.backpressure = backpressure
+	}
+}
+
+// Event loop pool, each connection is bound to a loop of the pool taken
+// round-robin and its Connect and Receive are called on that loop in order.
+// The pool must outlive the server or client.
+func WithEventLoopPool(pool *eventloop.Pool) Option {
+	return func(opts *options) {
+		opts.loops = &loopBalancer{pool: pool}
+	}
+}
+
+// Like WithEventLoopPool, the loop is chosen by hashing the remote address so
+// connections from the same peer share a loop.
+func WithEventLoopHash(pool *eventloop.Pool, hash func(addr net.Addr) int) Option {
+	return func(opts *options) {
+		opts.loops = &loopBalancer{pool: pool, hash: hash}
+	}
+}
+
+// WebSocket ping interval, a ping frame is sent when nothing has been written
+// within it. Pings and pongs received extend the read idle timeout.
+func WithPingInterval(interval time.Duration) Option {
+	return func(opts *options) {
+		opts.pingInterval = interval
+	}
+}
+
+// Maximum size of a received WebSocket message, larger messages close the
+// connection with status 1009. Zero means websocket.DefaultMaxMessageSize.
+func WithMaxMessageSize(size int) Option {
+	return func(opts *options) {
+		opts.maxMessageSize = size
+	}
+}
+
+// WebSocket permessage-deflate, offered by clients and accepted by servers.
+func WithCompression() Option {
+	return func(opts *options) {
+		opts.compression = true
+	}
+}
+
+// Origins accepted by WebSocket servers, each one a full origin such as
+// "https://example.com" compared case insensitively. By default requests
+// without a valid Origin header are rejected and others are accepted.
+func WithOrigins(origins ...string) Option {
+	return WithCheckOrigin(func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		for _, o := range origins {
+			if strings.EqualFold(o, origin) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Origin check of WebSocket servers, requests it returns false for are
+// rejected with 403 Forbidden. It replaces WithOrigins.
+func WithCheckOrigin(checkOrigin func(r *http.Request) bool) Option {
+	return func(opts *options) {
+		opts.checkOrigin = checkOrigin
+	}
+}
+
+// WebSocket subprotocols, servers select the first one of theirs the client
+// requested and clients request them in order. See
+// WSConnection.Subprotocol.
+func WithSubprotocols(subprotocols ...string) Option {
+	return func(opts *options) {
+		opts.subprotocols = subprotocols
+	}
+}
+
+// PROXY protocol v1 and v2 on TCPServer, connections from trusted sources
+// must start with a header within timeout, default 5s, and RemoteAddr returns
+// the client address it carries. Trusted sources are IPs or CIDRs such as
+// "10.0.0.0/8", at least one is required. Headers from other sources are not
+// parsed.
+func WithProxyProtocol(trusted []string, timeout time.Duration) Option {
+	proxy := newProxyProtocol(trusted, timeout)
+	return func(opts *options) {
+		opts.proxy = proxy
+	}
+}
+
+// Admission control of TCPServer and WSServer, connections it rejects are
+// closed before the connect event and messages over the rate limit close the
+// connection with CloseRateLimit.
+func WithAdmission(admission *Admission) Option {
+	return func(opts *options) {
+		opts.admission = admission
+	}
+}
+
+// Metrics of the connections of a TCPServer, TCPClient, WSServer or
+// WSClient. A Metrics may be shared to count them together.
+func WithMetrics(metrics *Metrics) Option {
+	return func(opts *options) {
+		opts.metrics = metrics
+	}
+}
+
+// Backoff of TCPClient and WSClient dial retries, it enables retry. The
+// default is ExponentialBackoff{}. UDPClient waits it between sessions.
+func WithBackoff(backoff Backoff) Option {
+	return func(opts *options) {
+		opts.backoff = backoff
+	}
+}
+
+// Dial timeout of TCPClient and WSClient, for WSClient it includes the
+// handshake.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(opts *options) {
+		opts.dialTimeout = timeout
+	}
+}
+
+// Retry callback of TCPClient and WSClient, called after each failed dial
+// with the attempt counted from 1 and the delay before the next one.
+func WithRetryCallback(callback func(attempt int, delay time.Duration, err error)) Option {
+	return func(opts *options) {
+		opts.retryCallback = callback
+	}
+}
+
+// Listen function of TCPServer instead of net.Listen, such as
+// memnet.Network.Listen in tests.
+func WithListenFunc(listen func(addr string) (net.Listener, error)) Option {
+	return func(opts *options) {
+		opts.listen = listen
+	}
+}
+
+// Dial function of TCPClient and WSClient instead of net.Dialer, such as
+// memnet.Network.Dial in tests. The dial timeout bounds ctx.
+func WithDialFunc(dial func(ctx context.Context, addr string) (net.Conn, error)) Option {
+	return func(opts *options) {
+		opts.dial = dial
+	}
+}
+
+// Recorder of the messages of TCPServer and TCPClient connections, see
+// Replay.
+func WithRecorder(recorder *Recorder) Option {
+	return func(opts *options) {
+		opts.recorder = recorder
+	}
+}
+
+// Replay speed, 1 keeps the recorded timing, 10 is ten times faster and zero
+// or less sends the messages without waiting. The default is 1.
+func WithReplaySpeed(speed float64) Option {
+	return func(opts *options) {
+		if speed <= 0 {
+			speed = -1
+		}
+		opts.replaySpeed = speed
+	}
+}
+
+// SO_REUSEPORT listeners of TCPServer, each one accepts in its own
+// goroutine. Other processes may listen on the same address with it.
+func WithReusePort(listeners int) Option {
+	return func(opts *options) {
+		opts.reusePort = listeners
+	}
+}
+
+// Listener handover of TCPServer over the Unix socket path, for restarts
+// without closing the port. ListenAndServe takes over the listeners of the
+// server on path, if any, then serves path for the next one. The previous
+// ListenAndServe returns ErrServerHandedOver, its connections are still
+// served until Shutdown.
+func WithHandover(path string) Option {
+	return func(opts *options) {
+		opts.handover = path
+	}
+}
+
+// Reliable ordered UDP, messages are split into segments that are acked and
+// resent, see ARQConfig. Both ends must use it.
+func WithARQ(config ARQConfig) Option {
+	return func(opts *options) {
+		if config.MTU > 0 && config.MTU <= arqHeaderSize {
+			panic("network: ARQ MTU must be larger than the segment header.")
+		}
+		opts.arq = &config
+	}
+}
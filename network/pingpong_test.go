@@ -1,12 +1,15 @@
 package network_test
 
 import (
+	"encoding/binary"
 	"log/slog"
+	"net"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/iakud/plume/network"
+	"github.com/iakud/plume/network/memnet"
 )
 
 const (
@@ -20,9 +23,9 @@ type pingpongServer struct {
 	server *network.TCPServer
 }
 
-func newPingpongServer(addr string) *pingpongServer {
+func newPingpongServer(addr string, opt ...network.Option) *pingpongServer {
 	srv := &pingpongServer{
-		server: network.NewTCPServer(addr),
+		server: network.NewTCPServer(addr, opt...),
 	}
 	return srv
 }
@@ -61,7 +64,7 @@ type pingpongClient struct {
 	done         chan struct{}
 }
 
-func newPingpongClient(addr string) *pingpongClient {
+func newPingpongClient(addr string, opt ...network.Option) *pingpongClient {
 	// build message
 	message := make([]byte, kBlockSize)
 	for i := 0; i < kBlockSize; i++ {
@@ -73,7 +76,7 @@ func newPingpongClient(addr string) *pingpongClient {
 	}
 	clients := make([]*network.TCPClient, kClientCount)
 	for i := 0; i < kClientCount; i++ {
-		client := network.NewTCPClient(addr)
+		client := network.NewTCPClient(addr, opt...)
 		go c.serveClient(client)
 		clients[i] = client
 	}
@@ -132,9 +135,124 @@ func (c *pingpongClient) Done() {
 }
 
 func TestPingpong(t *testing.T) {
-	srv := newPingpongServer("localhost:8000")
+	memNetwork := memnet.NewNetwork(memnet.StreamConfig{})
+	srv := newPingpongServer("pingpong:8000", memnetListen(t, memNetwork, "pingpong:8000"))
 	go srv.ListenAndServe()
 	defer srv.Close()
-	c := newPingpongClient("localhost:8000")
+	c := newPingpongClient("pingpong:8000", network.WithDialFunc(memNetwork.Dial))
 	c.Done()
 }
+
+const kPipeline = 16
+
+// bufferedCodec hides AppendHeader, the writer copies frames through bufio.
+type bufferedCodec struct {
+	network.Codec
+}
+
+type pingpongBenchServer struct {
+	pooled bool
+}
+
+func (srv *pingpongBenchServer) Connect(connection *network.TCPConnection, connected bool) {
+	if connected {
+		connection.SetNoDelay(true)
+	}
+}
+
+func (srv *pingpongBenchServer) Receive(connection *network.TCPConnection, b []byte) {
+	if !srv.pooled {
+		connection.Send(b)
+		return
+	}
+	buffer := network.GetBuffer(len(b))
+	copy(buffer.B, b)
+	connection.SendBuffer(buffer)
+}
+
+type pingpongBenchClient struct {
+	client  *network.TCPClient
+	message []byte
+	pooled  bool
+	n       int
+	count   int
+}
+
+func (c *pingpongBenchClient) send(connection *network.TCPConnection) {
+	if !c.pooled {
+		connection.Send(c.message)
+		return
+	}
+	buffer := network.GetBuffer(len(c.message))
+	copy(buffer.B, c.message)
+	connection.SendBuffer(buffer)
+}
+
+func (c *pingpongBenchClient) Connect(connection *network.TCPConnection, connected bool) {
+	if !connected {
+		return
+	}
+	connection.SetNoDelay(true)
+	for i := 0; i < kPipeline; i++ {
+		c.send(connection)
+	}
+}
+
+func (c *pingpongBenchClient) Receive(connection *network.TCPConnection, b []byte) {
+	c.count++
+	if c.count == c.n {
+		c.client.Close()
+		return
+	}
+	if c.count <= c.n-kPipeline {
+		c.send(connection)
+	}
+}
+
+// benchmarkPingpong runs over loopback TCP, the vectored writes need a
+// *net.TCPConn.
+func benchmarkPingpong(b *testing.B, codec network.Codec, size int, pooled bool) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	listen := func(string) (net.Listener, error) { return ln, nil }
+	server := network.NewTCPServer("", network.WithListenFunc(listen))
+	go server.ListenAndServe(&pingpongBenchServer{pooled: pooled}, codec)
+	defer server.Close()
+
+	c := &pingpongBenchClient{
+		client:  network.NewTCPClient(ln.Addr().String()),
+		message: make([]byte, size),
+		pooled:  pooled,
+		n:       b.N + kPipeline,
+	}
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	if err := c.client.DialAndServe(c, codec); err != network.ErrClientClosed {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkPingpongBuffered(b *testing.B) {
+	codec := &bufferedCodec{network.NewLengthCodec(4, binary.BigEndian, 0)}
+	benchmarkPingpong(b, codec, kBlockSize, false)
+}
+
+func BenchmarkPingpongVectored(b *testing.B) {
+	benchmarkPingpong(b, network.NewLengthCodec(4, binary.BigEndian, 0), kBlockSize, false)
+}
+
+func BenchmarkPingpongVectoredPooled(b *testing.B) {
+	benchmarkPingpong(b, network.NewLengthCodec(4, binary.BigEndian, 0), kBlockSize, true)
+}
+
+func BenchmarkPingpongBufferedSmall(b *testing.B) {
+	codec := &bufferedCodec{network.NewLengthCodec(4, binary.BigEndian, 0)}
+	benchmarkPingpong(b, codec, 64, false)
+}
+
+func BenchmarkPingpongVectoredSmall(b *testing.B) {
+	benchmarkPingpong(b, network.NewLengthCodec(4, binary.BigEndian, 0), 64, false)
+}
@@ -0,0 +1,223 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrProxyHeader = errors.New("network: invalid PROXY protocol header")
+)
+
+const (
+	proxyV1MaxLength  = 107
+	proxyV2HeaderSize = 16
+
+	// defaultProxyTimeout bounds the header read without a timeout.
+	defaultProxyTimeout = 5 * time.Second
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocol reads the PROXY protocol header of connections from trusted
+// sources, see WithProxyProtocol.
+type proxyProtocol struct {
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+func newProxyProtocol(trusted []string, timeout time.Duration) *proxyProtocol {
+	if len(trusted) == 0 {
+		panic("network: PROXY protocol without trusted sources")
+	}
+	if timeout <= 0 {
+		timeout = defaultProxyTimeout
+	}
+	p := &proxyProtocol{timeout: timeout}
+	for _, s := range trusted {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			panic("network: invalid PROXY protocol trusted source " + strconv.Quote(s))
+		}
+		p.trusted = append(p.trusted, ipNet)
+	}
+	return p
+}
+
+func (p *proxyProtocol) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range p.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// accept reads the header of conn from a trusted source, the returned conn
+// reports the addresses of the header.
+func (p *proxyProtocol) accept(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(p.timeout))
+	r := bufio.NewReader(conn)
+	src, dst, err := readProxyHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	proxyConn := &proxyConn{Conn: conn, r: r, remoteAddr: conn.RemoteAddr(), localAddr: conn.LocalAddr()}
+	if src != nil {
+		proxyConn.remoteAddr, proxyConn.localAddr = src, dst
+	}
+	return proxyConn, nil
+}
+
+// readProxyHeader reads a v1 or v2 header, the addresses are nil when the
+// header does not carry TCP addresses.
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch b[0] {
+	case 'P':
+		return readProxyV1(r)
+	case proxyV2Signature[0]:
+		return readProxyV2(r)
+	}
+	return nil, nil, ErrProxyHeader
+}
+
+func readProxyV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, ErrProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, nil, ErrProxyHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, nil, ErrProxyHeader
+	}
+	if len(fields) != 6 {
+		return nil, nil, ErrProxyHeader
+	}
+	srcAddr, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dstAddr, err := parseProxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return srcAddr, dstAddr, nil
+}
+
+func parseProxyV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, ErrProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var header [proxyV2HeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, nil, ErrProxyHeader
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	switch header[12] & 0x0f {
+	case 0: // LOCAL, health checks of the proxy itself
+		return nil, nil, nil
+	case 1: // PROXY
+	default:
+		return nil, nil, ErrProxyHeader
+	}
+	var size int
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		size = net.IPv4len
+	case 0x21: // TCP over IPv6
+		size = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(payload) < 2*size+4 {
+		return nil, nil, ErrProxyHeader
+	}
+	srcAddr := &net.TCPAddr{
+		IP:   net.IP(payload[:size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size:])),
+	}
+	dstAddr := &net.TCPAddr{
+		IP:   net.IP(payload[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size+2:])),
+	}
+	return srcAddr, dstAddr, nil
+}
+
+// proxyConn reports the addresses of the PROXY protocol header, reads go
+// through the reader the header was read with.
+type proxyConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
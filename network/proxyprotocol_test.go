@@ -0,0 +1,193 @@
+package network_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/iakud/plume/network"
+)
+
+type addrHandler struct {
+	addrs chan net.Addr
+}
+
+func (h *addrHandler) Connect(conn *network.TCPConnection, connected bool) {
+	if connected {
+		h.addrs <- conn.RemoteAddr()
+	}
+}
+
+func (h *addrHandler) Receive(*network.TCPConnection, []byte) {}
+
+func proxyV2Header(src, dst *net.TCPAddr) []byte {
+	b := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	b = append(b, 0x21, 0x11, 0, 12)
+	b = append(b, src.IP.To4()...)
+	b = append(b, dst.IP.To4()...)
+	var ports [4]byte
+	binary.BigEndian.PutUint16(ports[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(ports[2:], uint16(dst.Port))
+	return append(b, ports[:]...)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	h := &addrHandler{addrs: make(chan net.Addr, 1)}
+	server := network.NewTCPServer("localhost:8023", network.WithProxyProtocol([]string{"127.0.0.0/8", "::1"}, time.Millisecond*200))
+	go server.ListenAndServe(h, nil)
+	defer server.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	src := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 51000}
+	dst := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 8023}
+	for _, header := range [][]byte{
+		[]byte("PROXY TCP4 203.0.113.7 192.0.2.1 51000 8023\r\n"),
+		proxyV2Header(src, dst),
+	} {
+		conn, err := net.Dial("tcp", "localhost:8023")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write(header)
+		select {
+		case addr := <-h.addrs:
+			if addr.String() != src.String() {
+				t.Fatalf("remote address %v, want %v", addr, src)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout")
+		}
+	}
+
+	// no header within the timeout
+	conn, err := net.Dial("tcp", "localhost:8023")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection not closed")
+	}
+	select {
+	case addr := <-h.addrs:
+		t.Fatalf("connected from %v", addr)
+	default:
+	}
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	h := &addrHandler{addrs: make(chan net.Addr, 1)}
+	server := network.NewTCPServer("localhost:8024", network.WithProxyProtocol([]string{"10.0.0.0/8"}, time.Second))
+	go server.ListenAndServe(h, nil)
+	defer server.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	conn, err := net.Dial("tcp", "localhost:8024")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 51000 8024\r\n"))
+	select {
+	case addr := <-h.addrs:
+		if addr.String() != conn.LocalAddr().String() {
+			t.Fatalf("remote address %v, want %v", addr, conn.LocalAddr())
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestProxyProtocolShutdown(t *testing.T) {
+	h := &addrHandler{addrs: make(chan net.Addr, 1)}
+	admission := network.NewAdmission(network.AdmissionConfig{MaxConnections: 1})
+	server := network.NewTCPServer("localhost:8035",
+		network.WithProxyProtocol([]string{"127.0.0.0/8", "::1"}, time.Minute),
+		network.WithAdmission(admission),
+	)
+	go server.ListenAndServe(h, nil)
+	time.Sleep(time.Millisecond * 100)
+
+	// the connection waiting for its header counts against MaxConnections
+	conn, err := net.Dial("tcp", "localhost:8035")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rejected, err := net.Dial("tcp", "localhost:8035")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejected.Close()
+	rejected.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := rejected.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection over MaxConnections not closed")
+	}
+
+	// Shutdown closes the connection waiting for its header
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if _, _, err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection not closed")
+	}
+	if stats := admission.Stats(); stats.Connections != 0 {
+		t.Fatalf("%d admitted connections after shutdown", stats.Connections)
+	}
+}
+
+func TestProxyProtocolTrusted(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("no panic without trusted sources")
+		}
+	}()
+	network.WithProxyProtocol(nil, time.Second)
+}
+
+// headerCountCodec counts the frames written with writev.
+type headerCountCodec struct {
+	*network.VarintCodec
+	headers int32
+}
+
+func (c *headerCountCodec) AppendHeader(dst []byte, b []byte) ([]byte, error) {
+	atomic.AddInt32(&c.headers, 1)
+	return c.VarintCodec.AppendHeader(dst, b)
+}
+
+func TestProxyProtocolVectored(t *testing.T) {
+	codec := &headerCountCodec{VarintCodec: network.NewVarintCodec(0)}
+	server := network.NewTCPServer("localhost:8036", network.WithProxyProtocol([]string{"127.0.0.0/8", "::1"}, time.Second))
+	go server.ListenAndServe(tagHandler(""), codec)
+	defer server.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	conn, err := net.Dial("tcp", "localhost:8036")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 51000 8036\r\n"))
+	conn.Write([]byte{2, 'h', 'i'})
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	b := make([]byte, 3)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "\x02hi" {
+		t.Fatalf("received %q", b)
+	}
+	if atomic.LoadInt32(&codec.headers) == 0 {
+		t.Fatal("PROXY protocol connection not written with writev")
+	}
+}
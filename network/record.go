@@ -0,0 +1,286 @@
+package network
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRecordFormat = errors.New("network: invalid recording")
+)
+
+// recordMagic starts a recording, followed by the version and the start time
+// in unix nanoseconds.
+const (
+	recordMagic   = "PLRC"
+	recordVersion = 1
+
+	// maxRecordSize bounds the data of a record read.
+	maxRecordSize = 64 << 20
+	// recordFlushInterval bounds how long records stay buffered.
+	recordFlushInterval = time.Second
+)
+
+// RecordType is the type of a Record.
+type RecordType uint8
+
+const (
+	RecordOpen     RecordType = iota + 1 // a connection was opened, Addr is the remote address
+	RecordInbound                        // Data was read by the codec
+	RecordOutbound                       // Data was written by the codec
+	RecordClose                          // the connection was closed
+)
+
+// Record is an event of a recorded connection. Each record is encoded as the
+// type, the session, the microseconds since the previous record and, for
+// open and frame records, the length prefixed address or data.
+type Record struct {
+	Type    RecordType
+	Session uint64
+	Time    time.Duration // since the recording started
+	Addr    string
+	Data    []byte
+}
+
+// Recorder records the messages of TCP connections, see WithRecorder. Records
+// are buffered and flushed within a second, when a connection is closed, by
+// Flush and Close, so a crash loses at most the last second.
+type Recorder struct {
+	mutex      sync.Mutex
+	w          io.Writer
+	bw         *bufio.Writer
+	start      time.Time
+	last       time.Duration
+	session    uint64
+	scratch    []byte
+	flushTimer *time.Timer
+	closed     bool
+	err        error
+}
+
+// NewRecorder writes the header of a recording to w.
+func NewRecorder(w io.Writer) (*Recorder, error) {
+	r := &Recorder{
+		w:     w,
+		bw:    bufio.NewWriter(w),
+		start: time.Now(),
+	}
+	header := make([]byte, len(recordMagic)+1+8)
+	copy(header, recordMagic)
+	header[len(recordMagic)] = recordVersion
+	binary.BigEndian.PutUint64(header[len(recordMagic)+1:], uint64(r.start.UnixNano()))
+	if _, err := r.bw.Write(header); err != nil {
+		return nil, err
+	}
+	if err := r.bw.Flush(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Flush writes the buffered records, it returns the first write error.
+func (r *Recorder) Flush() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.closed && r.err == nil {
+		r.err = r.bw.Flush()
+	}
+	return r.err
+}
+
+// Close flushes the recording and closes the writer if it is an io.Closer.
+// Connections recorded after Close are not written.
+func (r *Recorder) Close() error {
+	err := r.Flush()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return err
+	}
+	r.closed = true
+	if r.flushTimer != nil {
+		r.flushTimer.Stop()
+		r.flushTimer = nil
+	}
+	if closer, ok := r.w.(io.Closer); ok {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (r *Recorder) write(t RecordType, session uint64, data []byte, flush bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed || r.err != nil {
+		return
+	}
+	now := time.Since(r.start)
+	delta := now - r.last
+	if delta < 0 {
+		delta = 0
+	}
+	r.last = now
+	b := append(r.scratch[:0], byte(t))
+	b = appendUvarint(b, session)
+	b = appendUvarint(b, uint64(delta/time.Microsecond))
+	if t != RecordClose {
+		b = appendUvarint(b, uint64(len(data)))
+	}
+	r.scratch = b
+	if _, r.err = r.bw.Write(b); r.err != nil {
+		return
+	}
+	if _, r.err = r.bw.Write(data); r.err != nil {
+		return
+	}
+	if flush {
+		r.err = r.bw.Flush()
+	} else if r.flushTimer == nil && r.bw.Buffered() > 0 {
+		r.flushTimer = time.AfterFunc(recordFlushInterval, r.flushBuffered)
+	}
+}
+
+func (r *Recorder) flushBuffered() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.flushTimer = nil
+	if !r.closed && r.err == nil {
+		r.err = r.bw.Flush()
+	}
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// codec returns codec recording the messages of connection, codec itself
+// when r is nil.
+func (r *Recorder) codec(connection *TCPConnection, codec Codec) (Codec, func()) {
+	if r == nil {
+		return codec, func() {}
+	}
+	r.mutex.Lock()
+	r.session++
+	session := r.session
+	r.mutex.Unlock()
+	r.write(RecordOpen, session, []byte(connection.RemoteAddr().String()), false)
+	closed := func() { r.write(RecordClose, session, nil, true) }
+
+	rc := &recordCodec{Codec: codec, recorder: r, session: session}
+	if headerCodec, ok := codec.(HeaderCodec); ok {
+		return &recordHeaderCodec{rc, headerCodec}, closed
+	}
+	return rc, closed
+}
+
+type recordCodec struct {
+	Codec
+	recorder *Recorder
+	session  uint64
+}
+
+func (c *recordCodec) Read(r io.Reader) ([]byte, error) {
+	b, err := c.Codec.Read(r)
+	if err == nil {
+		c.recorder.write(RecordInbound, c.session, b, false)
+	}
+	return b, err
+}
+
+func (c *recordCodec) Write(w io.Writer, b []byte) error {
+	c.recorder.write(RecordOutbound, c.session, b, false)
+	return c.Codec.Write(w, b)
+}
+
+// recordHeaderCodec keeps the vectored writes of a HeaderCodec.
+type recordHeaderCodec struct {
+	*recordCodec
+	headerCodec HeaderCodec
+}
+
+func (c *recordHeaderCodec) AppendHeader(dst []byte, b []byte) ([]byte, error) {
+	c.recorder.write(RecordOutbound, c.session, b, false)
+	return c.headerCodec.AppendHeader(dst, b)
+}
+
+// RecordReader reads the records of a recording.
+type RecordReader struct {
+	r     *bufio.Reader
+	start time.Time
+	time  time.Duration
+}
+
+// NewRecordReader reads the header of a recording from r.
+func NewRecordReader(r io.Reader) (*RecordReader, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(recordMagic)+1+8)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	if string(header[:len(recordMagic)]) != recordMagic || header[len(recordMagic)] != recordVersion {
+		return nil, ErrRecordFormat
+	}
+	start := int64(binary.BigEndian.Uint64(header[len(recordMagic)+1:]))
+	return &RecordReader{r: br, start: time.Unix(0, start)}, nil
+}
+
+// Start returns when the recording started.
+func (r *RecordReader) Start() time.Time {
+	return r.start
+}
+
+// Next returns the next record, io.EOF at the end of the recording. A
+// recording cut short returns io.ErrUnexpectedEOF, a record over 64MB
+// ErrRecordFormat.
+func (r *RecordReader) Next() (Record, error) {
+	t, err := r.r.ReadByte()
+	if err != nil {
+		return Record{}, err
+	}
+	if t < byte(RecordOpen) || t > byte(RecordClose) {
+		return Record{}, ErrRecordFormat
+	}
+	record := Record{Type: RecordType(t)}
+	if record.Session, err = r.uvarint(); err != nil {
+		return Record{}, err
+	}
+	delta, err := r.uvarint()
+	if err != nil {
+		return Record{}, err
+	}
+	r.time += time.Duration(delta) * time.Microsecond
+	record.Time = r.time
+	if record.Type == RecordClose {
+		return record, nil
+	}
+	n, err := r.uvarint()
+	if err != nil {
+		return Record{}, err
+	}
+	if n > maxRecordSize {
+		return Record{}, ErrRecordFormat
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return Record{}, unexpectedEOF(err)
+	}
+	if record.Type == RecordOpen {
+		record.Addr = string(data)
+	} else {
+		record.Data = data
+	}
+	return record, nil
+}
+
+func (r *RecordReader) uvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(r.r)
+	return v, unexpectedEOF(err)
+}
@@ -0,0 +1,167 @@
+package network_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iakud/plume/network"
+	"github.com/iakud/plume/network/memnet"
+)
+
+// recordHeaderSize is the magic, the version and the start time.
+const recordHeaderSize = 4 + 1 + 8
+
+// recordEcho records a client sending a, b and c to an echo server 50ms apart.
+func recordEcho(t *testing.T, codec network.Codec) []byte {
+	var recording bytes.Buffer
+	recorder, err := network.NewRecorder(&recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memNetwork := memnet.NewNetwork(memnet.StreamConfig{})
+	server := network.NewTCPServer("record:1", memnetListen(t, memNetwork, "record:1"), network.WithRecorder(recorder))
+	go server.ListenAndServe(echoHandler{}, codec)
+
+	handler := newMemnetHandler()
+	client := network.NewTCPClient("record:1", network.WithDialFunc(memNetwork.Dial))
+	go client.DialAndServe(handler, codec)
+	connection := handler.connection(t)
+	for _, message := range []string{"a", "b", "c"} {
+		connection.Send([]byte(message))
+		if b := <-handler.receive; string(b) != message {
+			t.Fatalf("echo %q", b)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	client.Close()
+	server.Shutdown(context.Background())
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return recording.Bytes()
+}
+
+func TestRecord(t *testing.T) {
+	recording := recordEcho(t, network.NewVarintCodec(0))
+	reader, err := network.NewRecordReader(bytes.NewReader(recording))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []network.RecordType
+	var inbound string
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Session != 1 {
+			t.Fatalf("session %d", record.Session)
+		}
+		types = append(types, record.Type)
+		if record.Type == network.RecordInbound {
+			inbound += string(record.Data)
+		}
+	}
+	if len(types) != 8 || types[0] != network.RecordOpen || types[7] != network.RecordClose || inbound != "abc" {
+		t.Fatalf("records %v, inbound %q", types, inbound)
+	}
+
+	// cut in the close record
+	reader, _ = network.NewRecordReader(bytes.NewReader(recording[:len(recording)-1]))
+	for err == nil {
+		_, err = reader.Next()
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("truncated recording: %v", err)
+	}
+
+	// a length over the limit is not allocated
+	corrupt := append([]byte(nil), recording[:recordHeaderSize]...)
+	corrupt = append(corrupt, byte(network.RecordInbound), 1, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f)
+	reader, _ = network.NewRecordReader(bytes.NewReader(corrupt))
+	if _, err := reader.Next(); err != network.ErrRecordFormat {
+		t.Fatalf("corrupt recording: %v", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	codec := network.NewVarintCodec(0)
+	recording := recordEcho(t, codec)
+
+	for _, speed := range []float64{1, 0} {
+		handler := newMemnetHandler()
+		start := time.Now()
+		err := network.ReplayHandler(context.Background(), bytes.NewReader(recording), handler, codec, network.WithReplaySpeed(speed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		elapsed := time.Since(start)
+		if speed == 1 && elapsed < time.Millisecond*100 || speed == 0 && elapsed > time.Millisecond*100 {
+			t.Fatalf("replayed at speed %v in %v", speed, elapsed)
+		}
+		close(handler.receive)
+		var received string
+		for b := range handler.receive {
+			received += string(b)
+		}
+		if received != "abc" {
+			t.Fatalf("replayed %q", received)
+		}
+		if reason := <-handler.closed; reason.Cause != network.ClosePeer {
+			t.Fatalf("close reason %v", reason)
+		}
+	}
+}
+
+func TestRecorderFlush(t *testing.T) {
+	var recording syncBuffer
+	recorder, err := network.NewRecorder(&recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recorder.Close()
+	memNetwork := memnet.NewNetwork(memnet.StreamConfig{})
+	server := network.NewTCPServer("flush:1", memnetListen(t, memNetwork, "flush:1"), network.WithRecorder(recorder))
+	go server.ListenAndServe(echoHandler{}, nil)
+	defer server.Close()
+
+	handler := newMemnetHandler()
+	client := network.NewTCPClient("flush:1", network.WithDialFunc(memNetwork.Dial))
+	go client.DialAndServe(handler, nil)
+	defer client.Close()
+	handler.connection(t)
+
+	// the open record is written while the connection is open
+	deadline := time.Now().Add(time.Second * 5)
+	for recording.Len() == recordHeaderSize {
+		if time.Now().After(deadline) {
+			t.Fatal("records not flushed")
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+// syncBuffer is a bytes.Buffer written by the recorder flush timer.
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Len()
+}
@@ -0,0 +1,157 @@
+package network
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"github.com/iakud/plume/network/memnet"
+)
+
+// Replay sends the inbound messages of a recording to the TCPServer at addr,
+// each recorded connection over a TCPClient created with opt. The messages
+// are encoded with codec, the one of the recorded server, and the responses
+// are discarded. Replay returns when the connections are closed, after the
+// last one is shut down.
+func Replay(ctx context.Context, r io.Reader, addr string, codec Codec, opt ...Option) error {
+	reader, err := NewRecordReader(r)
+	if err != nil {
+		return err
+	}
+	var opts options
+	for _, o := range opt {
+		o(&opts)
+	}
+	speed := opts.replaySpeed
+	if speed == 0 {
+		speed = 1
+	}
+
+	sessions := make(map[uint64]*replaySession)
+	defer func() {
+		for _, session := range sessions {
+			session.client.Close()
+		}
+	}()
+	start := time.Now()
+	var base time.Duration
+	for first := true; ; first = false {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if first {
+			base = record.Time
+		}
+		if speed > 0 {
+			at := time.Duration(float64(record.Time-base) / speed)
+			if !sleep(ctx, time.Until(start.Add(at))) {
+				return ctx.Err()
+			}
+		}
+
+		switch record.Type {
+		case RecordOpen:
+			session, err := dialReplay(ctx, addr, codec, opt)
+			if err != nil {
+				return err
+			}
+			sessions[record.Session] = session
+		case RecordInbound:
+			if session, ok := sessions[record.Session]; ok {
+				session.connection.Send(record.Data)
+			}
+		case RecordClose:
+			if session, ok := sessions[record.Session]; ok {
+				session.connection.Shutdown()
+			}
+		}
+	}
+
+	for _, session := range sessions {
+		session.connection.Shutdown()
+	}
+	for id, session := range sessions {
+		select {
+		case <-session.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delete(sessions, id)
+	}
+	return nil
+}
+
+// ReplayHandler is Replay into handler, served by a TCPServer created with
+// opt over an in-memory network. It returns when the disconnect events of
+// the replayed connections returned.
+func ReplayHandler(ctx context.Context, r io.Reader, handler TCPHandler, codec Codec, opt ...Option) error {
+	memNetwork := memnet.NewNetwork(memnet.StreamConfig{})
+	ln, err := memNetwork.Listen("replay")
+	if err != nil {
+		return err
+	}
+	listen := func(string) (net.Listener, error) { return ln, nil }
+	server := NewTCPServer("replay", append(opt[:len(opt):len(opt)], WithListenFunc(listen))...)
+	go server.ListenAndServe(handler, codec)
+	defer server.Close()
+
+	// the other options are the server ones
+	var opts options
+	for _, o := range opt {
+		o(&opts)
+	}
+	clientOpt := []Option{
+		WithDialFunc(memNetwork.Dial),
+		func(clientOpts *options) { clientOpts.replaySpeed = opts.replaySpeed },
+	}
+	if err := Replay(ctx, r, "replay", codec, clientOpt...); err != nil {
+		return err
+	}
+	_, _, err = server.Shutdown(ctx)
+	return err
+}
+
+// replaySession is a recorded connection being replayed.
+type replaySession struct {
+	client     *TCPClient
+	connection *TCPConnection
+	connected  chan *TCPConnection
+	done       chan struct{}
+	err        error // set before done is closed
+}
+
+func dialReplay(ctx context.Context, addr string, codec Codec, opt []Option) (*replaySession, error) {
+	session := &replaySession{
+		client:    NewTCPClient(addr, opt...),
+		connected: make(chan *TCPConnection, 1),
+		done:      make(chan struct{}),
+	}
+	go func() {
+		defer close(session.done)
+		if err := session.client.DialAndServeContext(ctx, session, codec); err != ErrClientClosed {
+			session.err = err
+		}
+	}()
+	select {
+	case session.connection = <-session.connected:
+		return session, nil
+	case <-session.done:
+		return nil, session.err
+	}
+}
+
+func (s *replaySession) Connect(connection *TCPConnection, connected bool) {
+	if connected {
+		s.connected <- connection
+		return
+	}
+	// do not redial
+	s.client.Close()
+}
+
+func (s *replaySession) Receive(connection *TCPConnection, b []byte) {}
@@ -0,0 +1,196 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	ErrMessageHeader  = errors.New("network: invalid message header")
+	ErrUnknownMessage = errors.New("network: unknown message")
+	ErrHandlerPanic   = errors.New("network: handler panic")
+)
+
+// MessageHeader splits a received buffer into a message ID and its payload,
+// and joins them again for sending.
+type MessageHeader interface {
+	Unpack(b []byte) (id uint32, payload []byte, err error)
+	Pack(id uint32, payload []byte) []byte
+}
+
+// defaultMessageHeader is a 4 byte big endian message ID.
+type defaultMessageHeader struct {
+}
+
+var DefaultMessageHeader *defaultMessageHeader = &defaultMessageHeader{}
+
+func (*defaultMessageHeader) Unpack(b []byte) (uint32, []byte, error) {
+	if len(b) < 4 {
+		return 0, nil, ErrMessageHeader
+	}
+	return binary.BigEndian.Uint32(b), b[4:], nil
+}
+
+func (*defaultMessageHeader) Pack(id uint32, payload []byte) []byte {
+	b := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(b, id)
+	copy(b[4:], payload)
+	return b
+}
+
+type messageHandler func(conn Conn, payload []byte) error
+
+// Router dispatches received messages to the handler registered for their
+// message ID. Use TCPHandler or WSHandler to serve it.
+type Router struct {
+	header MessageHeader
+
+	mutex     sync.RWMutex
+	handlers  map[uint32]messageHandler
+	connect   func(conn Conn, connected bool)
+	errorHook func(conn Conn, id uint32, err error)
+}
+
+func NewRouter(header MessageHeader) *Router {
+	if header == nil {
+		header = DefaultMessageHeader
+	}
+	router := &Router{
+		header:   header,
+		handlers: make(map[uint32]messageHandler),
+	}
+	return router
+}
+
+func (r *Router) handle(id uint32, handler messageHandler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.handlers[id]; ok {
+		panic(fmt.Sprintf("network: multiple registrations for message %d", id))
+	}
+	r.handlers[id] = handler
+}
+
+// HandleRaw registers f for message id with the undecoded payload.
+func (r *Router) HandleRaw(id uint32, f func(conn Conn, payload []byte)) {
+	r.handle(id, func(conn Conn, payload []byte) error {
+		f(conn, payload)
+		return nil
+	})
+}
+
+// Handle registers f for message id, unmarshaling the payload into a new T.
+func Handle[T proto.Message](r *Router, id uint32, f func(conn Conn, msg T)) {
+	var zero T
+	messageType := zero.ProtoReflect().Type()
+	r.handle(id, func(conn Conn, payload []byte) error {
+		msg := messageType.New().Interface().(T)
+		if err := proto.Unmarshal(payload, msg); err != nil {
+			return fmt.Errorf("network: unmarshal message %d: %w", id, err)
+		}
+		f(conn, msg)
+		return nil
+	})
+}
+
+// HandleConnect sets the callback for connection events.
+func (r *Router) HandleConnect(f func(conn Conn, connected bool)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.connect = f
+}
+
+// HandleError sets the hook for unknown message IDs, decode failures and
+// handler panics. By default errors are logged and the connection is kept.
+func (r *Router) HandleError(f func(conn Conn, id uint32, err error)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.errorHook = f
+}
+
+func (r *Router) Pack(id uint32, msg proto.Message) ([]byte, error) {
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return r.header.Pack(id, payload), nil
+}
+
+// Send marshals msg and sends it on conn as message id.
+func (r *Router) Send(conn Conn, id uint32, msg proto.Message) error {
+	b, err := r.Pack(id, msg)
+	if err != nil {
+		return err
+	}
+	return conn.Send(b)
+}
+
+func (r *Router) Connect(conn Conn, connected bool) {
+	r.mutex.RLock()
+	connect := r.connect
+	r.mutex.RUnlock()
+	if connect != nil {
+		connect(conn, connected)
+	}
+}
+
+// Receive is Dispatch, it makes the router a Handler.
+func (r *Router) Receive(conn Conn, b []byte) {
+	r.Dispatch(conn, b)
+}
+
+// Dispatch decodes b and calls the handler registered for its message ID.
+func (r *Router) Dispatch(conn Conn, b []byte) {
+	id, payload, err := r.header.Unpack(b)
+	if err != nil {
+		r.error(conn, id, err)
+		return
+	}
+	r.mutex.RLock()
+	handler, ok := r.handlers[id]
+	r.mutex.RUnlock()
+	if !ok {
+		r.error(conn, id, ErrUnknownMessage)
+		return
+	}
+	if err := r.call(handler, conn, id, payload); err != nil {
+		r.error(conn, id, err)
+	}
+}
+
+func (r *Router) call(handler messageHandler, conn Conn, id uint32, payload []byte) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			const size = 64 << 10
+			buf := make([]byte, size)
+			buf = buf[:runtime.Stack(buf, false)]
+			err = fmt.Errorf("%w: message %d: %v\n%s", ErrHandlerPanic, id, v, buf)
+		}
+	}()
+	return handler(conn, payload)
+}
+
+func (r *Router) error(conn Conn, id uint32, err error) {
+	r.mutex.RLock()
+	errorHook := r.errorHook
+	r.mutex.RUnlock()
+	if errorHook != nil {
+		errorHook(conn, id, err)
+		return
+	}
+	log.Printf("network: router %v message %d: %v", conn.RemoteAddr(), id, err)
+}
+
+func (r *Router) TCPHandler() TCPHandler {
+	return AsTCPHandler(r)
+}
+
+func (r *Router) WSHandler() WSHandler {
+	return AsWSHandler(r)
+}
@@ -0,0 +1,138 @@
+package network_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/iakud/plume/network"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const (
+	kMsgEcho  = 1
+	kMsgPanic = 2
+)
+
+// routerConn records sent messages, the methods the router does not use
+// are left to the nil embedded Conn.
+type routerConn struct {
+	network.Conn
+	sent [][]byte
+}
+
+func (*routerConn) LocalAddr() net.Addr  { return &net.TCPAddr{} }
+func (*routerConn) RemoteAddr() net.Addr { return &net.TCPAddr{} }
+func (c *routerConn) Send(b []byte) error {
+	c.sent = append(c.sent, b)
+	return nil
+}
+
+type routerError struct {
+	id  uint32
+	err error
+}
+
+func newEchoRouter() *network.Router {
+	router := network.NewRouter(nil)
+	network.Handle(router, kMsgEcho, func(conn network.Conn, msg *wrapperspb.StringValue) {
+		router.Send(conn, kMsgEcho, wrapperspb.String("echo "+msg.GetValue()))
+	})
+	router.HandleRaw(kMsgPanic, func(network.Conn, []byte) {
+		panic("boom")
+	})
+	return router
+}
+
+func unpackString(t *testing.T, b []byte) (uint32, string) {
+	id, payload, err := network.DefaultMessageHeader.Unpack(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &wrapperspb.StringValue{}
+	if err := proto.Unmarshal(payload, msg); err != nil {
+		t.Fatal(err)
+	}
+	return id, msg.GetValue()
+}
+
+func TestRouterDispatch(t *testing.T) {
+	router := newEchoRouter()
+	var errs []routerError
+	router.HandleError(func(conn network.Conn, id uint32, err error) {
+		errs = append(errs, routerError{id, err})
+	})
+	conn := &routerConn{}
+
+	b, err := router.Pack(kMsgEcho, wrapperspb.String("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.Dispatch(conn, b)
+	if len(errs) != 0 || len(conn.sent) != 1 {
+		t.Fatalf("dispatch: errors %v, sent %d", errs, len(conn.sent))
+	}
+	if id, value := unpackString(t, conn.sent[0]); id != kMsgEcho || value != "echo hello" {
+		t.Fatalf("reply: message %d %q", id, value)
+	}
+
+	router.Dispatch(conn, []byte{0, 0})
+	router.Dispatch(conn, network.DefaultMessageHeader.Pack(100, nil))
+	router.Dispatch(conn, network.DefaultMessageHeader.Pack(kMsgEcho, []byte{0xff}))
+	router.Dispatch(conn, network.DefaultMessageHeader.Pack(kMsgPanic, nil))
+	want := []routerError{
+		{0, network.ErrMessageHeader},
+		{100, network.ErrUnknownMessage},
+		{kMsgEcho, nil},
+		{kMsgPanic, network.ErrHandlerPanic},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("errors %v, want %d", errs, len(want))
+	}
+	for i, e := range want {
+		if errs[i].id != e.id || errs[i].err == nil || (e.err != nil && !errors.Is(errs[i].err, e.err)) {
+			t.Fatalf("error %d: message %d %v, want message %d %v", i, errs[i].id, errs[i].err, e.id, e.err)
+		}
+	}
+}
+
+func TestRouterDuplicate(t *testing.T) {
+	router := network.NewRouter(nil)
+	router.HandleRaw(kMsgEcho, func(network.Conn, []byte) {})
+	defer func() {
+		if recover() == nil {
+			t.Fatal("duplicate registration did not panic")
+		}
+	}()
+	router.HandleRaw(kMsgEcho, func(network.Conn, []byte) {})
+}
+
+func TestRouterTCP(t *testing.T) {
+	codec := network.NewLengthCodec(2, binary.BigEndian, 0)
+	server := network.NewTCPServer("localhost:8002")
+	go server.ListenAndServe(newEchoRouter().TCPHandler(), codec)
+	defer server.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	client := network.NewTCPClient("localhost:8002")
+	router := network.NewRouter(nil)
+	var reply string
+	network.Handle(router, kMsgEcho, func(conn network.Conn, msg *wrapperspb.StringValue) {
+		reply = msg.GetValue()
+		client.Close()
+	})
+	router.HandleConnect(func(conn network.Conn, connected bool) {
+		if connected {
+			router.Send(conn, kMsgEcho, wrapperspb.String("hello"))
+		}
+	})
+	if err := client.DialAndServe(router.TCPHandler(), codec); err != network.ErrClientClosed {
+		t.Fatal(err)
+	}
+	if reply != "echo hello" {
+		t.Fatalf("reply %q", reply)
+	}
+}
@@ -0,0 +1,182 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync"
+)
+
+var (
+	ErrRPCClosed  = errors.New("network: RPC connection closed")
+	ErrRPCMessage = errors.New("network: invalid RPC message")
+)
+
+const (
+	rpcRequest  byte = 1
+	rpcResponse byte = 2
+
+	rpcHeaderSize = 5
+)
+
+// RPCHandler handles requests on connections served by NewRPCHandler.
+// Serve runs where Receive runs, on the read goroutine or on the event loop
+// the connection is bound to; reply with conn.Reply, from any goroutine, to
+// answer seq.
+type RPCHandler interface {
+	Connect(conn *RPCConn, connected bool)
+	Serve(conn *RPCConn, seq uint32, req []byte)
+}
+
+type rpcResult struct {
+	resp []byte
+	err  error
+}
+
+// RPCConn tags outgoing requests on a TCPConnection with sequence numbers and
+// matches replies to pending calls. Many calls may be in flight at once.
+type RPCConn struct {
+	conn *TCPConnection
+
+	mutex   sync.Mutex
+	seq     uint32
+	pending map[uint32]chan rpcResult
+	closed  bool
+}
+
+func newRPCConn(conn *TCPConnection) *RPCConn {
+	rpcConn := &RPCConn{
+		conn:    conn,
+		pending: make(map[uint32]chan rpcResult),
+	}
+	return rpcConn
+}
+
+func (c *RPCConn) Conn() *TCPConnection {
+	return c.conn
+}
+
+func packRPC(typ byte, seq uint32, payload []byte) []byte {
+	b := make([]byte, rpcHeaderSize+len(payload))
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:], seq)
+	copy(b[rpcHeaderSize:], payload)
+	return b
+}
+
+// Call sends req and waits for its reply. It returns ctx.Err() when ctx is
+// done first, and ErrRPCClosed when the connection closes.
+func (c *RPCConn) Call(ctx context.Context, req []byte) ([]byte, error) {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil, ErrRPCClosed
+	}
+	c.seq++
+	seq := c.seq
+	ch := make(chan rpcResult, 1)
+	c.pending[seq] = ch
+	c.mutex.Unlock()
+
+	if err := c.conn.Send(packRPC(rpcRequest, seq, req)); err != nil {
+		c.cancel(seq)
+		return nil, err
+	}
+	select {
+	case result := <-ch:
+		return result.resp, result.err
+	case <-ctx.Done():
+		c.cancel(seq)
+		return nil, ctx.Err()
+	}
+}
+
+func (c *RPCConn) cancel(seq uint32) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.pending, seq)
+}
+
+// Reply answers the request seq.
+func (c *RPCConn) Reply(seq uint32, resp []byte) error {
+	return c.conn.Send(packRPC(rpcResponse, seq, resp))
+}
+
+func (c *RPCConn) complete(seq uint32, resp []byte) {
+	c.mutex.Lock()
+	ch, ok := c.pending[seq]
+	delete(c.pending, seq)
+	c.mutex.Unlock()
+	if ok { // late replies of canceled calls are dropped
+		ch <- rpcResult{resp: resp}
+	}
+}
+
+func (c *RPCConn) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	for seq, ch := range c.pending {
+		ch <- rpcResult{err: ErrRPCClosed}
+		delete(c.pending, seq)
+	}
+}
+
+type rpcTCPHandler struct {
+	handler RPCHandler
+
+	mutex sync.RWMutex
+	conns map[*TCPConnection]*RPCConn
+}
+
+// NewRPCHandler returns a TCPHandler serving handler with request/response
+// framing. Use it with TCPServer and TCPClient alike.
+func NewRPCHandler(handler RPCHandler) TCPHandler {
+	h := &rpcTCPHandler{
+		handler: handler,
+		conns:   make(map[*TCPConnection]*RPCConn),
+	}
+	return h
+}
+
+func (h *rpcTCPHandler) Connect(conn *TCPConnection, connected bool) {
+	if connected {
+		rpcConn := newRPCConn(conn)
+		h.mutex.Lock()
+		h.conns[conn] = rpcConn
+		h.mutex.Unlock()
+		h.handler.Connect(rpcConn, true)
+		return
+	}
+	h.mutex.Lock()
+	rpcConn := h.conns[conn]
+	delete(h.conns, conn)
+	h.mutex.Unlock()
+	rpcConn.close()
+	h.handler.Connect(rpcConn, false)
+}
+
+func (h *rpcTCPHandler) Receive(conn *TCPConnection, buf []byte) {
+	h.mutex.RLock()
+	rpcConn := h.conns[conn]
+	h.mutex.RUnlock()
+	if len(buf) < rpcHeaderSize {
+		log.Printf("network: RPC %v: %v", conn.RemoteAddr(), ErrRPCMessage)
+		conn.Close()
+		return
+	}
+	seq := binary.BigEndian.Uint32(buf[1:])
+	switch buf[0] {
+	case rpcRequest:
+		h.handler.Serve(rpcConn, seq, buf[rpcHeaderSize:])
+	case rpcResponse:
+		rpcConn.complete(seq, buf[rpcHeaderSize:])
+	default:
+		log.Printf("network: RPC %v: %v", conn.RemoteAddr(), ErrRPCMessage)
+		conn.Close()
+	}
+}
@@ -0,0 +1,119 @@
+package network_test
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iakud/plume/network"
+)
+
+type rpcServer struct{}
+
+func (*rpcServer) Connect(*network.RPCConn, bool) {}
+
+func (*rpcServer) Serve(conn *network.RPCConn, seq uint32, req []byte) {
+	switch string(req) {
+	case "ignore":
+	case "close":
+		conn.Conn().Close()
+	default:
+		// reply out of order
+		go func() {
+			time.Sleep(time.Millisecond * time.Duration(seq%10))
+			conn.Reply(seq, append([]byte("echo "), req...))
+		}()
+	}
+}
+
+type rpcClient struct {
+	connected chan *network.RPCConn
+}
+
+func (c *rpcClient) Connect(conn *network.RPCConn, connected bool) {
+	if connected {
+		c.connected <- conn
+	}
+}
+
+func (*rpcClient) Serve(*network.RPCConn, uint32, []byte) {}
+
+func dialRPC(t *testing.T, addr string) (*network.TCPClient, *network.RPCConn) {
+	codec := network.NewLengthCodec(4, binary.BigEndian, 0)
+	client := network.NewTCPClient(addr)
+	c := &rpcClient{connected: make(chan *network.RPCConn, 1)}
+	go client.DialAndServe(network.NewRPCHandler(c), codec)
+	select {
+	case conn := <-c.connected:
+		return client, conn
+	case <-time.After(time.Second * 5):
+		t.Fatal("dial timeout")
+	}
+	return nil, nil
+}
+
+func TestRPC(t *testing.T) {
+	codec := network.NewLengthCodec(4, binary.BigEndian, 0)
+	server := network.NewTCPServer("localhost:8003")
+	go server.ListenAndServe(network.NewRPCHandler(&rpcServer{}), codec)
+	defer server.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	client, conn := dialRPC(t, "localhost:8003")
+	defer client.Close()
+
+	// pipelined calls
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := fmt.Sprintf("hello %d", i)
+			resp, err := conn.Call(context.Background(), []byte(req))
+			if err != nil {
+				t.Errorf("call %d: %v", i, err)
+				return
+			}
+			if string(resp) != "echo "+req {
+				t.Errorf("call %d: reply %q", i, resp)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if _, err := conn.Call(ctx, []byte("ignore")); err != context.DeadlineExceeded {
+		t.Fatalf("call: %v, want DeadlineExceeded", err)
+	}
+
+	// in-flight calls fail when the connection closes
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := conn.Call(context.Background(), []byte("ignore"))
+			errs <- err
+		}()
+	}
+	time.Sleep(time.Millisecond * 50)
+	if _, err := conn.Call(context.Background(), []byte("close")); err != network.ErrRPCClosed {
+		t.Fatalf("call: %v, want ErrRPCClosed", err)
+	}
+	for i := 0; i < cap(errs); i++ {
+		select {
+		case err := <-errs:
+			if err != network.ErrRPCClosed {
+				t.Fatalf("call: %v, want ErrRPCClosed", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("in-flight call not failed")
+		}
+	}
+	if _, err := conn.Call(context.Background(), []byte("hello")); err != network.ErrRPCClosed {
+		t.Fatalf("call after close: %v, want ErrRPCClosed", err)
+	}
+}
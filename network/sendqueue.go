@@ -0,0 +1,282 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSlowConsumer = errors.New("network: slow consumer")
+)
+
+type OverflowPolicy int
+
+const (
+	OverflowReject     OverflowPolicy = iota // Send returns the pending send full error
+	OverflowDropOldest                       // the oldest pending messages are dropped
+	OverflowBlock                            // Send blocks until there is room, see SendContext
+	OverflowClose                            // the connection is closed after staying over the limit for SlowTimeout, at once without it
+)
+
+// Backpressure limits the messages pending send on a connection. A zero
+// MaxMessages or MaxBytes means no limit, a single message larger than
+// MaxBytes is still queued when nothing else is pending.
+type Backpressure struct {
+	MaxMessages int
+	MaxBytes    int
+	Policy      OverflowPolicy
+	SlowTimeout time.Duration
+}
+
+type SendStats struct {
+	QueuedMessages int
+	QueuedBytes    int
+	HighWaterMark  int // most bytes ever queued
+	Dropped        uint64
+	Rejected       uint64
+}
+
+// outgoing is a message pending send, buffer is released once b is written.
+// text marks WebSocket text messages.
+type outgoing struct {
+	b      []byte
+	buffer *Buffer
+	text   bool
+}
+
+func (o outgoing) release() {
+	if o.buffer != nil {
+		o.buffer.Release()
+	}
+}
+
+func releaseAll(bufs []outgoing) {
+	for _, o := range bufs {
+		o.release()
+	}
+}
+
+// sendQueue holds the messages pending send for the background writer.
+type sendQueue struct {
+	full    error
+	slow    func()
+	metrics *Metrics
+
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	bufs      []outgoing
+	bytes     int
+	closed    bool
+	space     chan struct{} // closed when the writer takes the pending messages
+	slowTimer *time.Timer
+	slowGen   uint64 // identifies slowTimer to its callback
+
+	backpressure  Backpressure
+	highWaterMark int
+	dropped       uint64
+	rejected      uint64
+}
+
+func newSendQueue(full error, slow func()) *sendQueue {
+	q := &sendQueue{
+		full: full,
+		slow: slow,
+	}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+func (q *sendQueue) setBackpressure(backpressure Backpressure) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.backpressure = backpressure
+}
+
+func (q *sendQueue) setPendingSend(pendingSend int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.backpressure.MaxMessages = pendingSend
+}
+
+func (q *sendQueue) isFull(n int) bool {
+	if len(q.bufs) == 0 {
+		return false
+	}
+	if q.backpressure.MaxMessages > 0 && len(q.bufs) >= q.backpressure.MaxMessages {
+		return true
+	}
+	return q.backpressure.MaxBytes > 0 && q.bytes+n > q.backpressure.MaxBytes
+}
+
+// push queues o, its buffer if any is released when it is written or dropped.
+func (q *sendQueue) push(ctx context.Context, o outgoing) error {
+	return q.pushOrFail(ctx, o, nil)
+}
+
+// pushOrFail is push returning closed when the queue is closed.
+func (q *sendQueue) pushOrFail(ctx context.Context, o outgoing, closed error) error {
+	b := o.b
+	q.mutex.Lock()
+	for {
+		if q.closed {
+			q.mutex.Unlock()
+			o.release()
+			return closed
+		}
+		if !q.isFull(len(b)) {
+			break
+		}
+		switch q.backpressure.Policy {
+		case OverflowDropOldest:
+			for q.isFull(len(b)) {
+				q.bytes -= len(q.bufs[0].b)
+				q.metrics.queue(-len(q.bufs[0].b))
+				q.bufs[0].release()
+				q.bufs[0] = outgoing{}
+				q.bufs = q.bufs[1:]
+				q.dropped++
+			}
+		case OverflowBlock:
+			if q.space == nil {
+				q.space = make(chan struct{})
+			}
+			space := q.space
+			q.mutex.Unlock()
+			select {
+			case <-space:
+			case <-ctx.Done():
+				o.release()
+				return ctx.Err()
+			}
+			q.mutex.Lock()
+			continue
+		case OverflowClose:
+			if q.backpressure.SlowTimeout <= 0 {
+				q.mutex.Unlock()
+				o.release()
+				q.slow()
+				return ErrSlowConsumer
+			}
+			if q.slowTimer == nil {
+				q.slowGen++
+				gen := q.slowGen
+				q.slowTimer = time.AfterFunc(q.backpressure.SlowTimeout, func() { q.checkSlow(gen) })
+			}
+		default:
+			q.rejected++
+			q.mutex.Unlock()
+			o.release()
+			return q.full
+		}
+		break
+	}
+	q.bufs = append(q.bufs, o)
+	q.bytes += len(b)
+	q.metrics.queue(len(b))
+	if q.bytes > q.highWaterMark {
+		q.highWaterMark = q.bytes
+	}
+	q.cond.Signal()
+	q.mutex.Unlock()
+	return nil
+}
+
+// checkSlow is called by the slow timer gen, which may have been stopped and
+// replaced by another one after it fired.
+func (q *sendQueue) checkSlow(gen uint64) {
+	q.mutex.Lock()
+	slow := q.slowTimer != nil && q.slowGen == gen && !q.closed
+	if slow {
+		q.slowTimer = nil
+	}
+	q.mutex.Unlock()
+	if slow {
+		q.slow()
+	}
+}
+
+// take waits for pending messages, closed reports the queue was closed and
+// nothing is left to write after bufs.
+func (q *sendQueue) take() (bufs []outgoing, closed bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for !q.closed && len(q.bufs) == 0 {
+		q.cond.Wait()
+	}
+	bufs, q.bufs = q.bufs, nil // swap
+	q.metrics.queue(-q.bytes)
+	q.bytes = 0
+	q.wakeSenders()
+	return bufs, q.closed
+}
+
+func (q *sendQueue) wakeSenders() {
+	if q.space != nil {
+		close(q.space)
+		q.space = nil
+	}
+	if q.slowTimer != nil {
+		q.slowTimer.Stop()
+		q.slowTimer = nil
+	}
+}
+
+// wait waits until at most n bytes are pending, or the queue is closed.
+func (q *sendQueue) wait(n int) {
+	q.mutex.Lock()
+	for !q.closed && q.bytes > n {
+		if q.space == nil {
+			q.space = make(chan struct{})
+		}
+		space := q.space
+		q.mutex.Unlock()
+		<-space
+		q.mutex.Lock()
+	}
+	q.mutex.Unlock()
+}
+
+// close stops the queue, messages pending are still taken by the writer.
+func (q *sendQueue) close() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return false
+	}
+	q.closed = true
+	q.wakeSenders()
+	q.cond.Signal()
+	return true
+}
+
+// discard takes the messages left when the writer stops on an error.
+func (q *sendQueue) discard() []outgoing {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	bufs := q.bufs
+	q.bufs = nil
+	q.metrics.queue(-q.bytes)
+	q.bytes = 0
+	return bufs
+}
+
+func (q *sendQueue) isClosed() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.closed
+}
+
+func (q *sendQueue) stats() SendStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	stats := SendStats{
+		QueuedMessages: len(q.bufs),
+		QueuedBytes:    q.bytes,
+		HighWaterMark:  q.highWaterMark,
+		Dropped:        q.dropped,
+		Rejected:       q.rejected,
+	}
+	return stats
+}
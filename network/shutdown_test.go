@@ -0,0 +1,147 @@
+package network_test
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/iakud/plume/network"
+)
+
+const kDrainMessages = 1000
+
+type drainServer struct {
+	connected    chan struct{}
+	disconnected int32
+}
+
+func (srv *drainServer) Connect(connection *network.TCPConnection, connected bool) {
+	if !connected {
+		time.Sleep(time.Millisecond * 50) // slow disconnect callback
+		atomic.AddInt32(&srv.disconnected, 1)
+		return
+	}
+	for i := 0; i < kDrainMessages; i++ {
+		connection.Send(make([]byte, 1024))
+	}
+	srv.connected <- struct{}{}
+}
+
+func (srv *drainServer) Receive(*network.TCPConnection, []byte) {}
+
+type drainClient struct {
+	client   *network.TCPClient
+	received int32
+}
+
+func (c *drainClient) Connect(connection *network.TCPConnection, connected bool) {
+	if !connected {
+		c.client.Close()
+	}
+}
+
+func (c *drainClient) Receive(*network.TCPConnection, []byte) {
+	atomic.AddInt32(&c.received, 1)
+}
+
+func TestShutdown(t *testing.T) {
+	codec := network.NewLengthCodec(2, binary.BigEndian, 0)
+	srv := &drainServer{connected: make(chan struct{}, 2)}
+	server := network.NewTCPServer("localhost:8009")
+	go server.ListenAndServe(srv, codec)
+	time.Sleep(time.Millisecond * 100)
+
+	c := &drainClient{client: network.NewTCPClient("localhost:8009")}
+	done := make(chan struct{})
+	go func() {
+		c.client.DialAndServe(c, codec)
+		close(done)
+	}()
+	<-srv.connected
+	// a peer that never reads nor closes
+	conn, err := net.Dial("tcp", "localhost:8009")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-srv.connected
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	drained, forced, err := server.Shutdown(ctx)
+	if drained != 1 || forced != 1 || err != context.DeadlineExceeded {
+		t.Fatalf("shutdown: drained %d, forced %d, %v", drained, forced, err)
+	}
+	if disconnected := atomic.LoadInt32(&srv.disconnected); disconnected != 1 {
+		t.Fatalf("disconnected %d before shutdown returned, want 1", disconnected)
+	}
+	<-done
+	if received := atomic.LoadInt32(&c.received); received != kDrainMessages {
+		t.Fatalf("client received %d messages, want %d", received, kDrainMessages)
+	}
+	if _, _, err := server.Shutdown(context.Background()); err != network.ErrServerClosed {
+		t.Fatalf("shutdown again: %v", err)
+	}
+}
+
+type wsDrainServer struct {
+	connected chan struct{}
+}
+
+func (srv *wsDrainServer) Connect(connection *network.WSConnection, connected bool) {
+	if !connected {
+		return
+	}
+	for i := 0; i < kDrainMessages; i++ {
+		connection.Send(make([]byte, 1024))
+	}
+	srv.connected <- struct{}{}
+}
+
+func (srv *wsDrainServer) Receive(*network.WSConnection, []byte) {}
+
+type wsDrainClient struct {
+	client   *network.WSClient
+	received int32
+}
+
+func (c *wsDrainClient) Connect(connection *network.WSConnection, connected bool) {
+	if !connected {
+		c.client.Close()
+	}
+}
+
+func (c *wsDrainClient) Receive(*network.WSConnection, []byte) {
+	atomic.AddInt32(&c.received, 1)
+}
+
+func TestWSShutdown(t *testing.T) {
+	srv := &wsDrainServer{connected: make(chan struct{}, 1)}
+	wsServer := network.NewWSServer(srv)
+	httpServer := &http.Server{Addr: "localhost:8010", Handler: wsServer}
+	go httpServer.ListenAndServe()
+	defer httpServer.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	c := &wsDrainClient{}
+	c.client = network.NewWSClient("ws://localhost:8010", c)
+	done := make(chan struct{})
+	go func() {
+		c.client.DialAndServe()
+		close(done)
+	}()
+	<-srv.connected
+
+	drained, forced, err := wsServer.Shutdown(context.Background())
+	if drained != 1 || forced != 0 || err != nil {
+		t.Fatalf("shutdown: drained %d, forced %d, %v", drained, forced, err)
+	}
+	<-done
+	if received := atomic.LoadInt32(&c.received); received != kDrainMessages {
+		t.Fatalf("client received %d messages, want %d", received, kDrainMessages)
+	}
+}
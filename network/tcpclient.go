@@ -1,11 +1,12 @@
 package network
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"log"
 	"net"
 	"sync"
-	"time"
 )
 
 var (
@@ -13,34 +14,40 @@ var (
 )
 
 type TCPClient struct {
-	addr  string
-	retry bool
+	network string
+	addr    string
+	retry   bool
+	opts    options
 
 	mutex      sync.Mutex
 	connection *TCPConnection
 	closed     bool
+	done       chan struct{}
 }
 
-func NewTCPClient(addr string) *TCPClient {
+func NewTCPClient(addr string, opt ...Option) *TCPClient {
 	client := &TCPClient{
-		addr:  addr,
-		retry: false,
+		network: "tcp",
+		addr:    addr,
+		done:    make(chan struct{}),
 	}
+	for _, o := range opt {
+		o(&client.opts)
+	}
+	client.retry = client.opts.backoff != nil
 	return client
 }
 
 func (c *TCPClient) EnableRetry()  { c.retry = true }
 func (c *TCPClient) DisableRetry() { c.retry = false }
 
-func dialTCP(addr string) (*net.TCPConn, error) {
-	raddr, err := net.ResolveTCPAddr("tcp", addr)
-	if err != nil {
-		return nil, err
-	}
-	return net.DialTCP("tcp", nil, raddr)
+func (c *TCPClient) DialAndServe(handler TCPHandler, codec Codec) error {
+	return c.DialAndServeContext(context.Background(), handler, codec)
 }
 
-func (c *TCPClient) DialAndServe(handler TCPHandler, codec Codec) error {
+// DialAndServeContext is DialAndServe, when ctx is done the dial, the wait
+// before retrying or the connection is closed and ctx.Err() is returned.
+func (c *TCPClient) DialAndServeContext(ctx context.Context, handler TCPHandler, codec Codec) error {
 	if c.isClosed() {
 		return ErrClientClosed
 	}
@@ -52,55 +59,97 @@ func (c *TCPClient) DialAndServe(handler TCPHandler, codec Codec) error {
 		codec = DefaultCodec
 	}
 
-	var tempDelay time.Duration // how long to sleep on connect failure
+	ctx, cancel := clientContext(ctx, c.done, c.closeConnection)
+	defer cancel()
+	retrier := newRetrier(&c.opts)
 	for {
-		conn, err := dialTCP(c.addr)
+		connection, err := c.dial(ctx)
 		if err != nil {
 			if c.isClosed() {
 				return ErrClientClosed
 			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			if !c.retry {
 				return err
 			}
-
-			if tempDelay == 0 {
-				tempDelay = 1 * time.Second
-			} else {
-				tempDelay *= 2
+			delay, ok := retrier.next(err)
+			if !ok {
+				return err
 			}
-			if max := 1 * time.Minute; tempDelay > max {
-				tempDelay = max
+			log.Printf("network: TCPClient dial error: %v; retrying in %v", err, delay)
+			if !sleep(ctx, delay) {
+				if c.isClosed() {
+					return ErrClientClosed
+				}
+				return ctx.Err()
 			}
-			log.Printf("network: TCPClient dial error: %v; retrying in %v", err, tempDelay)
-			time.Sleep(tempDelay)
 			continue
 		}
-		tempDelay = 0
+		retrier.reset()
 
-		connection := newTCPConnection(conn)
-		if err := c.newConnection(connection); err != nil {
+		if err := c.newConnection(ctx, connection); err != nil {
 			connection.Close()
 			return err
 		}
 		if err := c.serveConnection(connection, handler, codec); err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 	}
 }
 
+func (c *TCPClient) dial(ctx context.Context) (*TCPConnection, error) {
+	conn, err := dial(ctx, c.network, c.addr, &c.opts)
+	if err != nil {
+		return nil, err
+	}
+	if c.opts.tlsConfig == nil {
+		return newTCPConnection(conn, &c.opts), nil
+	}
+	tlsConn := tls.Client(conn, c.tlsConfig())
+	ctx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	return newTCPConnection(tlsConn, &c.opts), nil
+}
+
+func (c *TCPClient) tlsConfig() *tls.Config {
+	config := c.opts.tlsConfig
+	if config.ServerName != "" || config.InsecureSkipVerify {
+		return config
+	}
+	host, _, err := net.SplitHostPort(c.addr)
+	if err != nil {
+		return config
+	}
+	config = config.Clone()
+	config.ServerName = host
+	return config
+}
+
 func (c *TCPClient) isClosed() bool {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 	return c.closed
 }
 
-func (c *TCPClient) newConnection(connection *TCPConnection) error {
+func (c *TCPClient) newConnection(ctx context.Context, connection *TCPConnection) error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
 	if c.closed {
 		return ErrClientClosed
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	c.connection = connection
 	return nil
 }
@@ -136,9 +185,21 @@ func (c *TCPClient) Close() {
 		return
 	}
 	c.closed = true
+	close(c.done)
 	if c.connection == nil {
 		return
 	}
-	c.connection.Close()
+	c.connection.closeWithReason(CloseReason{CloseServer, ErrClientClosed})
 	c.connection = nil
 }
+
+// closeConnection closes the connection when the context of
+// DialAndServeContext is done.
+func (c *TCPClient) closeConnection(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.connection != nil {
+		c.connection.closeWithReason(CloseReason{CloseServer, err})
+	}
+}
@@ -2,71 +2,164 @@ package network
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"log"
 	"net"
 	"runtime"
 	"sync"
 	"time"
+
+	"github.com/iakud/plume/eventloop"
 )
 
 var (
 	ErrConnectionPendingSendFull = errors.New("network: Connection pending send full")
+	ErrConnectionClosed          = errors.New("network: Connection closed")
+	ErrReadIdleTimeout           = errors.New("network: read idle timeout")
+	ErrWriteIdleTimeout          = errors.New("network: write idle timeout")
 )
 
+const tlsHandshakeTimeout = 10 * time.Second
+
 type TCPConnection struct {
-	conn *net.TCPConn
+	conn      net.Conn
+	readIdle  time.Duration
+	writeIdle *writeIdle
+	heartbeat *heartbeat
+
+	loop    *eventloop.EventLoop
+	queue   *sendQueue
+	metrics *Metrics
 
-	bufs        [][]byte
-	pendingSend int
-	mutex       sync.Mutex
-	cond        *sync.Cond
-	closed      bool
+	admission *Admission
+	limiter   *tokenBucket
+	recorder  *Recorder
+
+	mutex  sync.Mutex
+	reason CloseReason
+	hooks  closeHooks
 
 	Userdata interface{}
 }
 
-func newTCPConnection(conn *net.TCPConn) *TCPConnection {
+func newTCPConnection(conn net.Conn, opts *options) *TCPConnection {
 	connection := &TCPConnection{
-		conn: conn,
+		conn:      conn,
+		readIdle:  opts.readIdleTimeout,
+		heartbeat: opts.heartbeat,
+		loop:      opts.loops.get(conn.RemoteAddr()),
+		metrics:   opts.metrics,
+		recorder:  opts.recorder,
+	}
+	connection.queue = newSendQueue(ErrConnectionPendingSendFull, connection.handleSlow)
+	connection.queue.setBackpressure(opts.backpressure)
+	connection.queue.metrics = opts.metrics
+	var ping func()
+	if opts.heartbeat != nil {
+		ping = connection.sendHeartbeat
 	}
-	connection.cond = sync.NewCond(&connection.mutex)
+	connection.writeIdle = newWriteIdle(opts.writeIdleTimeout, ping)
 	return connection
 }
 
 func (c *TCPConnection) serve(handler TCPHandler, codec Codec) {
+	defer c.hooks.run()
 	defer func() {
 		if err := recover(); err != nil {
 			const size = 64 << 10
 			buf := make([]byte, size)
 			buf = buf[:runtime.Stack(buf, false)]
 			log.Printf("network: panic serving %v: %v\n%s", c.RemoteAddr(), err, buf)
-			c.Close()
+			c.closeWithReason(panicCloseReason(err))
 		}
 	}()
 
+	c.metrics.connect()
+	defer func() { c.metrics.disconnect(c.CloseReason()) }()
+	if err := c.handshake(); err != nil {
+		log.Printf("network: TLS handshake error from %v: %v", c.RemoteAddr(), err)
+		c.closeWithReason(readCloseReason(err))
+		return
+	}
+	codec, closeRecord := c.recorder.codec(c, codec)
+	defer closeRecord()
 	// start write
 	c.startBackgroundWrite(codec)
 	defer c.stopBackgroundWrite()
+	c.writeIdle.start()
+	defer c.writeIdle.stop()
 	// conn event
-	handler.Connect(c, true)
-	defer handler.Connect(c, false)
+	c.runInLoop(func() { handler.Connect(c, true) })
+	defer c.runInLoopWait(func() { handler.Connect(c, false) })
+	c.readLoop(handler, codec)
+}
+
+func (c *TCPConnection) readLoop(handler TCPHandler, codec Codec) {
+	defer func() {
+		if err := recover(); err != nil {
+			const size = 64 << 10
+			buf := make([]byte, size)
+			buf = buf[:runtime.Stack(buf, false)]
+			log.Printf("network: panic serving %v: %v\n%s", c.RemoteAddr(), err, buf)
+			c.closeWithReason(panicCloseReason(err))
+		}
+	}()
+
 	// loop read
 	r := bufio.NewReader(c.conn)
 	for {
+		if c.readIdle > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.readIdle))
+		}
 		b, err := codec.Read(r)
 		if err != nil {
-			c.Close()
+			c.closeWithReason(readCloseReason(err))
+			return
+		}
+		if !c.limiter.allow() {
+			c.admission.overMessageRate(c.RemoteAddr())
+			c.closeWithReason(CloseReason{CloseRateLimit, ErrMessageRate})
 			return
 		}
-		handler.Receive(c, b)
+		c.metrics.received(len(b))
+		if c.heartbeat.receive(b, c.Send) {
+			continue
+		}
+		c.metrics.receivedMessage()
+		c.runInLoop(func() { handler.Receive(c, b) })
+	}
+}
+
+// runInLoop calls the handler on the connection loop, if any.
+func (c *TCPConnection) runInLoop(f func()) {
+	runInLoop(c.loop, c.RemoteAddr(), c.closeWithReason, f)
+}
+
+func (c *TCPConnection) runInLoopWait(f func()) {
+	runInLoopWait(c.loop, c.RemoteAddr(), c.closeWithReason, f)
+}
+
+func (c *TCPConnection) sendHeartbeat() {
+	c.Send(c.heartbeat.ping)
+}
+
+func (c *TCPConnection) handshake() error {
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return err
 	}
+	return tlsConn.SetDeadline(time.Time{})
 }
 
 func (c *TCPConnection) startBackgroundWrite(codec Codec) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	if c.closed {
+	if c.queue.isClosed() {
 		return
 	}
 	go c.backgroundWrite(codec)
@@ -79,57 +172,109 @@ func (c *TCPConnection) backgroundWrite(codec Codec) {
 			buf := make([]byte, size)
 			buf = buf[:runtime.Stack(buf, false)]
 			log.Printf("network: panic serving %v: %v\n%s", c.RemoteAddr(), err, buf)
-			c.Close()
+			c.closeWithReason(panicCloseReason(err))
 		}
 	}()
 
 	// loop write
-	w := bufio.NewWriter(c.conn)
+	write := c.bufferedWriter(codec)
+	if headerCodec, ok := codec.(HeaderCodec); ok {
+		if conn := vectoredConn(c.conn); conn != nil {
+			write = c.vectoredWriter(conn, headerCodec)
+		}
+	}
 	for closed := false; !closed; {
-		var bufs [][]byte
+		var bufs []outgoing
+		bufs, closed = c.queue.take()
 
-		c.mutex.Lock()
-		for !c.closed && len(c.bufs) == 0 {
-			c.cond.Wait()
+		if c.writeIdle != nil {
+			c.conn.SetWriteDeadline(time.Now().Add(c.writeIdle.timeout))
 		}
-		bufs, c.bufs = c.bufs, bufs // swap
-		closed = c.closed
-		c.mutex.Unlock()
-
-		for _, b := range bufs {
-			if err := codec.Write(w, b); err != nil {
-				c.closeWrite()
-				c.Close()
-				return
-			}
+		start := time.Now()
+		err := write(bufs)
+		if err == nil {
+			c.metrics.written(bufs, time.Since(start))
 		}
-		if err := w.Flush(); err != nil {
+		releaseAll(bufs)
+		if err != nil {
 			c.closeWrite()
-			c.Close()
+			releaseAll(c.queue.discard())
+			c.closeWithReason(writeCloseReason(err))
 			return
 		}
+		c.writeIdle.written()
 	}
 	// not writing now
-	c.conn.CloseWrite() // only SHUT_WR
+	shutdownWrite(c.conn) // only SHUT_WR
 }
 
-func (c *TCPConnection) stopBackgroundWrite() {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	if c.closed {
-		return
+func (c *TCPConnection) bufferedWriter(codec Codec) func([]outgoing) error {
+	w := bufio.NewWriter(c.conn)
+	return func(bufs []outgoing) error {
+		for _, o := range bufs {
+			if err := codec.Write(w, o.b); err != nil {
+				return err
+			}
+		}
+		return w.Flush()
 	}
-	c.closed = true
-	c.cond.Signal()
 }
 
-func (c *TCPConnection) closeWrite() {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	if c.closed {
-		return
+// vectoredConn returns the socket under conn, such as a PROXY protocol one,
+// when writev can be used on it, nil otherwise. TLS records are not unwrapped.
+func vectoredConn(conn net.Conn) net.Conn {
+	if _, ok := conn.(*tls.Conn); ok {
+		return nil
+	}
+	switch conn := netConn(conn).(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return conn
+	}
+	return nil
+}
+
+// vectoredWriter writes the frames to conn with writev, messages smaller than
+// smallWriteSize are copied next to their headers instead of taking an iovec.
+func (c *TCPConnection) vectoredWriter(conn net.Conn, codec HeaderCodec) func([]outgoing) error {
+	const smallWriteSize = 1024
+	var scratch []byte
+	var buffers net.Buffers
+	return func(bufs []outgoing) error {
+		scratch, buffers = scratch[:0], buffers[:0]
+		start := 0
+		for _, o := range bufs {
+			var err error
+			if scratch, err = codec.AppendHeader(scratch, o.b); err != nil {
+				return err
+			}
+			if len(o.b) < smallWriteSize {
+				scratch = append(scratch, o.b...)
+				continue
+			}
+			if start < len(scratch) {
+				buffers = append(buffers, scratch[start:])
+				start = len(scratch)
+			}
+			buffers = append(buffers, o.b)
+		}
+		if start < len(scratch) {
+			buffers = append(buffers, scratch[start:])
+		}
+		v := buffers // WriteTo consumes v
+		_, err := v.WriteTo(conn)
+		for i := range buffers {
+			buffers[i] = nil
+		}
+		return err
 	}
-	c.closed = true
+}
+
+func (c *TCPConnection) stopBackgroundWrite() {
+	c.queue.close()
+}
+
+func (c *TCPConnection) closeWrite() {
+	c.queue.close()
 }
 
 func (c *TCPConnection) LocalAddr() net.Addr {
@@ -140,41 +285,162 @@ func (c *TCPConnection) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
 
+// Loop returns the event loop Connect and Receive are called on, nil when
+// they are called on the read goroutine.
+func (c *TCPConnection) Loop() *eventloop.EventLoop {
+	return c.loop
+}
+
 func (c *TCPConnection) SetNoDelay(noDelay bool) error {
-	return c.conn.SetNoDelay(noDelay)
+	tcpConn, ok := netConn(c.conn).(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	return tcpConn.SetNoDelay(noDelay)
 }
 
+// ConnectionState returns the TLS state, ok is false on plain connections.
+func (c *TCPConnection) ConnectionState() (state tls.ConnectionState, ok bool) {
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return tlsConn.ConnectionState(), true
+}
+
+func (c *TCPConnection) PeerCertificates() []*x509.Certificate {
+	state, ok := c.ConnectionState()
+	if !ok {
+		return nil
+	}
+	return state.PeerCertificates
+}
+
+// SetPendingSend limits the number of messages pending send, see
+// SetBackpressure.
 func (c *TCPConnection) SetPendingSend(pendingSend int) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	c.pendingSend = pendingSend
+	c.queue.setPendingSend(pendingSend)
+}
+
+func (c *TCPConnection) SetBackpressure(backpressure Backpressure) {
+	c.queue.setBackpressure(backpressure)
+}
+
+func (c *TCPConnection) SendStats() SendStats {
+	return c.queue.stats()
 }
 
 func (c *TCPConnection) Send(b []byte) error {
-	if len(b) == 0 {
+	return c.SendContext(context.Background(), b)
+}
+
+// SendBuffer sends buffer.B and takes over the caller's reference to buffer,
+// it is released once written or dropped.
+func (c *TCPConnection) SendBuffer(buffer *Buffer) error {
+	if len(buffer.B) == 0 {
+		buffer.Release()
 		return nil
 	}
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	if c.closed {
+	return c.queue.push(context.Background(), outgoing{b: buffer.B, buffer: buffer})
+}
+
+// sendOpen is Send failing with ErrConnectionClosed once the connection is
+// closed or shut down, instead of dropping b.
+func (c *TCPConnection) sendOpen(b []byte) error {
+	return c.queue.pushOrFail(context.Background(), outgoing{b: b}, ErrConnectionClosed)
+}
+
+// SendContext is Send, ctx bounds the wait when the OverflowBlock policy is
+// used.
+func (c *TCPConnection) SendContext(ctx context.Context, b []byte) error {
+	if len(b) == 0 {
 		return nil
 	}
-	if c.pendingSend > 0 && len(c.bufs) >= c.pendingSend {
-		return ErrConnectionPendingSendFull
-	}
-	c.bufs = append(c.bufs, b)
-	c.cond.Signal()
-	return nil
+	return c.queue.push(ctx, outgoing{b: b})
+}
+
+func (c *TCPConnection) handleSlow() {
+	c.closeWithReason(CloseReason{CloseSlowConsumer, ErrSlowConsumer})
 }
 
 func (c *TCPConnection) Shutdown() {
 	c.stopBackgroundWrite() // stop write
 }
 
+// shutdown records reason for the connection closed after it is drained.
+func (c *TCPConnection) shutdown(reason CloseReason) {
+	c.mutex.Lock()
+	if c.reason.Cause == CloseNone {
+		c.reason = reason
+	}
+	c.mutex.Unlock()
+	c.Shutdown()
+}
+
 func (c *TCPConnection) Close() {
+	c.closeWithReason(CloseReason{CloseLocal, ErrConnectionClosed})
+}
+
+func (c *TCPConnection) closeWithReason(reason CloseReason) {
+	c.mutex.Lock()
+	if c.reason.Cause == CloseNone {
+		c.reason = reason
+	}
+	c.mutex.Unlock()
 	c.conn.Close()
 }
 
+// CloseReason returns why the connection was closed, it is set before the
+// disconnect event.
+func (c *TCPConnection) CloseReason() CloseReason {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.reason
+}
+
+// Err returns the error of CloseReason: ErrConnectionClosed after Close,
+// io.EOF when the peer closed it, ErrReadIdleTimeout, ErrWriteIdleTimeout, or
+// the read, write or codec error.
+func (c *TCPConnection) Err() error {
+	return c.CloseReason().Err
+}
+
 func (c *TCPConnection) CloseWithTimeout(timeout time.Duration) {
 	time.AfterFunc(timeout, c.Close)
 }
+
+func (c *TCPConnection) GetUserdata() interface{} {
+	return c.Userdata
+}
+
+func (c *TCPConnection) SetUserdata(userdata interface{}) {
+	c.Userdata = userdata
+}
+
+// netConn unwraps conn down to the socket.
+func netConn(conn net.Conn) net.Conn {
+	for {
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return conn
+		}
+		conn = wrapper.NetConn()
+	}
+}
+
+// shutdownWrite sends TLS close_notify if needed and shuts down the writing
+// side of the socket.
+func shutdownWrite(conn net.Conn) error {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.CloseWrite()
+	}
+	closeWriter, ok := netConn(conn).(interface{ CloseWrite() error })
+	if !ok {
+		return nil
+	}
+	return closeWriter.CloseWrite()
+}
+
+func (c *TCPConnection) onClose(f func()) (remove func(), ok bool) {
+	return c.hooks.add(f)
+}
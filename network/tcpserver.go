@@ -1,6 +1,8 @@
 package network
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"log"
 	"net"
@@ -13,17 +15,27 @@ var (
 )
 
 type TCPServer struct {
-	addr string
+	network string
+	addr    string
+	opts    options
 
 	mutex       sync.Mutex
-	listener    *net.TCPListener
+	listeners   []net.Listener
+	handover    *net.UnixListener
+	handedOver  bool
 	connections map[*TCPConnection]struct{}
+	proxyConns  map[net.Conn]struct{} // reading the PROXY protocol header
 	closed      bool
+	drained     chan struct{}
 }
 
-func NewTCPServer(addr string) *TCPServer {
+func NewTCPServer(addr string, opt ...Option) *TCPServer {
 	server := &TCPServer{
-		addr: addr,
+		network: "tcp",
+		addr:    addr,
+	}
+	for _, o := range opt {
+		o(&server.opts)
 	}
 	return server
 }
@@ -39,18 +51,52 @@ func listenTCP(addr string) (*net.TCPListener, error) {
 	return net.ListenTCP("tcp", laddr)
 }
 
+func (s *TCPServer) listen() ([]net.Listener, error) {
+	if s.opts.handover != "" {
+		lns, err := receiveListeners(s.opts.handover)
+		if err != errNoHandover {
+			return lns, err
+		}
+	}
+	if s.opts.listen != nil {
+		ln, err := s.opts.listen(s.addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+	if s.network == "unix" {
+		ln, err := listenUnix(s.addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+	if s.opts.reusePort > 0 {
+		return listenReusePort(s.addr, s.opts.reusePort)
+	}
+	ln, err := listenTCP(s.addr)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{ln}, nil
+}
+
+// ListenAndServe accepts on each listener in its own goroutine, see
+// WithReusePort. With WithHandover it returns ErrServerHandedOver once the
+// listeners are handed over, the connections are still served.
 func (s *TCPServer) ListenAndServe(handler TCPHandler, codec Codec) error {
 	if s.isClosed() {
 		return ErrServerClosed
 	}
-	ln, err := listenTCP(s.addr)
+	lns, err := s.listen()
 	if err != nil {
 		return err
 	}
 
-	defer ln.Close()
+	defer closeListeners(lns)
 
-	if err := s.newListener(ln); err != nil {
+	if err := s.newListeners(lns); err != nil {
 		return err
 	}
 
@@ -61,13 +107,42 @@ func (s *TCPServer) ListenAndServe(handler TCPHandler, codec Codec) error {
 		codec = DefaultCodec
 	}
 
+	if s.opts.handover != "" {
+		if err := s.listenHandover(s.opts.handover); err != nil {
+			return err
+		}
+	}
+
+	errc := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func(ln net.Listener) { errc <- s.serve(ln, handler, codec) }(ln)
+	}
+	err = <-errc
+	// stop the other accept goroutines
+	closeListeners(lns)
+	for i := 1; i < len(lns); i++ {
+		<-errc
+	}
+	return err
+}
+
+func closeListeners(lns []net.Listener) {
+	for _, ln := range lns {
+		ln.Close()
+	}
+}
+
+func (s *TCPServer) serve(ln net.Listener, handler TCPHandler, codec Codec) error {
 	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
-		conn, err := ln.AcceptTCP()
+		conn, err := ln.Accept()
 		if err != nil {
 			if s.isClosed() {
 				return ErrServerClosed
 			}
+			if s.isHandedOver() {
+				return ErrServerHandedOver
+			}
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
 					tempDelay = 5 * time.Millisecond
@@ -86,15 +161,72 @@ func (s *TCPServer) ListenAndServe(handler TCPHandler, codec Codec) error {
 		}
 		tempDelay = 0
 
-		connection := newTCPConnection(conn)
+		if s.opts.proxy != nil && s.opts.proxy.isTrusted(conn.RemoteAddr()) {
+			if err := s.opts.admission.reserve(conn.RemoteAddr()); err != nil {
+				conn.Close()
+				continue
+			}
+			if err := s.newProxyConn(conn); err != nil {
+				conn.Close()
+				s.opts.admission.unreserve()
+				return err
+			}
+			go s.serveProxy(conn, handler, codec)
+			continue
+		}
+		if err := s.opts.admission.admit(conn.RemoteAddr()); err != nil {
+			conn.Close()
+			continue
+		}
+		connection := s.newTCPConnection(conn)
 		if err := s.newConnection(connection); err != nil {
 			connection.Close() // close
+			s.opts.admission.release(conn.RemoteAddr())
 			return err
 		}
 		go s.serveConnection(connection, handler, codec)
 	}
 }
 
+func (s *TCPServer) newTCPConnection(conn net.Conn) *TCPConnection {
+	if s.opts.tlsConfig != nil {
+		conn = tls.Server(conn, s.opts.tlsConfig)
+	}
+	connection := newTCPConnection(conn, &s.opts)
+	connection.admission = s.opts.admission
+	connection.limiter = s.opts.admission.messageLimiter()
+	return connection
+}
+
+// serveProxy reads the PROXY protocol header before serving conn, so that
+// the connection is created with the client address. conn was reserved by
+// the admission.
+func (s *TCPServer) serveProxy(conn net.Conn, handler TCPHandler, codec Codec) {
+	netConn, err := s.opts.proxy.accept(conn)
+	if err != nil {
+		if !s.isClosed() {
+			log.Printf("network: PROXY protocol error from %v: %v", conn.RemoteAddr(), err)
+		}
+		conn.Close()
+		s.opts.admission.unreserve()
+		s.removeProxyConn(conn)
+		return
+	}
+	if err := s.opts.admission.admitReserved(netConn.RemoteAddr()); err != nil {
+		conn.Close()
+		s.opts.admission.unreserve()
+		s.removeProxyConn(conn)
+		return
+	}
+	connection := s.newTCPConnection(netConn)
+	if err := s.promoteProxyConn(conn, connection); err != nil {
+		connection.Close()
+		s.opts.admission.release(netConn.RemoteAddr())
+		return
+	}
+	s.serveConnection(connection, handler, codec)
+}
+
 func (s *TCPServer) isClosed() bool {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -102,18 +234,29 @@ func (s *TCPServer) isClosed() bool {
 	return s.closed
 }
 
-func (s *TCPServer) newListener(ln *net.TCPListener) error {
+func (s *TCPServer) newListeners(lns []net.Listener) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
 	if s.closed {
 		return ErrServerClosed
 	}
-	s.listener = ln
+	s.listeners = lns
 	s.connections = make(map[*TCPConnection]struct{})
+	s.proxyConns = make(map[net.Conn]struct{})
 	return nil
 }
 
+// closeListeners stops accepting and serving handovers, s.mutex is held.
+func (s *TCPServer) closeListeners() {
+	closeListeners(s.listeners)
+	s.listeners = nil
+	if s.handover != nil {
+		s.handover.Close()
+		s.handover = nil
+	}
+}
+
 func (s *TCPServer) newConnection(connection *TCPConnection) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -125,16 +268,63 @@ func (s *TCPServer) newConnection(connection *TCPConnection) error {
 	return nil
 }
 
+func (s *TCPServer) newProxyConn(conn net.Conn) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return ErrServerClosed
+	}
+	s.proxyConns[conn] = struct{}{}
+	return nil
+}
+
+func (s *TCPServer) removeProxyConn(conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.proxyConns, conn)
+	s.checkDrained()
+}
+
+// promoteProxyConn replaces conn, its header read, with connection.
+func (s *TCPServer) promoteProxyConn(conn net.Conn, connection *TCPConnection) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.proxyConns, conn)
+	if s.closed {
+		s.checkDrained()
+		return ErrServerClosed
+	}
+	s.connections[connection] = struct{}{}
+	return nil
+}
+
 func (s *TCPServer) serveConnection(connection *TCPConnection, handler TCPHandler, codec Codec) {
 	connection.serve(handler, codec)
+	s.opts.admission.release(connection.RemoteAddr())
 	// remove connection
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	if s.closed {
-		return
-	}
 	delete(s.connections, connection)
+	s.checkDrained()
+}
+
+// checkDrained ends a Shutdown waiting for the connections, s.mutex is held.
+func (s *TCPServer) checkDrained() {
+	if s.drained != nil && len(s.connections) == 0 && len(s.proxyConns) == 0 {
+		close(s.drained)
+		s.drained = nil
+	}
+}
+
+// closeProxyConns fails the header reads, s.mutex is held.
+func (s *TCPServer) closeProxyConns() {
+	for conn := range s.proxyConns {
+		conn.Close()
+	}
 }
 
 func (s *TCPServer) Close() {
@@ -145,13 +335,52 @@ func (s *TCPServer) Close() {
 		return
 	}
 	s.closed = true
-	if s.listener == nil {
-		return
-	}
-	s.listener.Close()
-	s.listener = nil
+	s.closeListeners()
+	s.closeProxyConns()
 	for connection := range s.connections {
-		connection.Close()
+		connection.closeWithReason(CloseReason{CloseServer, ErrServerClosed})
 		delete(s.connections, connection)
 	}
 }
+
+// Shutdown stops accepting and shuts down every connection, so that pending
+// sends are flushed before the write side is closed. It waits for the
+// connections to be closed and their disconnect events to return, when ctx
+// is done first the remaining connections are closed and ctx.Err() is
+// returned. It reports how many connections were drained and force closed.
+// Connections reading the PROXY protocol header are closed.
+func (s *TCPServer) Shutdown(ctx context.Context) (drained int, forced int, err error) {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return 0, 0, ErrServerClosed
+	}
+	s.closed = true
+	s.closeListeners()
+	s.closeProxyConns()
+	total := len(s.connections)
+	done := make(chan struct{})
+	if total == 0 && len(s.proxyConns) == 0 {
+		close(done)
+	} else {
+		s.drained = done
+	}
+	for connection := range s.connections {
+		connection.shutdown(CloseReason{CloseServer, ErrServerClosed})
+	}
+	s.mutex.Unlock()
+
+	select {
+	case <-done:
+		return total, 0, nil
+	case <-ctx.Done():
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	forced = len(s.connections)
+	for connection := range s.connections {
+		connection.closeWithReason(CloseReason{CloseServer, ErrServerClosed})
+	}
+	return total - forced, forced, ctx.Err()
+}
@@ -0,0 +1,151 @@
+package network_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/iakud/plume/network"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "plume test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+func (ca *testCA) issue(t *testing.T, commonName string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+type tlsEchoServer struct {
+	peers chan string
+}
+
+func (srv *tlsEchoServer) Connect(connection *network.TCPConnection, connected bool) {
+	if !connected {
+		return
+	}
+	var peer string
+	if certs := connection.PeerCertificates(); len(certs) > 0 {
+		peer = certs[0].Subject.CommonName
+	}
+	srv.peers <- peer
+}
+
+func (srv *tlsEchoServer) Receive(connection *network.TCPConnection, b []byte) {
+	connection.Send(b)
+}
+
+type tlsEchoClient struct {
+	client *network.TCPClient
+	reply  string
+	server string
+}
+
+func (c *tlsEchoClient) Connect(connection *network.TCPConnection, connected bool) {
+	if !connected {
+		return
+	}
+	if certs := connection.PeerCertificates(); len(certs) > 0 {
+		c.server = certs[0].Subject.CommonName
+	}
+	connection.Send([]byte("hello"))
+}
+
+func (c *tlsEchoClient) Receive(connection *network.TCPConnection, b []byte) {
+	c.reply = string(b)
+	c.client.Close()
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCA(t)
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "server")},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}
+	srv := &tlsEchoServer{peers: make(chan string, 2)}
+	server := network.NewTCPServer("localhost:8004", network.WithTLSConfig(serverConfig))
+	go server.ListenAndServe(srv, nil)
+	defer server.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	clientConfig := &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "client")},
+		RootCAs:      ca.pool,
+	}
+	c := &tlsEchoClient{client: network.NewTCPClient("localhost:8004", network.WithTLSConfig(clientConfig))}
+	if err := c.client.DialAndServe(c, nil); err != network.ErrClientClosed {
+		t.Fatal(err)
+	}
+	if c.reply != "hello" || c.server != "server" {
+		t.Fatalf("reply %q from %q", c.reply, c.server)
+	}
+	if peer := <-srv.peers; peer != "client" {
+		t.Fatalf("server peer %q", peer)
+	}
+
+	// clients without a certificate never reach the handler
+	clientConfig = &tls.Config{RootCAs: ca.pool}
+	c = &tlsEchoClient{client: network.NewTCPClient("localhost:8004", network.WithTLSConfig(clientConfig))}
+	go c.client.DialAndServe(c, nil)
+	defer c.client.Close()
+	select {
+	case peer := <-srv.peers:
+		t.Fatalf("unauthenticated client %q connected", peer)
+	case <-time.After(time.Millisecond * 200):
+	}
+}
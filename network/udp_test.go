@@ -0,0 +1,156 @@
+package network_test
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/iakud/plume/network"
+	"github.com/iakud/plume/network/memnet"
+)
+
+func TestUDPSessions(t *testing.T) {
+	server := network.NewUDPServer("localhost:8021")
+	go server.ListenAndServe(network.AsUDPHandler(sessionServer{}))
+	defer server.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	// each client has its own session count
+	for i := 0; i < 2; i++ {
+		c := &sessionClient{received: make(chan []byte, 2)}
+		client := network.NewUDPClient("localhost:8021")
+		go client.DialAndServe(network.AsUDPHandler(c))
+		defer client.Close()
+		c.wait(t)
+	}
+}
+
+type arqEcho struct{}
+
+func (arqEcho) Connect(*network.UDPConnection, bool) {}
+
+func (arqEcho) Receive(conn *network.UDPConnection, b []byte) {
+	conn.Send(b)
+}
+
+type arqClient struct {
+	count    int
+	received chan []byte
+}
+
+func (c *arqClient) Connect(conn *network.UDPConnection, connected bool) {
+	if !connected {
+		return
+	}
+	for i := 0; i < c.count; i++ {
+		// sizes up to several segments
+		b := make([]byte, 4+i*37%3000)
+		binary.BigEndian.PutUint32(b, uint32(i))
+		if err := conn.Send(b); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (c *arqClient) Receive(conn *network.UDPConnection, b []byte) {
+	c.received <- b
+}
+
+func TestUDPARQ(t *testing.T) {
+	a, b := memnet.NewPacketLink(memnet.LinkConfig{
+		Loss:    0.2,
+		Reorder: 0.2,
+		Latency: time.Millisecond,
+		Jitter:  time.Millisecond * 5,
+		Seed:    1,
+	})
+	config := network.ARQConfig{
+		NoDelay:      true,
+		Interval:     time.Millisecond * 10,
+		Resend:       2,
+		NoCongestion: true,
+		MTU:          512,
+	}
+	server := network.NewUDPServer("", network.WithARQ(config))
+	go server.Serve(a, arqEcho{})
+	defer server.Close()
+
+	c := &arqClient{count: 200, received: make(chan []byte, 200)}
+	client := network.NewUDPClient("", network.WithARQ(config))
+	go client.Serve(b, a.LocalAddr(), c)
+	defer client.Close()
+
+	for i := 0; i < c.count; i++ {
+		select {
+		case b := <-c.received:
+			if n := binary.BigEndian.Uint32(b); n != uint32(i) || len(b) != 4+i*37%3000 {
+				t.Fatalf("received message %d of %d bytes, want %d", n, len(b), i)
+			}
+		case <-time.After(time.Second * 10):
+			t.Fatalf("timeout after %d messages", i)
+		}
+	}
+}
+
+func TestUDPMessageTooLarge(t *testing.T) {
+	a, b := memnet.NewPacketLink(memnet.LinkConfig{})
+	defer a.Close()
+	server := network.NewUDPServer("")
+	go server.Serve(b, nil)
+	defer server.Close()
+
+	sent := make(chan error, 1)
+	client := network.NewUDPClient("", network.WithARQ(network.ARQConfig{MTU: 100, ReceiveWindow: 8}))
+	go client.Serve(a, b.LocalAddr(), network.AsUDPHandler(&sendHandler{sent: sent, b: make([]byte, 1000)}))
+	defer client.Close()
+	select {
+	case err := <-sent:
+		if err != network.ErrUDPMessageTooLarge {
+			t.Fatalf("send error %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+type sendHandler struct {
+	sent chan error
+	b    []byte
+}
+
+func (h *sendHandler) Connect(conn network.Conn, connected bool) {
+	if connected {
+		h.sent <- conn.Send(h.b)
+	}
+}
+
+func (h *sendHandler) Receive(network.Conn, []byte) {}
+
+func TestUDPClientBackoff(t *testing.T) {
+	// no server, every session closes on the read idle timeout
+	attempts := make(chan int, 16)
+	client := network.NewUDPClient("localhost:8034",
+		network.WithReadIdleTimeout(time.Millisecond*10),
+		network.WithBackoff(network.ExponentialBackoff{Initial: time.Millisecond * 50, MaxAttempts: 2}),
+		network.WithRetryCallback(func(attempt int, delay time.Duration, err error) { attempts <- attempt }),
+	)
+	start := time.Now()
+	if err := client.DialAndServe(nil); err != network.ErrReadIdleTimeout {
+		t.Fatalf("serve: %v, want ErrReadIdleTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*150 {
+		t.Fatalf("sessions restarted in %v", elapsed)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("%d retries, want 2", len(attempts))
+	}
+}
+
+func TestARQMTU(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("no panic")
+		}
+	}()
+	network.NewUDPClient("", network.WithARQ(network.ARQConfig{MTU: 24}))
+}
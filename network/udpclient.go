@@ -0,0 +1,195 @@
+package network
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrUDPClientClosed = errors.New("network: UDP client closed")
+)
+
+// UDPClient serves a UDPConnection with the server at addr, a new session
+// with a new local port is started when one is closed. Sessions are started
+// again after the delays of WithBackoff, counted from the last session that
+// received from the server.
+type UDPClient struct {
+	addr string
+	opts options
+	done chan struct{}
+
+	mutex      sync.Mutex
+	connection *UDPConnection
+	closed     bool
+}
+
+func NewUDPClient(addr string, opt ...Option) *UDPClient {
+	client := &UDPClient{
+		addr: addr,
+		done: make(chan struct{}),
+	}
+	for _, o := range opt {
+		o(&client.opts)
+	}
+	return client
+}
+
+func (c *UDPClient) DialAndServe(handler UDPHandler) error {
+	if c.isClosed() {
+		return ErrUDPClientClosed
+	}
+	raddr, err := net.ResolveUDPAddr("udp", c.addr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := clientContext(context.Background(), c.done, nil)
+	defer cancel()
+	retrier := newRetrier(&c.opts)
+	for {
+		conn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			return err
+		}
+		var received int32
+		connection, err := c.serve(conn, raddr, handler, &received)
+		if err != nil {
+			return err
+		}
+		if atomic.LoadInt32(&received) != 0 {
+			retrier.reset()
+		}
+		delay, ok := retrier.next(connection.Err())
+		if !ok {
+			return connection.Err()
+		}
+		log.Printf("network: UDPClient session closed: %v; restarting in %v", connection.Err(), delay)
+		if !sleep(ctx, delay) {
+			return ErrUDPClientClosed
+		}
+	}
+}
+
+// Serve serves one session with raddr over conn, datagrams from other
+// addresses are ignored. It closes conn when the session is closed.
+func (c *UDPClient) Serve(conn net.PacketConn, raddr net.Addr, handler UDPHandler) error {
+	_, err := c.serve(conn, raddr, handler, nil)
+	return err
+}
+
+// serve is Serve setting received, if any, once a datagram from raddr is
+// read.
+func (c *UDPClient) serve(conn net.PacketConn, raddr net.Addr, handler UDPHandler, received *int32) (*UDPConnection, error) {
+	defer conn.Close()
+
+	if handler == nil {
+		handler = DefaultUDPHandler
+	}
+
+	var conv uint32
+	if c.opts.arq != nil {
+		conv = newConv()
+	}
+	connection := newUDPConnection(conn, raddr, conv, &c.opts)
+	if err := c.newConnection(connection); err != nil {
+		return nil, err
+	}
+	go c.read(conn, connection, received)
+	return connection, c.serveConnection(connection, handler)
+}
+
+func newConv() uint32 {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return binary.LittleEndian.Uint32(b[:])
+}
+
+func (c *UDPClient) read(conn net.PacketConn, connection *UDPConnection, received *int32) {
+	buf := make([]byte, maxDatagramSize)
+	raddr := connection.RemoteAddr().String()
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			if !connection.isClosed() {
+				log.Printf("network: UDPClient error: %v", err)
+			}
+			connection.closeWithReason(readCloseReason(err))
+			return
+		}
+		if addr.String() != raddr {
+			continue
+		}
+		if received != nil {
+			atomic.StoreInt32(received, 1)
+		}
+		b := make([]byte, n)
+		copy(b, buf[:n])
+		connection.deliver(b)
+	}
+}
+
+func (c *UDPClient) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+func (c *UDPClient) newConnection(connection *UDPConnection) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return ErrUDPClientClosed
+	}
+	c.connection = connection
+	return nil
+}
+
+func (c *UDPClient) serveConnection(connection *UDPConnection, handler UDPHandler) error {
+	connection.serve(handler)
+	// remove connection
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return ErrUDPClientClosed
+	}
+	c.connection = nil
+	return nil
+}
+
+func (c *UDPClient) GetConnection() *UDPConnection {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	return c.connection
+}
+
+func (c *UDPClient) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.done)
+	if c.connection == nil {
+		return
+	}
+	c.connection.closeWithReason(CloseReason{CloseServer, ErrUDPClientClosed})
+	c.connection = nil
+}
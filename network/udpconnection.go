@@ -0,0 +1,458 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/iakud/plume/eventloop"
+)
+
+var (
+	ErrUDPConnectionPendingSendFull = errors.New("network: UDP connection pending send full")
+	ErrUDPMessageTooLarge           = errors.New("network: UDP message too large")
+)
+
+const (
+	// maxDatagramSize is the largest UDP payload over IPv4.
+	maxDatagramSize = 65507
+	// udpSessionTimeout closes sessions without a read idle timeout when
+	// nothing is received within it.
+	udpSessionTimeout = 60 * time.Second
+	// udpInputSize is the number of datagrams queued for a session, more
+	// are dropped.
+	udpInputSize = 256
+)
+
+// UDPConnection is a session with one peer, each datagram is a message or,
+// with WithARQ, a segment of the reliable ordered stream.
+type UDPConnection struct {
+	conn      net.PacketConn
+	addr      net.Addr
+	readIdle  time.Duration
+	writeIdle *writeIdle
+	heartbeat *heartbeat
+
+	input     chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	arq      *arq
+	arqMutex sync.Mutex
+	arqCond  *sync.Cond
+	interval time.Duration
+
+	loop  *eventloop.EventLoop
+	queue *sendQueue
+
+	mutex  sync.Mutex
+	reason CloseReason
+	hooks  closeHooks
+
+	Userdata interface{}
+}
+
+func newUDPConnection(conn net.PacketConn, addr net.Addr, conv uint32, opts *options) *UDPConnection {
+	connection := &UDPConnection{
+		conn:      conn,
+		addr:      addr,
+		readIdle:  opts.readIdleTimeout,
+		heartbeat: opts.heartbeat,
+		input:     make(chan []byte, udpInputSize),
+		closed:    make(chan struct{}),
+		loop:      opts.loops.get(addr),
+	}
+	if connection.readIdle <= 0 {
+		connection.readIdle = udpSessionTimeout
+	}
+	if opts.arq != nil {
+		config := opts.arq.withDefaults()
+		connection.arq = newARQ(conv, config, connection.output)
+		connection.arqCond = sync.NewCond(&connection.arqMutex)
+		connection.interval = config.Interval
+	}
+	connection.queue = newSendQueue(ErrUDPConnectionPendingSendFull, connection.handleSlow)
+	connection.queue.setBackpressure(opts.backpressure)
+	var ping func()
+	if opts.heartbeat != nil {
+		ping = connection.sendHeartbeat
+	}
+	connection.writeIdle = newWriteIdle(opts.writeIdleTimeout, ping)
+	return connection
+}
+
+func (c *UDPConnection) serve(handler UDPHandler) {
+	defer c.hooks.run()
+	defer c.sendFin()
+
+	// start write
+	c.startBackgroundWrite()
+	defer c.stopBackgroundWrite()
+	c.writeIdle.start()
+	defer c.writeIdle.stop()
+	if c.arq != nil {
+		go c.update()
+	}
+	// conn event
+	c.runInLoop(func() { handler.Connect(c, true) })
+	defer c.runInLoopWait(func() { handler.Connect(c, false) })
+	c.readLoop(handler)
+}
+
+func (c *UDPConnection) readLoop(handler UDPHandler) {
+	defer func() {
+		if err := recover(); err != nil {
+			const size = 64 << 10
+			buf := make([]byte, size)
+			buf = buf[:runtime.Stack(buf, false)]
+			log.Printf("network: panic serving %v: %v\n%s", c.RemoteAddr(), err, buf)
+			c.closeWithReason(panicCloseReason(err))
+		}
+	}()
+
+	timer := time.NewTimer(c.readIdle)
+	defer timer.Stop()
+	for {
+		select {
+		case b := <-c.input:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(c.readIdle)
+			if c.arq == nil {
+				c.receive(handler, b)
+				continue
+			}
+			if !c.receiveARQ(handler, b) {
+				c.closeWithReason(CloseReason{ClosePeer, io.EOF})
+				return
+			}
+		case <-timer.C:
+			c.closeWithReason(CloseReason{CloseIdleTimeout, ErrReadIdleTimeout})
+			return
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *UDPConnection) receive(handler UDPHandler, b []byte) {
+	if c.heartbeat.receive(b, c.Send) {
+		return
+	}
+	c.runInLoop(func() { handler.Receive(c, b) })
+}
+
+// receiveARQ delivers the messages completed by segment b, it returns false
+// when the peer closed the connection.
+func (c *UDPConnection) receiveARQ(handler UDPHandler, b []byte) bool {
+	var messages [][]byte
+	c.arqMutex.Lock()
+	if err := c.arq.input(b); err != nil {
+		c.arqMutex.Unlock()
+		return true // ignore invalid segments
+	}
+	for {
+		message, ok := c.arq.recv()
+		if !ok {
+			break
+		}
+		messages = append(messages, message)
+	}
+	fin := c.arq.fin
+	c.arqMutex.Unlock()
+	c.arqCond.Broadcast() // the send window may have opened
+
+	for _, message := range messages {
+		c.receive(handler, message)
+	}
+	return !fin
+}
+
+// update flushes the ARQ state every interval.
+func (c *UDPConnection) update() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.closed:
+			return
+		}
+		c.arqMutex.Lock()
+		c.arq.flush()
+		dead := c.arq.dead
+		c.arqMutex.Unlock()
+		if dead {
+			c.closeWithReason(CloseReason{CloseWriteError, ErrARQDeadLink})
+			return
+		}
+	}
+}
+
+func (c *UDPConnection) output(b []byte) {
+	c.conn.WriteTo(b, c.addr)
+}
+
+// sendFin tells an ARQ peer the connection is closed, unless it closed
+// first.
+func (c *UDPConnection) sendFin() {
+	if c.arq == nil || c.CloseReason().Cause == ClosePeer {
+		return
+	}
+	c.arqMutex.Lock()
+	fin := c.arq.finSegment()
+	c.arqMutex.Unlock()
+	c.output(fin)
+}
+
+// runInLoop calls the handler on the connection loop, if any.
+func (c *UDPConnection) runInLoop(f func()) {
+	runInLoop(c.loop, c.RemoteAddr(), c.closeWithReason, f)
+}
+
+func (c *UDPConnection) runInLoopWait(f func()) {
+	runInLoopWait(c.loop, c.RemoteAddr(), c.closeWithReason, f)
+}
+
+func (c *UDPConnection) sendHeartbeat() {
+	c.Send(c.heartbeat.ping)
+}
+
+// deliver queues a datagram from the peer, it is dropped when the session
+// falls behind.
+func (c *UDPConnection) deliver(b []byte) {
+	select {
+	case c.input <- b:
+	default:
+	}
+}
+
+func (c *UDPConnection) startBackgroundWrite() {
+	if c.queue.isClosed() {
+		return
+	}
+	go c.backgroundWrite()
+}
+
+func (c *UDPConnection) backgroundWrite() {
+	for closed := false; !closed; {
+		var bufs []outgoing
+		bufs, closed = c.queue.take()
+
+		err := c.write(bufs)
+		releaseAll(bufs)
+		if err != nil {
+			c.closeWrite()
+			releaseAll(c.queue.discard())
+			c.closeWithReason(writeCloseReason(err))
+			return
+		}
+		c.writeIdle.written()
+	}
+	// not writing now
+	if c.arq != nil && !c.waitSent() {
+		return
+	}
+	c.Close()
+}
+
+func (c *UDPConnection) write(bufs []outgoing) error {
+	if c.arq == nil {
+		for _, o := range bufs {
+			if _, err := c.conn.WriteTo(o.b, c.addr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	c.arqMutex.Lock()
+	defer c.arqMutex.Unlock()
+	for _, o := range bufs {
+		// wait for the send window
+		for c.arq.waitSnd() >= 2*int(c.arq.sndWnd) && !c.isClosed() {
+			c.arqCond.Wait()
+		}
+		if c.isClosed() {
+			return nil
+		}
+		c.arq.send(o.b)
+	}
+	c.arq.flush()
+	return nil
+}
+
+// waitSent waits for the peer to ack every segment, it returns false when
+// the connection was closed first.
+func (c *UDPConnection) waitSent() bool {
+	c.arqMutex.Lock()
+	defer c.arqMutex.Unlock()
+	for c.arq.waitSnd() > 0 && !c.isClosed() {
+		c.arqCond.Wait()
+	}
+	return !c.isClosed()
+}
+
+func (c *UDPConnection) stopBackgroundWrite() {
+	c.queue.close()
+}
+
+func (c *UDPConnection) closeWrite() {
+	c.queue.close()
+}
+
+func (c *UDPConnection) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *UDPConnection) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *UDPConnection) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// Loop returns the event loop Connect and Receive are called on, nil when
+// they are called on the read goroutine.
+func (c *UDPConnection) Loop() *eventloop.EventLoop {
+	return c.loop
+}
+
+// SetPendingSend limits the number of messages pending send, see
+// SetBackpressure.
+func (c *UDPConnection) SetPendingSend(pendingSend int) {
+	c.queue.setPendingSend(pendingSend)
+}
+
+func (c *UDPConnection) SetBackpressure(backpressure Backpressure) {
+	c.queue.setBackpressure(backpressure)
+}
+
+func (c *UDPConnection) SendStats() SendStats {
+	return c.queue.stats()
+}
+
+// checkSize rejects messages that do not fit in a datagram, or in the ARQ
+// receive window.
+func (c *UDPConnection) checkSize(n int) error {
+	if c.arq == nil {
+		if n > maxDatagramSize {
+			return ErrUDPMessageTooLarge
+		}
+		return nil
+	}
+	if _, ok := c.arq.fragments(n); !ok {
+		return ErrUDPMessageTooLarge
+	}
+	return nil
+}
+
+func (c *UDPConnection) Send(b []byte) error {
+	return c.SendContext(context.Background(), b)
+}
+
+// SendBuffer sends buffer.B, see TCPConnection.SendBuffer.
+func (c *UDPConnection) SendBuffer(buffer *Buffer) error {
+	if len(buffer.B) == 0 {
+		buffer.Release()
+		return nil
+	}
+	if err := c.checkSize(len(buffer.B)); err != nil {
+		buffer.Release()
+		return err
+	}
+	return c.queue.push(context.Background(), outgoing{b: buffer.B, buffer: buffer})
+}
+
+// SendContext is Send, ctx bounds the wait when the OverflowBlock policy is
+// used.
+func (c *UDPConnection) SendContext(ctx context.Context, b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	if err := c.checkSize(len(b)); err != nil {
+		return err
+	}
+	return c.queue.push(ctx, outgoing{b: b})
+}
+
+func (c *UDPConnection) handleSlow() {
+	c.closeWithReason(CloseReason{CloseSlowConsumer, ErrSlowConsumer})
+}
+
+// Shutdown sends the pending messages then closes the connection, with ARQ
+// it waits for them to be acked.
+func (c *UDPConnection) Shutdown() {
+	c.stopBackgroundWrite()
+}
+
+// shutdown records reason for the connection closed after it is drained.
+func (c *UDPConnection) shutdown(reason CloseReason) {
+	c.mutex.Lock()
+	if c.reason.Cause == CloseNone {
+		c.reason = reason
+	}
+	c.mutex.Unlock()
+	c.Shutdown()
+}
+
+func (c *UDPConnection) Close() {
+	c.closeWithReason(CloseReason{CloseLocal, ErrConnectionClosed})
+}
+
+func (c *UDPConnection) closeWithReason(reason CloseReason) {
+	c.mutex.Lock()
+	if c.reason.Cause == CloseNone {
+		c.reason = reason
+	}
+	c.mutex.Unlock()
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if c.arq != nil {
+			c.arqMutex.Lock()
+			c.arqCond.Broadcast()
+			c.arqMutex.Unlock()
+		}
+	})
+}
+
+// CloseReason returns why the connection was closed, it is set before the
+// disconnect event.
+func (c *UDPConnection) CloseReason() CloseReason {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.reason
+}
+
+// Err returns the error of CloseReason, see TCPConnection.Err. It is io.EOF
+// when an ARQ peer closed the connection.
+func (c *UDPConnection) Err() error {
+	return c.CloseReason().Err
+}
+
+func (c *UDPConnection) CloseWithTimeout(timeout time.Duration) {
+	time.AfterFunc(timeout, c.Close)
+}
+
+func (c *UDPConnection) GetUserdata() interface{} {
+	return c.Userdata
+}
+
+func (c *UDPConnection) SetUserdata(userdata interface{}) {
+	c.Userdata = userdata
+}
+
+func (c *UDPConnection) onClose(f func()) (remove func(), ok bool) {
+	return c.hooks.add(f)
+}
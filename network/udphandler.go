@@ -0,0 +1,19 @@
+package network
+
+type UDPHandler interface {
+	Connect(conn *UDPConnection, connected bool)
+	Receive(conn *UDPConnection, b []byte)
+}
+
+type defaultUDPHandler struct {
+}
+
+func (*defaultUDPHandler) Connect(*UDPConnection, bool) {
+
+}
+
+func (*defaultUDPHandler) Receive(*UDPConnection, []byte) {
+
+}
+
+var DefaultUDPHandler = &defaultUDPHandler{}
@@ -0,0 +1,245 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUDPServerClosed = errors.New("network: UDP server closed")
+)
+
+// UDPServer serves a UDPConnection for each peer address, sessions are
+// closed when nothing is received within the read idle timeout. With
+// WithARQ a session starts on the first data segment of a conversation.
+type UDPServer struct {
+	addr string
+	opts options
+
+	mutex       sync.Mutex
+	conn        net.PacketConn
+	connections map[string]*UDPConnection
+	finished    map[string]finishedConv
+	closed      bool
+	drained     chan struct{}
+}
+
+// finishedConv is a conversation closed recently, its late segments are
+// ignored rather than starting a new session.
+type finishedConv struct {
+	conv uint32
+	at   time.Time
+}
+
+func NewUDPServer(addr string, opt ...Option) *UDPServer {
+	server := &UDPServer{
+		addr: addr,
+	}
+	for _, o := range opt {
+		o(&server.opts)
+	}
+	return server
+}
+
+func (s *UDPServer) ListenAndServe(handler UDPHandler) error {
+	if s.isClosed() {
+		return ErrUDPServerClosed
+	}
+	addr := s.addr
+	if addr == "" {
+		addr = ":0"
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(conn, handler)
+}
+
+// Serve reads datagrams from conn and closes it when it returns.
+func (s *UDPServer) Serve(conn net.PacketConn, handler UDPHandler) error {
+	defer conn.Close()
+
+	if err := s.newConn(conn); err != nil {
+		return err
+	}
+
+	if handler == nil {
+		handler = DefaultUDPHandler
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() {
+				return ErrUDPServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			log.Printf("network: UDPServer error: %v", err)
+			return err
+		}
+		b := make([]byte, n)
+		copy(b, buf[:n])
+		connection, created := s.getConnection(conn, addr, b)
+		if connection == nil {
+			continue
+		}
+		connection.deliver(b)
+		if created {
+			go s.serveConnection(connection, handler)
+		}
+	}
+}
+
+func (s *UDPServer) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.closed
+}
+
+func (s *UDPServer) newConn(conn net.PacketConn) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return ErrUDPServerClosed
+	}
+	s.conn = conn
+	s.connections = make(map[string]*UDPConnection)
+	s.finished = make(map[string]finishedConv)
+	return nil
+}
+
+// getConnection returns the session of addr for datagram b, creating it
+// when b may start one. It returns nil when b is dropped, and true when the
+// session was created.
+func (s *UDPServer) getConnection(conn net.PacketConn, addr net.Addr, b []byte) (*UDPConnection, bool) {
+	key := addr.String()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	connection, ok := s.connections[key]
+	if s.opts.arq == nil {
+		if ok || s.closed {
+			return connection, false
+		}
+		connection = newUDPConnection(conn, addr, 0, &s.opts)
+		s.connections[key] = connection
+		return connection, true
+	}
+
+	conv, valid := arqConv(b)
+	if !valid {
+		return nil, false
+	}
+	if ok && connection.arq.conv == conv {
+		return connection, false
+	}
+	if f, ok := s.finished[key]; ok && f.conv == conv {
+		return nil, false
+	}
+	if b[4] != arqCmdPush || s.closed {
+		return nil, false
+	}
+	if ok {
+		// the peer started a new conversation
+		connection.closeWithReason(CloseReason{ClosePeer, ErrARQSegment})
+	}
+	connection = newUDPConnection(conn, addr, conv, &s.opts)
+	s.connections[key] = connection
+	return connection, true
+}
+
+func (s *UDPServer) serveConnection(connection *UDPConnection, handler UDPHandler) {
+	connection.serve(handler)
+	// remove connection
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := connection.RemoteAddr().String()
+	if s.connections[key] != connection {
+		return
+	}
+	delete(s.connections, key)
+	if connection.arq != nil {
+		now := time.Now()
+		for k, f := range s.finished {
+			if now.Sub(f.at) > udpSessionTimeout {
+				delete(s.finished, k)
+			}
+		}
+		s.finished[key] = finishedConv{connection.arq.conv, now}
+	}
+	if s.drained != nil && len(s.connections) == 0 {
+		close(s.drained)
+		s.drained = nil
+		s.conn.Close()
+	}
+}
+
+func (s *UDPServer) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	if s.conn == nil {
+		return
+	}
+	s.conn.Close()
+	for key, connection := range s.connections {
+		connection.closeWithReason(CloseReason{CloseServer, ErrUDPServerClosed})
+		delete(s.connections, key)
+	}
+}
+
+// Shutdown stops starting sessions and shuts down every connection, see
+// TCPServer.Shutdown. Datagrams are still read until the connections are
+// drained, so that ARQ connections receive their acks.
+func (s *UDPServer) Shutdown(ctx context.Context) (drained int, forced int, err error) {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return 0, 0, ErrUDPServerClosed
+	}
+	s.closed = true
+	total := len(s.connections)
+	done := make(chan struct{})
+	if total == 0 {
+		close(done)
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	} else {
+		s.drained = done
+	}
+	for _, connection := range s.connections {
+		connection.shutdown(CloseReason{CloseServer, ErrUDPServerClosed})
+	}
+	s.mutex.Unlock()
+
+	select {
+	case <-done:
+		return total, 0, nil
+	case <-ctx.Done():
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	forced = len(s.connections)
+	s.conn.Close()
+	for _, connection := range s.connections {
+		connection.closeWithReason(CloseReason{CloseServer, ErrUDPServerClosed})
+	}
+	return total - forced, forced, ctx.Err()
+}
@@ -0,0 +1,54 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// PeerCredentials are the credentials of the process at the other end of a
+// Unix domain socket, when it connected.
+type PeerCredentials struct {
+	PID int
+	UID int
+	GID int
+}
+
+// NewUnixServer returns a TCPServer listening on the Unix domain socket
+// path, the socket file is removed on Close but kept when the listener is
+// handed over, see WithHandover. A stale socket file left by a crashed
+// process is replaced.
+func NewUnixServer(path string, opt ...Option) *TCPServer {
+	server := NewTCPServer(path, opt...)
+	server.network = "unix"
+	return server
+}
+
+// NewUnixClient returns a TCPClient dialing the Unix domain socket path.
+func NewUnixClient(path string, opt ...Option) *TCPClient {
+	client := NewTCPClient(path, opt...)
+	client.network = "unix"
+	return client
+}
+
+func listenUnix(path string) (*net.UnixListener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+	} else if errors.Is(err, syscall.ECONNREFUSED) {
+		// nobody listens on the socket file
+		os.Remove(path)
+	}
+	return net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+}
+
+// PeerCredentials returns the credentials of the peer process, ok is false
+// on other connections than Unix domain sockets or when the system does not
+// support SO_PEERCRED.
+func (c *TCPConnection) PeerCredentials() (cred PeerCredentials, ok bool) {
+	unixConn, ok := netConn(c.conn).(*net.UnixConn)
+	if !ok {
+		return PeerCredentials{}, false
+	}
+	return peerCredentials(unixConn)
+}
@@ -0,0 +1,20 @@
+package network
+
+import (
+	"net"
+	"syscall"
+)
+
+func peerCredentials(conn *net.UnixConn) (PeerCredentials, bool) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return PeerCredentials{}, false
+	}
+	var ucred *syscall.Ucred
+	if cerr := rawConn.Control(func(fd uintptr) {
+		ucred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); cerr != nil || err != nil {
+		return PeerCredentials{}, false
+	}
+	return PeerCredentials{PID: int(ucred.Pid), UID: int(ucred.Uid), GID: int(ucred.Gid)}, true
+}
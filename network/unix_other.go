@@ -0,0 +1,9 @@
+//go:build !linux
+
+package network
+
+import "net"
+
+func peerCredentials(conn *net.UnixConn) (PeerCredentials, bool) {
+	return PeerCredentials{}, false
+}
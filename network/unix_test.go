@@ -0,0 +1,107 @@
+package network_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/iakud/plume/network"
+)
+
+type credHandler chan network.PeerCredentials
+
+func (h credHandler) Connect(connection *network.TCPConnection, connected bool) {
+	if connected {
+		cred, _ := connection.PeerCredentials()
+		h <- cred
+	}
+}
+
+func (h credHandler) Receive(connection *network.TCPConnection, b []byte) {
+	connection.Send(b)
+}
+
+func TestUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "game.sock")
+	// a stale socket file is replaced
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.SetUnlinkOnClose(false)
+	ln.Close()
+
+	codec := network.NewVarintCodec(0)
+	creds := make(credHandler, 1)
+	server := network.NewUnixServer(path)
+	go server.ListenAndServe(creds, codec)
+
+	// dial again until the server listens
+	handler := newMemnetHandler()
+	client := network.NewUnixClient(path, network.WithBackoff(network.ExponentialBackoff{Initial: time.Millisecond * 10}))
+	go client.DialAndServe(handler, codec)
+	defer client.Close()
+
+	handler.connection(t).Send([]byte("hello"))
+	select {
+	case b := <-handler.receive:
+		if string(b) != "hello" {
+			t.Fatalf("received %q", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("receive timeout")
+	}
+	cred := <-creds
+	if runtime.GOOS == "linux" && (cred.PID != os.Getpid() || cred.UID != os.Getuid()) {
+		t.Fatalf("credentials %+v", cred)
+	}
+
+	server.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file after Close: %v", err)
+	}
+}
+
+func TestUnixHandover(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "game.sock")
+	handover := filepath.Join(dir, "handover.sock")
+	codec := network.NewVarintCodec(0)
+
+	old := network.NewUnixServer(path, network.WithHandover(handover))
+	oldErr := make(chan error, 1)
+	go func() { oldErr <- old.ListenAndServe(tagHandler("old"), codec) }()
+	defer old.Close()
+	backoff := network.WithBackoff(network.ExponentialBackoff{Initial: time.Millisecond * 10})
+	handler := newMemnetHandler()
+	client := network.NewUnixClient(path, backoff)
+	go client.DialAndServe(handler, codec)
+	defer client.Close()
+	expectTag(t, handler.connection(t), handler, "old")
+
+	server := network.NewUnixServer(path, network.WithHandover(handover))
+	go server.ListenAndServe(tagHandler("new"), codec)
+	select {
+	case err := <-oldErr:
+		if err != network.ErrServerHandedOver {
+			t.Fatalf("ListenAndServe: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handover timeout")
+	}
+
+	// the socket file is kept for the new server
+	handler = newMemnetHandler()
+	client = network.NewUnixClient(path, backoff)
+	go client.DialAndServe(handler, codec)
+	defer client.Close()
+	expectTag(t, handler.connection(t), handler, "new")
+
+	server.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file after Close: %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	ErrVarintOverflow = errors.New("network: varint overflows a 64-bit integer")
+)
+
+// VarintCodec frames each message with an unsigned varint length header.
+type VarintCodec struct {
+	maxFrameSize int
+}
+
+// NewVarintCodec returns a varint length codec. A maxFrameSize <= 0 means
+// DefaultMaxFrameSize.
+func NewVarintCodec(maxFrameSize int) *VarintCodec {
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+	codec := &VarintCodec{
+		maxFrameSize: maxFrameSize,
+	}
+	return codec
+}
+
+func (c *VarintCodec) MaxFrameSize() int {
+	return c.maxFrameSize
+}
+
+func (c *VarintCodec) Read(r io.Reader) ([]byte, error) {
+	br := toByteReader(r)
+	var n uint64
+	var shift uint
+	for i := 0; ; i++ {
+		if i == binary.MaxVarintLen64 {
+			return nil, ErrVarintOverflow
+		}
+		x, err := br.ReadByte()
+		if err != nil {
+			if i > 0 {
+				return nil, unexpectedEOF(err)
+			}
+			return nil, err
+		}
+		if x < 0x80 {
+			if i == binary.MaxVarintLen64-1 && x > 1 {
+				return nil, ErrVarintOverflow
+			}
+			n |= uint64(x) << shift
+			break
+		}
+		n |= uint64(x&0x7f) << shift
+		shift += 7
+		if n > uint64(c.maxFrameSize) {
+			return nil, ErrFrameTooLarge
+		}
+	}
+	if n > uint64(c.maxFrameSize) {
+		return nil, ErrFrameTooLarge
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return b, nil
+}
+
+func (c *VarintCodec) Write(w io.Writer, b []byte) error {
+	if len(b) > c.maxFrameSize {
+		return ErrFrameTooLarge
+	}
+	var h [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(h[:], uint64(len(b)))
+	if _, err := w.Write(h[:n]); err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *VarintCodec) AppendHeader(dst []byte, b []byte) ([]byte, error) {
+	if len(b) > c.maxFrameSize {
+		return dst, ErrFrameTooLarge
+	}
+	var h [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(h[:], uint64(len(b)))
+	return append(dst, h[:n]...), nil
+}
+
+type byteReader struct {
+	r io.Reader
+	b [1]byte
+}
+
+func (r *byteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(r.r, r.b[:]); err != nil {
+		return 0, err
+	}
+	return r.b[0], nil
+}
+
+// toByteReader avoids reading past the frame when r is not already buffered.
+func toByteReader(r io.Reader) io.ByteReader {
+	if br, ok := r.(io.ByteReader); ok {
+		return br
+	}
+	return &byteReader{r: r}
+}
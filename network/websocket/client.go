@@ -0,0 +1,191 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBadHandshake = errors.New("websocket: bad handshake")
+	ErrBadScheme    = errors.New("websocket: bad URL scheme")
+)
+
+type Dialer struct {
+	// NetDial dials the TCP connection, net.Dialer by default.
+	NetDial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// TLSClientConfig is used for wss URLs, ServerName defaults to the URL
+	// host.
+	TLSClientConfig *tls.Config
+
+	// HandshakeTimeout limits the dial and the opening handshake, zero
+	// means no limit besides the context.
+	HandshakeTimeout time.Duration
+
+	// Subprotocols requested in order of preference.
+	Subprotocols []string
+
+	// EnableCompression offers permessage-deflate.
+	EnableCompression bool
+}
+
+var DefaultDialer = &Dialer{HandshakeTimeout: 45 * time.Second}
+
+func (d *Dialer) Dial(urlStr string, header http.Header) (*Conn, *http.Response, error) {
+	return d.DialContext(context.Background(), urlStr, header)
+}
+
+// DialContext opens a WebSocket connection to a ws or wss URL, header is
+// added to the handshake request. The response is returned on
+// ErrBadHandshake too.
+func (d *Dialer) DialContext(ctx context.Context, urlStr string, header http.Header) (*Conn, *http.Response, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	default:
+		return nil, nil, ErrBadScheme
+	}
+	if d.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.HandshakeTimeout)
+		defer cancel()
+	}
+
+	var keyBytes [16]byte
+	if _, err := rand.Read(keyBytes[:]); err != nil {
+		return nil, nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(keyBytes[:])
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if len(d.Subprotocols) > 0 {
+		req.Header.Set("Sec-WebSocket-Protocol", strings.Join(d.Subprotocols, ", "))
+	}
+	if d.EnableCompression {
+		req.Header.Set("Sec-WebSocket-Extensions", deflateExtension)
+	}
+
+	netDial := d.NetDial
+	if netDial == nil {
+		netDial = (&net.Dialer{}).DialContext
+	}
+	conn, err := netDial(ctx, "tcp", hostPort(u))
+	if err != nil {
+		return nil, nil, err
+	}
+	// interrupt the handshake when ctx is done
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	c, resp, err := d.handshake(ctx, conn, u, req, key)
+	close(stop)
+	<-stopped
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, resp, err
+	}
+	c.conn.SetDeadline(time.Time{})
+	return c, resp, nil
+}
+
+func (d *Dialer) handshake(ctx context.Context, conn net.Conn, u *url.URL, req *http.Request, key string) (*Conn, *http.Response, error) {
+	if u.Scheme == "https" {
+		config := &tls.Config{}
+		if d.TLSClientConfig != nil {
+			config = d.TLSClientConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, nil, err
+		}
+		conn = tlsConn
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, nil, ctxErr(ctx, err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, nil, ctxErr(ctx, err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(nil))
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!headerContainsToken(resp.Header, "Upgrade", "websocket") ||
+		!headerContainsToken(resp.Header, "Connection", "upgrade") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != computeAcceptKey(key) {
+		return nil, resp, ErrBadHandshake
+	}
+	subprotocol := resp.Header.Get("Sec-WebSocket-Protocol")
+	if subprotocol != "" && !containsString(d.Subprotocols, subprotocol) {
+		return nil, resp, ErrBadHandshake
+	}
+	compress := false
+	for _, ext := range parseExtensions(resp.Header) {
+		if !d.EnableCompression || compress || !deflateAccepted(ext) {
+			return nil, resp, ErrBadHandshake
+		}
+		compress = true
+	}
+	return newConn(conn, br, false, compress, subprotocol), resp, nil
+}
+
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Messages smaller than minCompressSize are sent uncompressed.
+const minCompressSize = 64
+
+// deflateTail ends the message with the empty stored block removed by the
+// sender, and a final block so the reader sees EOF.
+const deflateTail = "\x00\x00\xff\xff\x01\x00\x00\xff\xff"
+
+var (
+	flateWriterPool sync.Pool
+	flateReaderPool sync.Pool
+)
+
+// compress deflates b without context takeover, see RFC 7692 section 7.2.1.
+func compress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	fw, ok := flateWriterPool.Get().(*flate.Writer)
+	if ok {
+		fw.Reset(&buf)
+	} else {
+		fw, _ = flate.NewWriter(&buf, flate.BestSpeed)
+	}
+	defer flateWriterPool.Put(fw)
+	if _, err := fw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte(deflateTail[:4])), nil
+}
+
+// decompress inflates b, failing with ErrMessageTooLarge past limit.
+func decompress(b []byte, limit int64) ([]byte, error) {
+	r := io.MultiReader(bytes.NewReader(b), strings.NewReader(deflateTail))
+	fr, ok := flateReaderPool.Get().(io.ReadCloser)
+	if ok {
+		fr.(flate.Resetter).Reset(r, nil)
+	} else {
+		fr = flate.NewReader(r)
+	}
+	defer flateReaderPool.Put(fr)
+	out, err := io.ReadAll(io.LimitReader(fr, limit+1))
+	if err != nil {
+		return nil, &protocolError{CloseInvalidFramePayloadData, "invalid compressed message"}
+	}
+	if int64(len(out)) > limit {
+		return nil, ErrMessageTooLarge
+	}
+	return out, nil
+}
@@ -0,0 +1,519 @@
+// Package websocket implements the WebSocket protocol of RFC 6455 and the
+// permessage-deflate extension of RFC 7692.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type MessageType int
+
+const (
+	TextMessage   MessageType = 1
+	BinaryMessage MessageType = 2
+	CloseMessage  MessageType = 8
+	PingMessage   MessageType = 9
+	PongMessage   MessageType = 10
+)
+
+// Close status codes, see RFC 6455 section 7.4.1.
+const (
+	CloseNormalClosure           = 1000
+	CloseGoingAway               = 1001
+	CloseProtocolError           = 1002
+	CloseUnsupportedData         = 1003
+	CloseNoStatusReceived        = 1005
+	CloseAbnormalClosure         = 1006
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation         = 1008
+	CloseMessageTooBig           = 1009
+	CloseMandatoryExtension      = 1010
+	CloseInternalServerErr       = 1011
+	CloseServiceRestart          = 1012
+	CloseTryAgainLater           = 1013
+)
+
+const DefaultMaxMessageSize = 4 << 20
+
+const (
+	finBit  = 0x80
+	rsv1Bit = 0x40
+	rsv2Bit = 0x20
+	rsv3Bit = 0x10
+	maskBit = 0x80
+
+	opContinuation = 0
+
+	maxControlPayload = 125
+	closeReplyTimeout = time.Second
+)
+
+var (
+	ErrMessageTooLarge = errors.New("websocket: message too large")
+	ErrCloseSent       = errors.New("websocket: close sent")
+	ErrMessageType     = errors.New("websocket: invalid message type")
+	ErrControlTooLarge = errors.New("websocket: control frame payload too large")
+)
+
+// CloseError is returned by ReadMessage when the peer sent a close frame.
+// Code is CloseNoStatusReceived when the frame had no status code.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	if e.Text == "" {
+		return fmt.Sprintf("websocket: close %d", e.Code)
+	}
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Text)
+}
+
+// protocolError fails the connection with code.
+type protocolError struct {
+	code int
+	text string
+}
+
+func (e *protocolError) Error() string {
+	return "websocket: " + e.text
+}
+
+// Conn is a WebSocket connection. ReadMessage must be called from one
+// goroutine, writes may be called concurrently.
+type Conn struct {
+	conn        net.Conn
+	br          *bufio.Reader
+	isServer    bool
+	compress    bool
+	subprotocol string
+
+	// read state
+	readLimit    int64
+	readErr      error
+	pingHandler  func(data []byte) error
+	pongHandler  func(data []byte) error
+	closeHandler func(code int, text string) error
+
+	writeMutex sync.Mutex
+	closeSent  bool
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, isServer bool, compress bool, subprotocol string) *Conn {
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+	c := &Conn{
+		conn:        conn,
+		br:          br,
+		isServer:    isServer,
+		compress:    compress,
+		subprotocol: subprotocol,
+		readLimit:   DefaultMaxMessageSize,
+	}
+	c.SetPingHandler(nil)
+	c.SetPongHandler(nil)
+	c.SetCloseHandler(nil)
+	return c
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// Subprotocol returns the negotiated subprotocol, empty when none.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// Compression reports whether permessage-deflate was negotiated.
+func (c *Conn) Compression() bool {
+	return c.compress
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// SetReadLimit sets the maximum size of a received message, after
+// decompression. Larger messages fail the connection with
+// CloseMessageTooBig.
+func (c *Conn) SetReadLimit(limit int64) {
+	if limit <= 0 {
+		limit = DefaultMaxMessageSize
+	}
+	c.readLimit = limit
+}
+
+// SetPingHandler sets the handler for ping frames, called from ReadMessage.
+// The default handler replies with a pong.
+func (c *Conn) SetPingHandler(h func(data []byte) error) {
+	if h == nil {
+		h = func(data []byte) error {
+			if err := c.WriteControl(PongMessage, data); err != nil && err != ErrCloseSent {
+				return err
+			}
+			return nil
+		}
+	}
+	c.pingHandler = h
+}
+
+// SetPongHandler sets the handler for pong frames, called from ReadMessage.
+func (c *Conn) SetPongHandler(h func(data []byte) error) {
+	if h == nil {
+		h = func([]byte) error { return nil }
+	}
+	c.pongHandler = h
+}
+
+// SetCloseHandler sets the handler for the close frame, called from
+// ReadMessage before it returns the CloseError. The default handler echoes
+// the status code back.
+func (c *Conn) SetCloseHandler(h func(code int, text string) error) {
+	if h == nil {
+		h = func(code int, text string) error {
+			if err := c.WriteClose(code, ""); err != nil && err != ErrCloseSent {
+				return err
+			}
+			return nil
+		}
+	}
+	c.closeHandler = h
+}
+
+// ReadMessage returns the next text or binary message, control frames are
+// handled on the way. A close frame from the peer returns a *CloseError, the
+// connection should then be closed.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	mt, b, err := c.readMessage()
+	if err != nil {
+		c.readErr = err
+		return 0, nil, err
+	}
+	return mt, b, nil
+}
+
+func (c *Conn) readMessage() (MessageType, []byte, error) {
+	var mt MessageType
+	var compressed bool
+	var b []byte
+	for {
+		h, err := c.readHeader()
+		if err != nil {
+			return 0, nil, c.fail(err)
+		}
+		if h.isControl() {
+			payload, err := c.readPayload(h, nil)
+			if err != nil {
+				return 0, nil, err
+			}
+			if err := c.handleControl(h.opcode, payload); err != nil {
+				return 0, nil, c.fail(err)
+			}
+			continue
+		}
+		switch h.opcode {
+		case opContinuation:
+			if mt == 0 {
+				return 0, nil, c.fail(&protocolError{CloseProtocolError, "continuation frame without a message"})
+			}
+			if h.rsv1 {
+				// RFC 7692 6.1, only the first frame is marked
+				return 0, nil, c.fail(&protocolError{CloseProtocolError, "RSV1 set on a continuation frame"})
+			}
+		case byte(TextMessage), byte(BinaryMessage):
+			if mt != 0 {
+				return 0, nil, c.fail(&protocolError{CloseProtocolError, "message started before the previous one finished"})
+			}
+			mt = MessageType(h.opcode)
+			compressed = h.rsv1
+		default:
+			return 0, nil, c.fail(&protocolError{CloseProtocolError, fmt.Sprintf("unknown opcode %d", h.opcode)})
+		}
+		if h.length > c.readLimit-int64(len(b)) {
+			return 0, nil, c.fail(ErrMessageTooLarge)
+		}
+		if b, err = c.readPayload(h, b); err != nil {
+			return 0, nil, err
+		}
+		if h.fin {
+			break
+		}
+	}
+	if compressed {
+		var err error
+		if b, err = decompress(b, c.readLimit); err != nil {
+			return 0, nil, c.fail(err)
+		}
+	}
+	if mt == TextMessage && !utf8.Valid(b) {
+		return 0, nil, c.fail(&protocolError{CloseInvalidFramePayloadData, "invalid UTF-8 in text message"})
+	}
+	return mt, b, nil
+}
+
+type frameHeader struct {
+	fin    bool
+	rsv1   bool
+	opcode byte
+	masked bool
+	mask   [4]byte
+	length int64
+}
+
+func (h *frameHeader) isControl() bool {
+	return h.opcode&0x08 != 0
+}
+
+func (c *Conn) readHeader() (h frameHeader, err error) {
+	var p [8]byte
+	if _, err := io.ReadFull(c.br, p[:2]); err != nil {
+		return h, err
+	}
+	h.fin = p[0]&finBit != 0
+	h.rsv1 = p[0]&rsv1Bit != 0
+	h.opcode = p[0] & 0x0f
+	h.masked = p[1]&maskBit != 0
+	if p[0]&(rsv2Bit|rsv3Bit) != 0 || h.rsv1 && (!c.compress || h.isControl()) {
+		return h, &protocolError{CloseProtocolError, "unexpected reserved bits"}
+	}
+	if h.masked != c.isServer {
+		return h, &protocolError{CloseProtocolError, "bad frame masking"}
+	}
+	switch n := p[1] & 0x7f; n {
+	case 126:
+		if _, err := io.ReadFull(c.br, p[:2]); err != nil {
+			return h, unexpectedEOF(err)
+		}
+		h.length = int64(binary.BigEndian.Uint16(p[:2]))
+	case 127:
+		if _, err := io.ReadFull(c.br, p[:8]); err != nil {
+			return h, unexpectedEOF(err)
+		}
+		length := binary.BigEndian.Uint64(p[:8])
+		if length > 1<<63-1 {
+			return h, &protocolError{CloseProtocolError, "bad frame length"}
+		}
+		h.length = int64(length)
+	default:
+		h.length = int64(n)
+	}
+	if h.isControl() && (!h.fin || h.length > maxControlPayload) {
+		return h, &protocolError{CloseProtocolError, "bad control frame"}
+	}
+	if h.masked {
+		if _, err := io.ReadFull(c.br, h.mask[:]); err != nil {
+			return h, unexpectedEOF(err)
+		}
+	}
+	return h, nil
+}
+
+// readPayload appends the frame payload to dst, unmasked.
+func (c *Conn) readPayload(h frameHeader, dst []byte) ([]byte, error) {
+	n := len(dst)
+	if int64(cap(dst)-n) < h.length {
+		b := make([]byte, n, n+int(h.length))
+		copy(b, dst)
+		dst = b
+	}
+	dst = dst[:n+int(h.length)]
+	if _, err := io.ReadFull(c.br, dst[n:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if h.masked {
+		maskBytes(h.mask, dst[n:])
+	}
+	return dst, nil
+}
+
+func (c *Conn) handleControl(opcode byte, payload []byte) error {
+	switch MessageType(opcode) {
+	case PingMessage:
+		return c.pingHandler(payload)
+	case PongMessage:
+		return c.pongHandler(payload)
+	case CloseMessage:
+		code, text := CloseNoStatusReceived, ""
+		if len(payload) == 1 {
+			return &protocolError{CloseProtocolError, "bad close frame"}
+		}
+		if len(payload) >= 2 {
+			code = int(binary.BigEndian.Uint16(payload))
+			text = string(payload[2:])
+			if !validCloseCode(code) {
+				return &protocolError{CloseProtocolError, fmt.Sprintf("bad close code %d", code)}
+			}
+			if !utf8.ValidString(text) {
+				return &protocolError{CloseInvalidFramePayloadData, "invalid UTF-8 in close frame"}
+			}
+		}
+		if err := c.closeHandler(code, text); err != nil {
+			return err
+		}
+		return &CloseError{Code: code, Text: text}
+	}
+	return &protocolError{CloseProtocolError, fmt.Sprintf("unknown opcode %d", opcode)}
+}
+
+// fail sends the close frame for protocol errors and returns err.
+func (c *Conn) fail(err error) error {
+	code := 0
+	var pe *protocolError
+	switch {
+	case errors.As(err, &pe):
+		code = pe.code
+	case err == ErrMessageTooLarge:
+		code = CloseMessageTooBig
+	}
+	if code != 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(closeReplyTimeout))
+		c.WriteClose(code, "")
+	}
+	return err
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1013:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// WriteMessage sends a text or binary message in a single frame, compressed
+// when permessage-deflate was negotiated and the message is not tiny.
+func (c *Conn) WriteMessage(mt MessageType, data []byte) error {
+	if mt != TextMessage && mt != BinaryMessage {
+		return ErrMessageType
+	}
+	compressed := false
+	if c.compress && len(data) >= minCompressSize {
+		b, err := compress(data)
+		if err != nil {
+			return err
+		}
+		data, compressed = b, true
+	}
+	return c.writeFrame(byte(mt), compressed, data)
+}
+
+// WriteControl sends a ping, pong or close frame.
+func (c *Conn) WriteControl(mt MessageType, data []byte) error {
+	if mt != PingMessage && mt != PongMessage && mt != CloseMessage {
+		return ErrMessageType
+	}
+	if len(data) > maxControlPayload {
+		return ErrControlTooLarge
+	}
+	return c.writeFrame(byte(mt), false, data)
+}
+
+// WriteClose sends a close frame with code and text, only the first close
+// frame is sent and no message may be written after it.
+func (c *Conn) WriteClose(code int, text string) error {
+	if code == CloseNoStatusReceived {
+		return c.WriteControl(CloseMessage, nil)
+	}
+	if len(text) > maxControlPayload-2 {
+		text = text[:maxControlPayload-2]
+	}
+	payload := make([]byte, 2+len(text))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	copy(payload[2:], text)
+	return c.WriteControl(CloseMessage, payload)
+}
+
+func (c *Conn) writeFrame(opcode byte, rsv1 bool, payload []byte) error {
+	var header [14]byte
+	header[0] = finBit | opcode
+	if rsv1 {
+		header[0] |= rsv1Bit
+	}
+	n := 2
+	switch length := len(payload); {
+	case length <= maxControlPayload:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+		n += 2
+	default:
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+		n += 8
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if MessageType(opcode) == CloseMessage {
+		c.closeSent = true
+	}
+	if c.isServer {
+		bufs := net.Buffers{header[:n], payload}
+		_, err := bufs.WriteTo(c.conn)
+		return err
+	}
+	// client frames are masked
+	header[1] |= maskBit
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	b := make([]byte, n+4+len(payload))
+	copy(b, header[:n])
+	copy(b[n:], mask[:])
+	copy(b[n+4:], payload)
+	maskBytes(mask, b[n+4:])
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// Close closes the underlying connection without the close handshake.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+func maskBytes(mask [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= mask[i&3]
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,160 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+// frame returns a masked client frame.
+func frame(b0 byte, payload []byte) []byte {
+	mask := [4]byte{1, 2, 3, 4}
+	var h []byte
+	switch {
+	case len(payload) <= 125:
+		h = []byte{b0, maskBit | byte(len(payload))}
+	case len(payload) <= 0xffff:
+		h = []byte{b0, maskBit | 126, 0, 0}
+		binary.BigEndian.PutUint16(h[2:], uint16(len(payload)))
+	default:
+		h = []byte{b0, maskBit | 127, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(h[2:], uint64(len(payload)))
+	}
+	b := append(h, mask[:]...)
+	masked := append([]byte(nil), payload...)
+	maskBytes(mask, masked)
+	return append(b, masked...)
+}
+
+// newPipe returns a server conn and the raw client end, frames sent by the
+// server are read by a client conn into control.
+func newPipe(t *testing.T, compress bool) (*Conn, net.Conn, chan string) {
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	control := make(chan string, 8)
+	c := newConn(client, nil, false, compress, "")
+	c.SetPongHandler(func(data []byte) error {
+		control <- "pong " + string(data)
+		return nil
+	})
+	c.SetCloseHandler(func(code int, text string) error {
+		control <- "close " + (&CloseError{code, text}).Error()
+		return nil
+	})
+	go func() {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	return newConn(server, nil, true, compress, ""), client, control
+}
+
+func writeFrames(conn net.Conn, frames ...[]byte) {
+	go func() {
+		for _, f := range frames {
+			if _, err := conn.Write(f); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func TestFragmentedMessage(t *testing.T) {
+	server, client, control := newPipe(t, false)
+	writeFrames(client,
+		frame(byte(TextMessage), []byte("hello ")),
+		frame(finBit|byte(PingMessage), []byte("ping")),
+		frame(opContinuation, []byte("web")),
+		frame(finBit|opContinuation, []byte("socket")),
+	)
+	mt, b, err := server.ReadMessage()
+	if err != nil || mt != TextMessage || string(b) != "hello websocket" {
+		t.Fatalf("read: %v %q %v", mt, b, err)
+	}
+	if s := <-control; s != "pong ping" {
+		t.Fatalf("control: %s", s)
+	}
+}
+
+func TestCloseFrame(t *testing.T) {
+	server, client, control := newPipe(t, false)
+	payload := []byte{0x0f, 0xa0} // 4000
+	writeFrames(client, frame(finBit|byte(CloseMessage), append(payload, "bye"...)))
+	_, _, err := server.ReadMessage()
+	var ce *CloseError
+	if !errors.As(err, &ce) || ce.Code != 4000 || ce.Text != "bye" {
+		t.Fatalf("read: %v", err)
+	}
+	if s := <-control; s != "close websocket: close 4000" {
+		t.Fatalf("control: %s", s)
+	}
+	if err := server.WriteMessage(BinaryMessage, []byte("late")); err != ErrCloseSent {
+		t.Fatalf("write after close: %v", err)
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	tests := []struct {
+		frame []byte
+		code  int
+	}{
+		{[]byte{finBit | byte(BinaryMessage), 1, 'x'}, CloseProtocolError},                                 // unmasked
+		{frame(finBit|rsv2Bit|byte(BinaryMessage), nil), CloseProtocolError},                               // reserved bit
+		{frame(finBit|rsv1Bit|byte(BinaryMessage), nil), CloseProtocolError},                               // not negotiated
+		{frame(byte(PingMessage), nil), CloseProtocolError},                                                // fragmented control
+		{frame(finBit|opContinuation, nil), CloseProtocolError},                                            // no message
+		{frame(finBit|byte(CloseMessage), []byte{0x03, 0xed}), CloseProtocolError},                         // 1005
+		{frame(finBit|byte(TextMessage), []byte{0xff}), CloseInvalidFramePayloadData},                      // UTF-8
+		{frame(finBit|byte(BinaryMessage), make([]byte, 2000)), CloseMessageTooBig},                        // limit
+		{frame(finBit|byte(PingMessage), make([]byte, maxControlPayload+1)), CloseProtocolError},           // too large
+		{frame(finBit|byte(CloseMessage), append([]byte{0x03, 0xe8}, 0xff)), CloseInvalidFramePayloadData}, // UTF-8
+	}
+	for i, test := range tests {
+		server, client, control := newPipe(t, false)
+		server.SetReadLimit(1024)
+		writeFrames(client, test.frame)
+		if _, _, err := server.ReadMessage(); err == nil {
+			t.Fatalf("%d: no error", i)
+		}
+		if s, want := <-control, "close "+(&CloseError{test.code, ""}).Error(); s != want {
+			t.Fatalf("%d: %s, want %s", i, s, want)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	server, client, _ := newPipe(t, true)
+	message := bytes.Repeat([]byte("compressible "), 1000)
+	compressed, err := compress(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) >= len(message)/10 {
+		t.Fatalf("compressed %d bytes to %d", len(message), len(compressed))
+	}
+	writeFrames(client, frame(finBit|rsv1Bit|byte(BinaryMessage), compressed))
+	mt, b, err := server.ReadMessage()
+	if err != nil || mt != BinaryMessage || !bytes.Equal(b, message) {
+		t.Fatalf("read: %v %d bytes %v", mt, len(b), err)
+	}
+
+	// RSV1 is only valid on the first frame
+	server, client, control := newPipe(t, true)
+	writeFrames(client, frame(rsv1Bit|byte(BinaryMessage), compressed[:1]), frame(finBit|rsv1Bit|opContinuation, compressed[1:]))
+	if _, _, err := server.ReadMessage(); err == nil {
+		t.Fatal("RSV1 continuation: no error")
+	}
+	if s, want := <-control, "close "+(&CloseError{CloseProtocolError, ""}).Error(); s != want {
+		t.Fatalf("RSV1 continuation: %s, want %s", s, want)
+	}
+	if _, err := decompress(compressed, int64(len(message)-1)); err != ErrMessageTooLarge {
+		t.Fatalf("decompress over limit: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// deflateExtension is offered and accepted without context takeover, each
+// message is then compressed on its own.
+const deflateExtension = "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
+
+func computeAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContainsToken reports whether the comma separated header name
+// contains token, case insensitive.
+func headerContainsToken(header http.Header, name string, token string) bool {
+	for _, t := range headerTokens(header, name) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
+
+func headerTokens(header http.Header, name string) []string {
+	var tokens []string
+	for _, v := range header.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tokens = append(tokens, t)
+			}
+		}
+	}
+	return tokens
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+type extension struct {
+	name   string
+	params map[string]string
+}
+
+// parseExtensions parses Sec-WebSocket-Extensions, quoted parameter values
+// may not contain commas or semicolons.
+func parseExtensions(header http.Header) []extension {
+	var extensions []extension
+	for _, v := range header.Values("Sec-WebSocket-Extensions") {
+		for _, e := range strings.Split(v, ",") {
+			parts := strings.Split(e, ";")
+			name := strings.TrimSpace(parts[0])
+			if name == "" {
+				continue
+			}
+			ext := extension{name: strings.ToLower(name), params: make(map[string]string)}
+			for _, p := range parts[1:] {
+				key, value := p, ""
+				if i := strings.IndexByte(p, '='); i >= 0 {
+					key, value = p[:i], strings.Trim(strings.TrimSpace(p[i+1:]), `"`)
+				}
+				ext.params[strings.ToLower(strings.TrimSpace(key))] = value
+			}
+			extensions = append(extensions, ext)
+		}
+	}
+	return extensions
+}
+
+// acceptDeflate reports whether the server can accept a permessage-deflate
+// offer, it always compresses with the full window.
+func acceptDeflate(ext extension) bool {
+	if ext.name != "permessage-deflate" {
+		return false
+	}
+	for key, value := range ext.params {
+		switch key {
+		case "server_no_context_takeover", "client_no_context_takeover", "client_max_window_bits":
+		case "server_max_window_bits":
+			if value != "15" {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// deflateAccepted reports whether the client can use the permessage-deflate
+// response, the server must not take over the context of its messages.
+func deflateAccepted(ext extension) bool {
+	if ext.name != "permessage-deflate" {
+		return false
+	}
+	if _, ok := ext.params["server_no_context_takeover"]; !ok {
+		return false
+	}
+	for key, value := range ext.params {
+		switch key {
+		case "server_no_context_takeover", "client_no_context_takeover", "server_max_window_bits":
+		case "client_max_window_bits":
+			if value != "" && value != "15" {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
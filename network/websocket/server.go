@@ -0,0 +1,118 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// HandshakeError is returned by Upgrade when the request is not a valid
+// WebSocket handshake, the HTTP error has been replied.
+type HandshakeError struct {
+	Status int
+	Reason string
+}
+
+func (e *HandshakeError) Error() string {
+	return "websocket: " + e.Reason
+}
+
+type Upgrader struct {
+	// CheckOrigin returns whether the request origin is accepted, nil
+	// accepts every origin.
+	CheckOrigin func(r *http.Request) bool
+
+	// Subprotocols supported by the server in order of preference, the
+	// first one requested by the client is selected.
+	Subprotocols []string
+
+	// EnableCompression accepts permessage-deflate when the client offers
+	// it.
+	EnableCompression bool
+}
+
+// Upgrade upgrades the HTTP server connection to the WebSocket protocol,
+// header is added to the response.
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request, header http.Header) (*Conn, error) {
+	if r.Method != http.MethodGet {
+		return nil, u.fail(w, http.StatusMethodNotAllowed, "request method is not GET")
+	}
+	if !headerContainsToken(r.Header, "Connection", "upgrade") {
+		return nil, u.fail(w, http.StatusBadRequest, "Connection header does not contain upgrade")
+	}
+	if !headerContainsToken(r.Header, "Upgrade", "websocket") {
+		return nil, u.fail(w, http.StatusBadRequest, "Upgrade header does not contain websocket")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, u.fail(w, http.StatusUpgradeRequired, "unsupported version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if b, err := base64.StdEncoding.DecodeString(key); err != nil || len(b) != 16 {
+		return nil, u.fail(w, http.StatusBadRequest, "bad Sec-WebSocket-Key")
+	}
+	if u.CheckOrigin != nil && !u.CheckOrigin(r) {
+		return nil, u.fail(w, http.StatusForbidden, "origin not allowed")
+	}
+	compress := false
+	if u.EnableCompression {
+		for _, ext := range parseExtensions(r.Header) {
+			if acceptDeflate(ext) {
+				compress = true
+				break
+			}
+		}
+	}
+
+	subprotocol := u.selectSubprotocol(r)
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, u.fail(w, http.StatusInternalServerError, "response does not implement http.Hijacker")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	if brw.Reader.Buffered() > 0 {
+		conn.Close()
+		return nil, errors.New("websocket: client sent data before handshake")
+	}
+	// the server may have set deadlines
+	conn.SetDeadline(time.Time{})
+
+	bw := bufio.NewWriter(conn)
+	bw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: ")
+	bw.WriteString(computeAcceptKey(key))
+	bw.WriteString("\r\n")
+	if subprotocol != "" {
+		bw.WriteString("Sec-WebSocket-Protocol: " + subprotocol + "\r\n")
+	}
+	if compress {
+		bw.WriteString("Sec-WebSocket-Extensions: " + deflateExtension + "\r\n")
+	}
+	header.Write(bw)
+	bw.WriteString("\r\n")
+	if err := bw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newConn(conn, brw.Reader, true, compress, subprotocol), nil
+}
+
+func (u *Upgrader) selectSubprotocol(r *http.Request) string {
+	requested := headerTokens(r.Header, "Sec-WebSocket-Protocol")
+	for _, subprotocol := range u.Subprotocols {
+		if containsString(requested, subprotocol) {
+			return subprotocol
+		}
+	}
+	return ""
+}
+
+func (u *Upgrader) fail(w http.ResponseWriter, status int, reason string) error {
+	http.Error(w, http.StatusText(status), status)
+	return &HandshakeError{Status: status, Reason: reason}
+}
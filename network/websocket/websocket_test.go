@@ -0,0 +1,115 @@
+package websocket_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/iakud/plume/network/websocket"
+)
+
+func newEchoServer(t *testing.T, upgrader *websocket.Upgrader) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			mt, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if string(b) == "close" {
+				conn.WriteClose(websocket.CloseGoingAway, "bye")
+				continue
+			}
+			conn.WriteMessage(mt, b)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestDialEcho(t *testing.T) {
+	for _, compression := range []bool{false, true} {
+		url := newEchoServer(t, &websocket.Upgrader{EnableCompression: true})
+		dialer := &websocket.Dialer{EnableCompression: compression}
+		conn, _, err := dialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.Compression() != compression {
+			t.Fatalf("compression %v, want %v", conn.Compression(), compression)
+		}
+		messages := []struct {
+			mt websocket.MessageType
+			b  []byte
+		}{
+			{websocket.TextMessage, []byte("hello")},
+			{websocket.BinaryMessage, []byte{}},
+			{websocket.BinaryMessage, bytes.Repeat([]byte{1, 2, 3}, 300)},
+			{websocket.TextMessage, bytes.Repeat([]byte("large"), 20000)},
+		}
+		for _, m := range messages {
+			if err := conn.WriteMessage(m.mt, m.b); err != nil {
+				t.Fatal(err)
+			}
+			mt, b, err := conn.ReadMessage()
+			if err != nil || mt != m.mt || !bytes.Equal(b, m.b) {
+				t.Fatalf("echo: %v %d bytes %v", mt, len(b), err)
+			}
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte("close"))
+		_, _, err = conn.ReadMessage()
+		var ce *websocket.CloseError
+		if !errors.As(err, &ce) || ce.Code != websocket.CloseGoingAway || ce.Text != "bye" {
+			t.Fatalf("close: %v", err)
+		}
+		conn.Close()
+	}
+}
+
+func TestUpgradeRejected(t *testing.T) {
+	upgrader := &websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return false }}
+	url := newEchoServer(t, upgrader)
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != websocket.ErrBadHandshake || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("dial: %v", err)
+	}
+	r, err := http.Get("http" + strings.TrimPrefix(url, "ws"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusBadRequest {
+		t.Fatalf("plain request: %s", r.Status)
+	}
+}
+
+func TestSubprotocol(t *testing.T) {
+	url := newEchoServer(t, &websocket.Upgrader{Subprotocols: []string{"v2", "v1"}})
+	tests := []struct {
+		requested []string
+		selected  string
+	}{
+		{[]string{"v1", "v2"}, "v2"},
+		{[]string{"v1"}, "v1"},
+		{[]string{"v3"}, ""},
+		{nil, ""},
+	}
+	for _, test := range tests {
+		dialer := &websocket.Dialer{Subprotocols: test.requested}
+		conn, resp, err := dialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if conn.Subprotocol() != test.selected || resp.Header.Get("Sec-WebSocket-Protocol") != test.selected {
+			t.Fatalf("requested %v: selected %q, want %q", test.requested, conn.Subprotocol(), test.selected)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package network_test
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/iakud/plume/network"
+	"github.com/iakud/plume/network/websocket"
+)
+
+type wsHandler struct {
+	connected chan *network.WSConnection
+	received  chan string
+	closed    chan error
+}
+
+func newWSHandler() *wsHandler {
+	h := &wsHandler{
+		connected: make(chan *network.WSConnection, 1),
+		received:  make(chan string, 4),
+		closed:    make(chan error, 1),
+	}
+	return h
+}
+
+func (h *wsHandler) Connect(connection *network.WSConnection, connected bool) {
+	if connected {
+		h.connected <- connection
+		return
+	}
+	h.closed <- connection.Err()
+}
+
+func (h *wsHandler) Receive(connection *network.WSConnection, data []byte) {
+	h.received <- string(data)
+}
+
+func serveWS(t *testing.T, addr string, handler network.WSHandler, opt ...network.Option) {
+	httpServer := &http.Server{Addr: addr, Handler: network.NewWSServer(handler, opt...)}
+	go httpServer.ListenAndServe()
+	t.Cleanup(func() { httpServer.Close() })
+	time.Sleep(time.Millisecond * 100)
+}
+
+func dialWS(t *testing.T, url string, handler network.WSHandler, opt ...network.Option) {
+	client := network.NewWSClient(url, handler, opt...)
+	go client.DialAndServe()
+	t.Cleanup(client.Close)
+}
+
+func wantCloseCode(t *testing.T, err error, code int) {
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != code {
+		t.Fatalf("close: %v, want status %d", err, code)
+	}
+}
+
+func TestWSCloseCode(t *testing.T) {
+	srv := newWSHandler()
+	serveWS(t, "localhost:8016", srv, network.WithCompression())
+	c := newWSHandler()
+	dialWS(t, "ws://localhost:8016", c, network.WithCompression())
+
+	client := <-c.connected
+	client.SendText([]byte("text"))
+	client.Send(make([]byte, 4096))
+	if s := <-srv.received; s != "text" {
+		t.Fatalf("received %q", s)
+	}
+	if s := <-srv.received; len(s) != 4096 {
+		t.Fatalf("received %d bytes", len(s))
+	}
+	server := <-srv.connected
+	server.ShutdownWithCode(4001, "kicked")
+	err := <-c.closed
+	wantCloseCode(t, err, 4001)
+	if err.(*websocket.CloseError).Text != "kicked" {
+		t.Fatalf("close text: %v", err)
+	}
+	wantCloseCode(t, <-srv.closed, 4001) // echoed by the client
+}
+
+func TestWSMaxMessageSize(t *testing.T) {
+	srv := newWSHandler()
+	serveWS(t, "localhost:8017", srv, network.WithMaxMessageSize(1024))
+	c := newWSHandler()
+	dialWS(t, "ws://localhost:8017", c)
+
+	(<-c.connected).Send(make([]byte, 1025))
+	if err := <-srv.closed; err != websocket.ErrMessageTooLarge {
+		t.Fatalf("server close: %v", err)
+	}
+	wantCloseCode(t, <-c.closed, websocket.CloseMessageTooBig)
+}
+
+func TestWSPing(t *testing.T) {
+	srv := newWSHandler()
+	serveWS(t, "localhost:8018", srv, network.WithReadIdleTimeout(time.Millisecond*200))
+	c := newWSHandler()
+	dialWS(t, "ws://localhost:8018", c, network.WithPingInterval(time.Millisecond*50))
+
+	<-srv.connected
+	select {
+	case err := <-srv.closed:
+		t.Fatalf("closed with pings: %v", err)
+	case <-time.After(time.Millisecond * 600):
+	}
+}
+
+func TestWSOrigin(t *testing.T) {
+	srv := newWSHandler()
+	serveWS(t, "localhost:8019", srv, network.WithOrigins("http://example.com"))
+	err := network.NewWSClient("ws://localhost:8019", nil).DialAndServe()
+	if err != websocket.ErrBadHandshake {
+		t.Fatalf("dial from other origin: %v", err)
+	}
+
+	serveWS(t, "localhost:8020", srv, network.WithOrigins("http://localhost:8020"), network.WithSubprotocols("game.v2", "game.v1"))
+	c := newWSHandler()
+	dialWS(t, "ws://localhost:8020/?token=abc", c, network.WithSubprotocols("game.v1", "game.v2"))
+	server := <-srv.connected
+	if token := server.Request().URL.Query().Get("token"); token != "abc" {
+		t.Fatalf("request token %q", token)
+	}
+	if server.Subprotocol() != "game.v2" || (<-c.connected).Subprotocol() != "game.v2" {
+		t.Fatalf("subprotocol %q", server.Subprotocol())
+	}
+}
@@ -1,12 +1,15 @@
 package network
 
 import (
+	"context"
 	"errors"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"sync"
-	"time"
 
-	"golang.org/x/net/websocket"
+	"github.com/iakud/plume/network/websocket"
 )
 
 var (
@@ -17,17 +20,23 @@ type WSClient struct {
 	Url     string
 	Handler WSHandler
 	retry   bool
+	opts    options
 
 	mutex      sync.Mutex
 	connection *WSConnection
 	closed     bool
+	done       chan struct{}
 }
 
-func NewWSClient(url string, handler WSHandler) *WSClient {
+func NewWSClient(url string, handler WSHandler, opt ...Option) *WSClient {
 	client := &WSClient{
 		Url:     url,
 		Handler: handler,
 	}
+	for _, o := range opt {
+		o(&client.opts)
+	}
+	client.retry = client.opts.backoff != nil
 	return client
 }
 
@@ -35,11 +44,16 @@ func (c *WSClient) EnableRetry()  { c.retry = true }
 func (c *WSClient) DisableRetry() { c.retry = false }
 
 func DialAndServeWS(url string, handler WSHandler) error {
-	client := &WSClient{Url: url, Handler: handler}
+	client := NewWSClient(url, handler)
 	return client.DialAndServe()
 }
 
 func (c *WSClient) DialAndServe() error {
+	return c.DialAndServeContext(context.Background())
+}
+
+// DialAndServeContext is DialAndServe, see TCPClient.DialAndServeContext.
+func (c *WSClient) DialAndServeContext(ctx context.Context) error {
 	if c.isClosed() {
 		return ErrWSClientClosed
 	}
@@ -49,40 +63,74 @@ func (c *WSClient) DialAndServe() error {
 		handler = DefaultWSHandler
 	}
 
-	var tempDelay time.Duration // how long to sleep on connect failure
+	ctx, cancel := clientContext(ctx, c.doneChan(), c.closeConnection)
+	defer cancel()
+	retrier := newRetrier(&c.opts)
 	for {
-		conn, err := websocket.Dial(c.Url, "", "http://localhost/")
+		conn, _, err := c.dial(ctx)
 		if err != nil {
 			if c.isClosed() {
 				return ErrWSClientClosed
 			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			if !c.retry {
 				return err
 			}
-
-			if tempDelay == 0 {
-				tempDelay = 1 * time.Second
-			} else {
-				tempDelay *= 2
+			delay, ok := retrier.next(err)
+			if !ok {
+				return err
 			}
-			if max := 1 * time.Minute; tempDelay > max {
-				tempDelay = max
+			log.Printf("network: Websocket client dial error: %v; retrying in %v", err, delay)
+			if !sleep(ctx, delay) {
+				if c.isClosed() {
+					return ErrWSClientClosed
+				}
+				return ctx.Err()
 			}
-			log.Printf("network: Websocket client dial error: %v; retrying in %v", err, tempDelay)
-			time.Sleep(tempDelay)
 			continue
 		}
-		tempDelay = 0
+		retrier.reset()
 
-		connection := newWSConnection(conn)
-		if err := c.newConnection(connection); err != nil {
+		connection := newWSConnection(conn, &c.opts)
+		if err := c.newConnection(ctx, connection); err != nil {
 			connection.Close()
 			return err
 		}
 		if err := c.serveConnection(connection, handler); err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *WSClient) dial(ctx context.Context) (*websocket.Conn, *http.Response, error) {
+	dialer := websocket.Dialer{
+		TLSClientConfig:   c.opts.tlsConfig,
+		Subprotocols:      c.opts.subprotocols,
+		HandshakeTimeout:  websocket.DefaultDialer.HandshakeTimeout,
+		EnableCompression: c.opts.compression,
+	}
+	if c.opts.dialTimeout > 0 {
+		dialer.HandshakeTimeout = c.opts.dialTimeout
+	}
+	if c.opts.dial != nil {
+		dialer.NetDial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return c.opts.dial(ctx, addr)
+		}
+	}
+	header := make(http.Header)
+	if u, err := url.Parse(c.Url); err == nil {
+		origin := &url.URL{Scheme: "http", Host: u.Host}
+		if u.Scheme == "wss" {
+			origin.Scheme = "https"
+		}
+		header.Set("Origin", origin.String())
 	}
+	return dialer.DialContext(ctx, c.Url, header)
 }
 
 func (c *WSClient) isClosed() bool {
@@ -91,13 +139,31 @@ func (c *WSClient) isClosed() bool {
 	return c.closed
 }
 
-func (c *WSClient) newConnection(connection *WSConnection) error {
+// doneChan returns the channel closed by Close, WSClient may be used without
+// NewWSClient.
+func (c *WSClient) doneChan() chan struct{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.done == nil {
+		c.done = make(chan struct{})
+		if c.closed {
+			close(c.done)
+		}
+	}
+	return c.done
+}
+
+func (c *WSClient) newConnection(ctx context.Context, connection *WSConnection) error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
 	if c.closed {
 		return ErrWSClientClosed
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	c.connection = connection
 	return nil
 }
@@ -133,9 +199,23 @@ func (c *WSClient) Close() {
 		return
 	}
 	c.closed = true
+	if c.done != nil {
+		close(c.done)
+	}
 	if c.connection == nil {
 		return
 	}
-	c.connection.Close()
+	c.connection.closeWithReason(CloseReason{CloseServer, ErrWSClientClosed})
 	c.connection = nil
 }
+
+// closeConnection closes the connection when the context of
+// DialAndServeContext is done.
+func (c *WSClient) closeConnection(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.connection != nil {
+		c.connection.closeWithReason(CloseReason{CloseServer, err})
+	}
+}
@@ -1,58 +1,175 @@
 package network
 
 import (
+	"context"
 	"errors"
+	"log"
 	"net"
+	"net/http"
+	"runtime"
 	"sync"
 	"time"
 
-	"golang.org/x/net/websocket"
+	"github.com/iakud/plume/eventloop"
+	"github.com/iakud/plume/network/websocket"
 )
 
 var (
 	ErrWSConnectionPendingSendFull = errors.New("network: WebSocket connection pending send full")
 )
 
+// wsCloseTimeout bounds the wait for the peer close frame after ours is sent.
+const wsCloseTimeout = 5 * time.Second
+
 type WSConnection struct {
-	conn *websocket.Conn
+	conn      *websocket.Conn
+	req       *http.Request
+	readIdle  time.Duration
+	writeIdle *writeIdle
+	pingIdle  *writeIdle
+	heartbeat *heartbeat
+
+	loop    *eventloop.EventLoop
+	queue   *sendQueue
+	metrics *Metrics
+
+	admission *Admission
+	limiter   *tokenBucket
+
+	mutex     sync.Mutex
+	reason    CloseReason
+	closeCode int
+	closeText string
+	hooks     closeHooks
 
-	bufs        [][]byte
-	pendingSend int
-	mutex       sync.Mutex
-	cond        *sync.Cond
-	closed      bool
+	Userdata interface{}
 }
 
-func newWSConnection(conn *websocket.Conn) *WSConnection {
-	connection := &WSConnection{conn: conn}
-	connection.cond = sync.NewCond(&connection.mutex)
+func newWSConnection(conn *websocket.Conn, opts *options) *WSConnection {
+	connection := &WSConnection{
+		conn:      conn,
+		readIdle:  opts.readIdleTimeout,
+		heartbeat: opts.heartbeat,
+		loop:      opts.loops.get(conn.RemoteAddr()),
+		metrics:   opts.metrics,
+	}
+	connection.queue = newSendQueue(ErrWSConnectionPendingSendFull, connection.handleSlow)
+	connection.queue.setBackpressure(opts.backpressure)
+	connection.queue.metrics = opts.metrics
+	var ping func()
+	if opts.heartbeat != nil {
+		ping = connection.sendHeartbeat
+	}
+	connection.writeIdle = newWriteIdle(opts.writeIdleTimeout, ping)
+	connection.pingIdle = newWriteIdle(opts.pingInterval, connection.ping)
+	conn.SetReadLimit(int64(opts.maxMessageSize))
+	conn.SetPingHandler(connection.handlePing)
+	conn.SetPongHandler(connection.handlePong)
 	return connection
 }
 
 func (c *WSConnection) serve(handler WSHandler) {
+	defer c.hooks.run()
 	defer c.conn.Close()
+	c.metrics.connect()
+	defer func() { c.metrics.disconnect(c.CloseReason()) }()
 
 	// start write
 	c.startBackgroundWrite()
 	defer c.stopBackgroundWrite()
+	c.writeIdle.start()
+	defer c.writeIdle.stop()
+	c.pingIdle.start()
+	defer c.pingIdle.stop()
 
 	// conn event
-	handler.Connect(c, true)
-	defer handler.Connect(c, false)
+	c.runInLoop(func() { handler.Connect(c, true) })
+	defer c.runInLoopWait(func() { handler.Connect(c, false) })
+	c.readLoop(handler)
+}
+
+func (c *WSConnection) readLoop(handler WSHandler) {
+	defer func() {
+		if err := recover(); err != nil {
+			const size = 64 << 10
+			buf := make([]byte, size)
+			buf = buf[:runtime.Stack(buf, false)]
+			log.Printf("network: panic serving %v: %v\n%s", c.RemoteAddr(), err, buf)
+			c.closeWithReason(panicCloseReason(err))
+		}
+	}()
+
 	for {
-		var data []byte
-		if err := websocket.Message.Receive(c.conn, &data); err != nil {
-			c.conn.Close()
-			break
+		if c.readIdle > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.readIdle))
+		}
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.closeWithReason(wsReadCloseReason(err))
+			return
 		}
-		handler.Receive(c, data)
+		if !c.limiter.allow() {
+			c.admission.overMessageRate(c.RemoteAddr())
+			c.closeWithReason(CloseReason{CloseRateLimit, ErrMessageRate})
+			return
+		}
+		c.metrics.received(len(data))
+		if c.heartbeat.receive(data, c.Send) {
+			continue
+		}
+		c.metrics.receivedMessage()
+		c.runInLoop(func() { handler.Receive(c, data) })
 	}
 }
 
+// runInLoop calls the handler on the connection loop, if any.
+func (c *WSConnection) runInLoop(f func()) {
+	runInLoop(c.loop, c.RemoteAddr(), c.closeWithReason, f)
+}
+
+func (c *WSConnection) runInLoopWait(f func()) {
+	runInLoopWait(c.loop, c.RemoteAddr(), c.closeWithReason, f)
+}
+
+// wsReadCloseReason is readCloseReason, a close frame from the peer is
+// recorded with its *websocket.CloseError.
+func wsReadCloseReason(err error) CloseReason {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return CloseReason{ClosePeer, err}
+	}
+	return readCloseReason(err)
+}
+
+func (c *WSConnection) handlePing(data []byte) error {
+	c.extendReadDeadline()
+	if err := c.conn.WriteControl(websocket.PongMessage, data); err != nil && err != websocket.ErrCloseSent {
+		return err
+	}
+	return nil
+}
+
+func (c *WSConnection) handlePong([]byte) error {
+	c.extendReadDeadline()
+	return nil
+}
+
+func (c *WSConnection) extendReadDeadline() {
+	if c.readIdle > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.readIdle))
+	}
+}
+
+func (c *WSConnection) ping() {
+	c.conn.WriteControl(websocket.PingMessage, nil)
+}
+
+func (c *WSConnection) sendHeartbeat() {
+	c.Send(c.heartbeat.ping)
+}
+
 func (c *WSConnection) startBackgroundWrite() {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	if c.closed {
+	if c.queue.isClosed() {
 		return
 	}
 	go c.backgroundWrite()
@@ -60,45 +177,75 @@ func (c *WSConnection) startBackgroundWrite() {
 
 func (c *WSConnection) backgroundWrite() {
 	for closed := false; !closed; {
-		var bufs [][]byte
+		var bufs []outgoing
+		bufs, closed = c.queue.take()
 
-		c.mutex.Lock()
-		for !c.closed && len(c.bufs) == 0 {
-			c.cond.Wait()
+		if c.writeIdle != nil {
+			c.conn.SetWriteDeadline(time.Now().Add(c.writeIdle.timeout))
+		}
+		start := time.Now()
+		err := c.write(bufs)
+		if err == nil {
+			c.metrics.written(bufs, time.Since(start))
 		}
-		bufs, c.bufs = c.bufs, bufs // swap
-		closed = c.closed
-		c.mutex.Unlock()
-
-		for _, message := range bufs {
-			if err := websocket.Message.Send(c.conn, message); err != nil {
-				c.closeWrite()
-				c.conn.Close()
-				return
-			}
+		releaseAll(bufs)
+		if err == websocket.ErrCloseSent {
+			// the peer closed first, the read loop closes the connection
+			c.closeWrite()
+			releaseAll(c.queue.discard())
+			return
 		}
+		if err != nil {
+			c.closeWrite()
+			releaseAll(c.queue.discard())
+			c.closeWithReason(writeCloseReason(err))
+			return
+		}
+		c.writeIdle.written()
+		c.pingIdle.written()
 	}
 	// not writing now
-	c.conn.Close()
+	c.writeClose()
 }
 
-func (c *WSConnection) stopBackgroundWrite() {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	if c.closed {
-		return
+func (c *WSConnection) write(bufs []outgoing) error {
+	for _, o := range bufs {
+		messageType := websocket.BinaryMessage
+		if o.text {
+			messageType = websocket.TextMessage
+		}
+		if err := c.conn.WriteMessage(messageType, o.b); err != nil {
+			return err
+		}
 	}
-	c.closed = true
-	c.cond.Signal()
+	return nil
 }
 
-func (c *WSConnection) closeWrite() {
+// writeClose starts the close handshake, the connection is closed when the
+// peer answers or after wsCloseTimeout.
+func (c *WSConnection) writeClose() {
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	if c.closed {
+	code, text := c.closeCode, c.closeText
+	if code == 0 {
+		code = websocket.CloseNormalClosure
+		if c.reason.Cause == CloseServer {
+			code = websocket.CloseGoingAway
+		}
+	}
+	c.mutex.Unlock()
+	if err := c.conn.WriteClose(code, text); err != nil && err != websocket.ErrCloseSent {
+		c.closeWithReason(writeCloseReason(err))
 		return
 	}
-	c.closed = true
+	c.CloseWithTimeout(wsCloseTimeout)
+}
+
+func (c *WSConnection) stopBackgroundWrite() {
+	c.queue.close()
+}
+
+func (c *WSConnection) closeWrite() {
+	c.queue.close()
 }
 
 func (c *WSConnection) LocalAddr() net.Addr {
@@ -109,36 +256,137 @@ func (c *WSConnection) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
 
+// Request returns the upgrade request of server connections, nil for client
+// connections. Its body must not be read.
+func (c *WSConnection) Request() *http.Request {
+	return c.req
+}
+
+// Subprotocol returns the negotiated subprotocol, empty when none.
+func (c *WSConnection) Subprotocol() string {
+	return c.conn.Subprotocol()
+}
+
+// Loop returns the event loop Connect and Receive are called on, nil when
+// they are called on the read goroutine.
+func (c *WSConnection) Loop() *eventloop.EventLoop {
+	return c.loop
+}
+
+// SetPendingSend limits the number of messages pending send, see
+// SetBackpressure.
 func (c *WSConnection) SetPendingSend(pendingSend int) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	c.pendingSend = pendingSend
+	c.queue.setPendingSend(pendingSend)
 }
 
+func (c *WSConnection) SetBackpressure(backpressure Backpressure) {
+	c.queue.setBackpressure(backpressure)
+}
+
+func (c *WSConnection) SendStats() SendStats {
+	return c.queue.stats()
+}
+
+// Send sends data as a binary message.
 func (c *WSConnection) Send(data []byte) error {
+	return c.SendContext(context.Background(), data)
+}
+
+// SendText sends data as a text message, it must be valid UTF-8.
+func (c *WSConnection) SendText(data []byte) error {
 	if len(data) == 0 {
 		return nil
 	}
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	if c.closed {
+	return c.queue.push(context.Background(), outgoing{b: data, text: true})
+}
+
+// SendBuffer sends buffer.B, see TCPConnection.SendBuffer.
+func (c *WSConnection) SendBuffer(buffer *Buffer) error {
+	if len(buffer.B) == 0 {
+		buffer.Release()
 		return nil
 	}
-	if c.pendingSend > 0 && len(c.bufs) >= c.pendingSend {
-		return ErrWSConnectionPendingSendFull
+	return c.queue.push(context.Background(), outgoing{b: buffer.B, buffer: buffer})
+}
+
+// SendContext is Send, ctx bounds the wait when the OverflowBlock policy is
+// used.
+func (c *WSConnection) SendContext(ctx context.Context, data []byte) error {
+	if len(data) == 0 {
+		return nil
 	}
-	c.bufs = append(c.bufs, data)
-	c.cond.Signal()
-	return nil
+	return c.queue.push(ctx, outgoing{b: data})
 }
 
+func (c *WSConnection) handleSlow() {
+	c.closeWithReason(CloseReason{CloseSlowConsumer, ErrSlowConsumer})
+}
+
+// Shutdown sends the pending messages then the close frame, status 1000 or
+// 1001 when the server or client is closing.
 func (c *WSConnection) Shutdown() {
 	c.stopBackgroundWrite()
 }
 
+// ShutdownWithCode is Shutdown with the close frame status code and text.
+func (c *WSConnection) ShutdownWithCode(code int, text string) {
+	c.mutex.Lock()
+	if c.closeCode == 0 {
+		c.closeCode, c.closeText = code, text
+	}
+	c.mutex.Unlock()
+	c.Shutdown()
+}
+
+// shutdown records reason for the connection closed after it is drained.
+func (c *WSConnection) shutdown(reason CloseReason) {
+	c.mutex.Lock()
+	if c.reason.Cause == CloseNone {
+		c.reason = reason
+	}
+	c.mutex.Unlock()
+	c.Shutdown()
+}
+
 func (c *WSConnection) Close() {
+	c.closeWithReason(CloseReason{CloseLocal, ErrConnectionClosed})
+}
+
+func (c *WSConnection) closeWithReason(reason CloseReason) {
+	c.mutex.Lock()
+	if c.reason.Cause == CloseNone {
+		c.reason = reason
+	}
+	c.mutex.Unlock()
 	c.conn.Close()
 }
+
+// CloseReason returns why the connection was closed, it is set before the
+// disconnect event.
+func (c *WSConnection) CloseReason() CloseReason {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.reason
+}
+
+// Err returns the error of CloseReason, see TCPConnection.Err. When the peer
+// sent a close frame it is a *websocket.CloseError with the status code.
+func (c *WSConnection) Err() error {
+	return c.CloseReason().Err
+}
+
 func (c *WSConnection) CloseWithTimeout(timeout time.Duration) {
 	time.AfterFunc(timeout, c.Close)
 }
+
+func (c *WSConnection) GetUserdata() interface{} {
+	return c.Userdata
+}
+
+func (c *WSConnection) SetUserdata(userdata interface{}) {
+	c.Userdata = userdata
+}
+
+func (c *WSConnection) onClose(f func()) (remove func(), ok bool) {
+	return c.hooks.add(f)
+}
@@ -1,12 +1,13 @@
 package network
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"net/http"
+	"net/url"
 	"sync"
 
-	"golang.org/x/net/websocket"
+	"github.com/iakud/plume/network/websocket"
 )
 
 var (
@@ -14,42 +15,85 @@ var (
 )
 
 type WSServer struct {
-	Handler WSHandler
-	server  websocket.Server
+	Handler  WSHandler
+	upgrader websocket.Upgrader
+	opts     options
 
 	mutex       sync.Mutex
 	connections map[*WSConnection]struct{}
 	closed      bool
+	drained     chan struct{}
 }
 
-func NewWSServer(handler WSHandler) *WSServer {
+func NewWSServer(handler WSHandler, opt ...Option) *WSServer {
 	server := &WSServer{
 		Handler:     handler,
 		connections: make(map[*WSConnection]struct{}),
 	}
-	server.server = websocket.Server{Handler: server.serveWebSocket, Handshake: checkOrigin}
+	for _, o := range opt {
+		o(&server.opts)
+	}
+	server.upgrader = websocket.Upgrader{
+		CheckOrigin:       server.opts.checkOrigin,
+		Subprotocols:      server.opts.subprotocols,
+		EnableCompression: server.opts.compression,
+	}
+	if server.upgrader.CheckOrigin == nil {
+		server.upgrader.CheckOrigin = checkOrigin
+	}
 	return server
 }
 
-func checkOrigin(config *websocket.Config, req *http.Request) (err error) {
-	config.Origin, err = websocket.Origin(config, req)
-	if err == nil && config.Origin == nil {
-		return fmt.Errorf("null origin")
+// checkOrigin rejects requests without a valid Origin header.
+func checkOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return false
 	}
-	return err
+	_, err := url.ParseRequestURI(origin)
+	return err == nil
 }
 
 func (s *WSServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	s.server.ServeHTTP(w, req)
+	addr := httpAddr(req.RemoteAddr)
+	if err := s.opts.admission.admit(addr); err != nil {
+		status := http.StatusServiceUnavailable
+		if err == ErrBanned {
+			status = http.StatusForbidden
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	conn, err := s.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		s.opts.admission.release(addr)
+		return
+	}
+	s.serveWebSocket(conn, req)
+	s.opts.admission.release(addr)
+}
+
+// httpAddr is the remote address of an HTTP request.
+type httpAddr string
+
+func (httpAddr) Network() string {
+	return "tcp"
+}
+
+func (a httpAddr) String() string {
+	return string(a)
 }
 
-func (s *WSServer) serveWebSocket(conn *websocket.Conn) {
+func (s *WSServer) serveWebSocket(conn *websocket.Conn, req *http.Request) {
 	handler := s.Handler
 	if handler == nil {
 		handler = DefaultWSHandler
 	}
 
-	connection := newWSConnection(conn)
+	connection := newWSConnection(conn, &s.opts)
+	connection.req = req
+	connection.admission = s.opts.admission
+	connection.limiter = s.opts.admission.messageLimiter()
 	if err := s.newConnection(connection); err != nil {
 		connection.Close() // close
 		return
@@ -72,10 +116,11 @@ func (s *WSServer) serveConnection(connection *WSConnection, handler WSHandler)
 	// remove connection
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	if s.closed {
-		return
-	}
 	delete(s.connections, connection)
+	if s.drained != nil && len(s.connections) == 0 {
+		close(s.drained)
+		s.drained = nil
+	}
 }
 
 func (s *WSServer) Close() {
@@ -87,7 +132,43 @@ func (s *WSServer) Close() {
 	}
 	s.closed = true
 	for connection := range s.connections {
-		connection.Close()
+		connection.closeWithReason(CloseReason{CloseServer, ErrWSServerClosed})
 		delete(s.connections, connection)
 	}
 }
+
+// Shutdown shuts down every connection and waits for them to be closed, see
+// TCPServer.Shutdown. The http.Server serving s is not shut down.
+func (s *WSServer) Shutdown(ctx context.Context) (drained int, forced int, err error) {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return 0, 0, ErrWSServerClosed
+	}
+	s.closed = true
+	total := len(s.connections)
+	done := make(chan struct{})
+	if total == 0 {
+		close(done)
+	} else {
+		s.drained = done
+	}
+	for connection := range s.connections {
+		connection.shutdown(CloseReason{CloseServer, ErrWSServerClosed})
+	}
+	s.mutex.Unlock()
+
+	select {
+	case <-done:
+		return total, 0, nil
+	case <-ctx.Done():
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	forced = len(s.connections)
+	for connection := range s.connections {
+		connection.closeWithReason(CloseReason{CloseServer, ErrWSServerClosed})
+	}
+	return total - forced, forced, ctx.Err()
+}